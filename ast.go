@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Position is a location in a Jettyfile. Line and Column are 1-based and
+// Column counts bytes.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (pos Position) String() string {
+	if pos.File == "" {
+		return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", pos.File, pos.Line, pos.Column)
+}
+
+// Token is a word of an instruction as written. Raw is the source text,
+// quotes included, and Value its unquoted form. End is the position just
+// after the token's last byte.
+type Token struct {
+	Raw   string
+	Value string
+	Start Position
+	End   Position
+}
+
+// Comment is a `#` comment line. Text includes the leading `#`.
+type Comment struct {
+	Text string
+	Pos  Position
+}
+
+// Node is one instruction as written in a Jettyfile. Keyword is the directive
+// token including its modifier, Options the leading --name[=value] tokens and
+// Args the remaining argument tokens. Text is the argument text after the
+// options, with continuation lines joined by newlines, as the build sees it.
+// Lines holds the physical source lines, continuation backslashes included,
+// and Comments the comment lines directly above the instruction. Heredoc is
+// the here-document the instruction ends with, if any.
+type Node struct {
+	Directive  string
+	Symbol     string
+	Keyword    Token
+	Options    []Token
+	Args       []Token
+	Text       string
+	OptionArgs map[string]string
+	Lines      []string
+	Comments   []Comment
+	Heredoc    *Heredoc
+	Start      Position
+	End        Position
+}
+
+// SourceFile is a parsed Jettyfile. Trailing holds the comments after the
+// last instruction.
+type SourceFile struct {
+	Name     string
+	Nodes    []*Node
+	Trailing []Comment
+}
+
+// ParseError is a syntax error at a position in a Jettyfile. Its message
+// keeps the `line N:` form of the build's other errors.
+type ParseError struct {
+	Pos Position
+	Err error
+}
+
+func (err *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", err.Pos.Line, err.Err)
+}
+
+func (err *ParseError) Unwrap() error {
+	return err.Err
+}
+
+// parseReader parses a Jettyfile into its syntax tree without resolving
+// includes, blocks, labels or targets. name is recorded in every position.
+func parseReader(name string, reader io.Reader) (*SourceFile, error) {
+	file := &SourceFile{Name: name}
+	scanner := bufio.NewScanner(reader)
+	var comments []Comment
+	var pending []string
+	var heredoc *Heredoc
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if heredoc != nil {
+			if heredoc.add(line) {
+				heredoc = nil
+			}
+			continue
+		}
+		trimmedLine := strings.TrimSpace(line)
+		if len(pending) == 0 && (trimmedLine == "" || strings.HasPrefix(trimmedLine, "#")) {
+			if trimmedLine != "" {
+				column := strings.Index(line, "#") + 1
+				comments = append(comments, Comment{Text: trimmedLine, Pos: Position{File: name, Line: lineNumber, Column: column}})
+			}
+			continue
+		}
+		pending = append(pending, line)
+		if strings.HasSuffix(strings.TrimRight(line, " \t"), "\\") {
+			continue
+		}
+		node, err := parseNode(name, lineNumber-len(pending)+1, pending)
+		if err != nil {
+			return nil, err
+		}
+		node.Comments = comments
+		file.Nodes = append(file.Nodes, node)
+		comments, pending = nil, nil
+		heredoc = startHeredoc(node)
+	}
+	if heredoc != nil {
+		return nil, &ParseError{Pos: heredoc.Marker.Start, Err: fmt.Errorf("unterminated heredoc: missing closing %s", heredoc.Delimiter)}
+	}
+	if len(pending) > 0 {
+		start := lineNumber - len(pending) + 1
+		return nil, &ParseError{Pos: Position{File: name, Line: start, Column: 1}, Err: fmt.Errorf("unterminated multi-line command")}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	file.Trailing = comments
+	return file, nil
+}
+
+// nodeText joins the physical lines of an instruction the way the build
+// sees them and maps byte offsets in the joined text back to positions.
+type nodeText struct {
+	text      string
+	file      string
+	firstLine int
+	starts    []int
+}
+
+func newNodeText(file string, firstLine int, lines []string) nodeText {
+	var text strings.Builder
+	starts := make([]int, len(lines))
+	for i, line := range lines {
+		starts[i] = text.Len()
+		if i < len(lines)-1 {
+			text.WriteString(strings.TrimSuffix(strings.TrimRight(line, " \t"), "\\"))
+			text.WriteByte('\n')
+		} else {
+			text.WriteString(line)
+		}
+	}
+	return nodeText{text: text.String(), file: file, firstLine: firstLine, starts: starts}
+}
+
+func (nt nodeText) position(offset int) Position {
+	segment := 0
+	for segment+1 < len(nt.starts) && nt.starts[segment+1] <= offset {
+		segment++
+	}
+	return Position{File: nt.file, Line: nt.firstLine + segment, Column: offset - nt.starts[segment] + 1}
+}
+
+func (nt nodeText) token(start int, end int) Token {
+	raw := nt.text[start:end]
+	value := raw
+	if parts, err := splitArgs(raw); err == nil && len(parts) == 1 {
+		value = parts[0]
+	}
+	return Token{Raw: raw, Value: value, Start: nt.position(start), End: nt.position(end)}
+}
+
+func parseNode(file string, firstLine int, lines []string) (*Node, error) {
+	nt := newNodeText(file, firstLine, lines)
+	start := len(nt.text) - len(strings.TrimLeftFunc(nt.text, unicode.IsSpace))
+	end := len(strings.TrimRightFunc(nt.text, unicode.IsSpace))
+	line := nt.text[start:end]
+	fail := func(offset int, err error) (*Node, error) {
+		return nil, &ParseError{Pos: nt.position(offset), Err: err}
+	}
+	parts := strings.Fields(line)
+	if len(parts) < 2 && !bareDirectives[strings.ToUpper(line)] {
+		return fail(start, fmt.Errorf("invalid instruction: %s", line))
+	}
+	keywordEnd := start + len(parts[0])
+	directive, symbol, err := parseDirectiveToken(parts[0])
+	if err != nil {
+		return fail(start, err)
+	}
+	if argumentlessDirectives[directive] && len(parts) > 1 {
+		return fail(start, fmt.Errorf("%s does not take arguments", directive))
+	}
+	options, args, err := parseInstructionOptions(directive, symbol, nt.text[keywordEnd:end])
+	if err != nil {
+		return fail(keywordEnd, err)
+	}
+	argsStart := end - len(args)
+	node := &Node{
+		Directive:  directive,
+		Symbol:     symbol,
+		Keyword:    nt.token(start, keywordEnd),
+		Text:       strings.TrimSpace(args),
+		OptionArgs: options,
+		Lines:      append([]string(nil), lines...),
+		Start:      nt.position(start),
+		End:        nt.position(end),
+	}
+	for _, span := range tokenSpans(nt.text, keywordEnd, end) {
+		token := nt.token(span[0], span[1])
+		if span[0] < argsStart {
+			node.Options = append(node.Options, token)
+		} else {
+			node.Args = append(node.Args, token)
+		}
+	}
+	return node, nil
+}
+
+// tokenSpans returns the [start, end) offsets of the words of text[from:to],
+// split at whitespace outside quotes and not escaped by a backslash.
+func tokenSpans(text string, from int, to int) [][2]int {
+	var spans [][2]int
+	start := -1
+	var quote byte
+	for i := from; i < to; i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' && i+1 < to {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if start >= 0 {
+				spans = append(spans, [2]int{start, i})
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+		switch c {
+		case '"', '\'':
+			quote = c
+		case '\\':
+			if i+1 < to {
+				i++
+			}
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, to})
+	}
+	return spans
+}
+
+// Instructions converts the file's nodes into the flat instruction list the
+// build executes.
+func (file *SourceFile) Instructions() []Instruction {
+	instructions := make([]Instruction, 0, len(file.Nodes))
+	for _, node := range file.Nodes {
+		instructions = append(instructions, Instruction{
+			Directive: node.Directive,
+			Symbol:    node.Symbol,
+			Args:      node.Text,
+			Options:   node.OptionArgs,
+			Line:      node.Start.Line,
+			Heredoc:   node.Heredoc,
+		})
+	}
+	return instructions
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseReaderRecordsPositions(t *testing.T) {
+	content := strings.Join([]string{
+		"# Build settings",
+		"ARG NAME=\"hello world\"",
+		"",
+		"# compile",
+		"# everything",
+		"  *RUN --timeout=5s go build \\",
+		"    -o 'bin/app' .",
+		"# done",
+		"",
+	}, "\n")
+	file, err := parseReader("Jettyfile", strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("parseReader returned error: %v", err)
+	}
+	if len(file.Nodes) != 2 {
+		t.Fatalf("expected 2 nodes, got %d", len(file.Nodes))
+	}
+
+	arg := file.Nodes[0]
+	if len(arg.Comments) != 1 || arg.Comments[0].Text != "# Build settings" || arg.Comments[0].Pos.String() != "Jettyfile:1:1" {
+		t.Fatalf("unexpected leading comments: %#v", arg.Comments)
+	}
+	if len(arg.Args) != 1 || arg.Args[0].Raw != `NAME="hello world"` || arg.Args[0].Value != "NAME=hello world" {
+		t.Fatalf("unexpected ARG tokens: %#v", arg.Args)
+	}
+	if arg.Args[0].Start.String() != "Jettyfile:2:5" || arg.Args[0].End.String() != "Jettyfile:2:23" {
+		t.Fatalf("ARG token spans %s-%s", arg.Args[0].Start, arg.Args[0].End)
+	}
+
+	run := file.Nodes[1]
+	if run.Directive != "RUN" || run.Symbol != "*" || run.Keyword.Raw != "*RUN" || run.Keyword.Start.String() != "Jettyfile:6:3" {
+		t.Fatalf("unexpected RUN keyword: %#v", run.Keyword)
+	}
+	if len(run.Comments) != 2 || run.Comments[1].Text != "# everything" {
+		t.Fatalf("unexpected RUN comments: %#v", run.Comments)
+	}
+	if len(run.Options) != 1 || run.Options[0].Raw != "--timeout=5s" || run.OptionArgs["timeout"] != "5s" {
+		t.Fatalf("unexpected RUN options: %#v %#v", run.Options, run.OptionArgs)
+	}
+	var values, starts []string
+	for _, token := range run.Args {
+		values = append(values, token.Value)
+		starts = append(starts, token.Start.String())
+	}
+	if strings.Join(values, " ") != "go build -o bin/app ." {
+		t.Fatalf("unexpected RUN values: %q", values)
+	}
+	if strings.Join(starts, " ") != "Jettyfile:6:21 Jettyfile:6:24 Jettyfile:7:5 Jettyfile:7:8 Jettyfile:7:18" {
+		t.Fatalf("unexpected RUN token starts: %q", starts)
+	}
+	if run.Start.String() != "Jettyfile:6:3" || run.End.String() != "Jettyfile:7:19" {
+		t.Fatalf("RUN spans %s-%s", run.Start, run.End)
+	}
+	if run.Text != "go build \n    -o 'bin/app' ." {
+		t.Fatalf("unexpected RUN text: %q", run.Text)
+	}
+	if len(run.Lines) != 2 || run.Lines[0] != "  *RUN --timeout=5s go build \\" {
+		t.Fatalf("expected the continuation layout to be kept, got %q", run.Lines)
+	}
+	if len(file.Trailing) != 1 || file.Trailing[0].Text != "# done" {
+		t.Fatalf("unexpected trailing comments: %#v", file.Trailing)
+	}
+}
+
+func TestParseReaderErrorPositions(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+		pos     string
+	}{
+		{"ARG A=1\n  NOPE x\n", "line 2: invalid directive: NOPE", "2:3"},
+		{"RUN --nope echo\n", "line 1: unknown option --nope for RUN", "1:4"},
+		{"ARG A=1\nRUN echo \\\n", "line 2: unterminated multi-line command", "2:1"},
+	}
+	for _, tc := range tests {
+		_, err := parseReader("", strings.NewReader(tc.content))
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Fatalf("parseReader(%q) error = %v, want a ParseError", tc.content, err)
+		}
+		if err.Error() != tc.want || parseErr.Pos.String() != tc.pos {
+			t.Errorf("parseReader(%q) = %q at %s, want %q at %s", tc.content, err, parseErr.Pos, tc.want, tc.pos)
+		}
+	}
+}
+
+func TestSourceFileInstructionsMatchParseFile(t *testing.T) {
+	file, err := parseReader("", strings.NewReader("ENV A=1\nRUN --retries=2 echo \\\n  $A\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instructions := file.Instructions()
+	if len(instructions) != 2 {
+		t.Fatalf("expected 2 instructions, got %d", len(instructions))
+	}
+	run := instructions[1]
+	if run.Directive != "RUN" || run.Args != "echo \n  $A" || run.Line != 2 || run.Options["retries"] != "2" {
+		t.Fatalf("unexpected instruction: %#v", run)
+	}
+}
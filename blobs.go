@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// errBlobCorrupt is returned when a stored blob no longer matches its digest.
+var errBlobCorrupt = errors.New("blob does not match its digest")
+
+// blobStorePath is the content-addressed store holding snapshots of OUT files,
+// one file per SHA-256 digest.
+func blobStorePath() string {
+	return filepath.Join(filepath.Dir(cacheStorePath()), "blobs")
+}
+
+func blobPath(digest string) string {
+	if len(digest) < 2 {
+		return filepath.Join(blobStorePath(), digest)
+	}
+	return filepath.Join(blobStorePath(), digest[:2], digest)
+}
+
+// storeBlob copies the file at path into the blob store and returns its
+// digest.
+func storeBlob(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	digest, err := writeBlob(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to store %s: %w", path, err)
+	}
+	return digest, nil
+}
+
+// writeBlob copies r into the blob store and returns its digest. Blobs are
+// written to a temporary file and renamed into place, so a concurrent reader
+// never sees a partial blob.
+func writeBlob(r io.Reader) (string, error) {
+	storeDir := blobStorePath()
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create blob store: %w", err)
+	}
+	temp, err := os.CreateTemp(storeDir, "blob-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create blob: %w", err)
+	}
+	defer os.Remove(temp.Name())
+
+	digest, err := copyWithDigest(temp, r)
+	if err != nil {
+		temp.Close()
+		return "", err
+	}
+	if err := temp.Close(); err != nil {
+		return "", err
+	}
+	// Renaming over an existing blob replaces one that may have been
+	// corrupted with a good copy.
+	target := blobPath(digest)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", fmt.Errorf("failed to create blob store: %w", err)
+	}
+	if err := os.Rename(temp.Name(), target); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// restoreBlob writes the blob digest to path with the given mode, creating
+// parent directories as needed. It returns errBlobCorrupt, leaving path
+// untouched, when the blob's content does not match its digest.
+func restoreBlob(digest string, path string, mode os.FileMode) error {
+	blob, err := os.Open(blobPath(digest))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to restore %s: %w", path, err)
+	}
+	defer os.Remove(temp.Name())
+
+	written, err := copyWithDigest(temp, blob)
+	if err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to restore %s: %w", path, err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", path, err)
+	}
+	if written != digest {
+		return errBlobCorrupt
+	}
+	if err := os.Chmod(temp.Name(), mode.Perm()); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", path, err)
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", path, err)
+	}
+	return nil
+}
+
+// fileDigest returns the SHA-256 digest of the file at path, as blobs are
+// named.
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return copyWithDigest(io.Discard, file)
+}
+
+// copyWithDigest copies r to w and returns the SHA-256 digest of the data.
+func copyWithDigest(w io.Writer, r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -49,14 +49,35 @@ type BuildInfo struct {
 	WorkerNode string    `json:"worker_node"`
 	FileName   string    `json:"file_name,omitempty"`
 	Error      string    `json:"error,omitempty"`
+	// Retries counts the extra attempts made by instructions with --retries.
+	Retries int64 `json:"retries,omitempty"`
+	// Steps is the per-instruction outcome of the build, ordered by line. It
+	// is delivered with the final record but not persisted.
+	Steps []StepResult `json:"-"`
 }
 
-// Instruction is a single parsed directive from a Jettyfile.
+// Instruction is a single parsed directive from a Jettyfile. Body holds the
+// instructions grouped under a TGT header or inside an IF or FOR block; Else
+// holds the alternative branch of an IF block. ID and After carry the step
+// label and dependencies declared by preceding ID/AFTER directives. Options
+// holds the leading --name[=value] options stripped from Args. File and
+// FileLine locate an instruction spliced in by INC, whose Line is then that
+// of the top-level INC. Macro is the DEF block a CALL expands. Heredoc is
+// the here-document the instruction ends with, if any.
 type Instruction struct {
 	Directive string
 	Symbol    string
 	Args      string
+	Options   map[string]string
 	Line      int
+	File      string
+	FileLine  int
+	Body      []Instruction
+	Else      []Instruction
+	ID        string
+	After     []string
+	Macro     *Instruction
+	Heredoc   *Heredoc
 }
 
 // Job describes a build to run, including its I/O channels and inherited state.
@@ -71,6 +92,20 @@ type Job struct {
 	InitialEnv    map[string]string
 	EnvFile       string
 	Depth         int
+	// Targets selects the TGT sections to run; empty runs every target.
+	Targets []string
+	// KeepGoing runs every step that does not depend on a failed one instead
+	// of stopping at the first failure.
+	KeepGoing bool
+	// DryRun evaluates the build and logs the commands it would run without
+	// running them. Dry runs are not recorded in the build status store.
+	DryRun bool
+	// Strict fails the build on a reference to an undefined variable.
+	Strict bool
+	// ExplainCache logs why each cacheable step that runs missed the cache.
+	ExplainCache bool
+	// Shell is the SHELL a sub-build inherits from its parent.
+	Shell []string
 	// SkipDefaultEnv suppresses loading an implicit <BaseDir>/.env. It is set
 	// for remotely fetched sub-builds whose BaseDir is a shared temp directory.
 	SkipDefaultEnv bool
@@ -94,6 +129,26 @@ type BuildState struct {
 	PendingDeps     []string
 	PendingOuts     []string
 	CurrentCacheKey string
+	// CurrentCacheInputs are the components of CurrentCacheKey.
+	CurrentCacheInputs *CacheInputs
+	// CacheHit is set when the last executed instruction was skipped as CACHED
+	// or RESTORED.
+	CacheHit bool
+	// KeepGoing keeps running independent steps after a step fails.
+	KeepGoing bool
+	// DryRun plans side-effecting instructions instead of executing them.
+	DryRun bool
+	// Strict makes a reference to an undefined variable an error.
+	Strict bool
+	// ExplainCache logs the reason for each cache miss.
+	ExplainCache bool
+	// ProvidedArgs names the ARGs seeded from Job.InitialArgs; an ARG
+	// default does not override them.
+	ProvidedArgs map[string]bool
+	// Shell is the program and arguments set by SHELL that RUN, CMD and USE
+	// run scripts with; empty means the platform default.
+	Shell []string
+	Stats *buildStats
 }
 
 // BoxInfo identifies a Docker image (repository and tag) for USE/FRM/BOX.
@@ -152,9 +207,15 @@ func processBuild(job Job) (err error) {
 		WorkerNode: job.WorkerNode,
 		FileName:   absFileName,
 	}
-	publishBuildInfo(job.Context, job.BuildInfoChan, buildInfo)
+	// Dry runs are reported to the caller but not persisted.
+	publish := publishBuildInfo
+	if job.DryRun {
+		publish = sendBuildInfo
+	}
+	publish(job.Context, job.BuildInfoChan, buildInfo)
 
 	var buildErr error
+	stats := &buildStats{}
 	defer func() {
 		if r := recover(); r != nil {
 			// Convert a panic into a Failed build and a returned error rather
@@ -165,13 +226,15 @@ func processBuild(job Job) (err error) {
 			sendResult(job.Context, job.ResultChan, "Error: "+buildErr.Error())
 		}
 		buildInfo.EndTime = time.Now()
+		buildInfo.Retries = stats.retries.Load()
+		buildInfo.Steps = stats.stepResults()
 		if buildErr != nil {
 			buildInfo.Status = statusFailed
 			buildInfo.Error = buildErr.Error()
 		} else {
 			buildInfo.Status = statusCompleted
 		}
-		publishBuildInfo(job.Context, job.BuildInfoChan, buildInfo)
+		publish(job.Context, job.BuildInfoChan, buildInfo)
 	}()
 
 	instructions, err := parseFile(absFileName)
@@ -180,22 +243,48 @@ func processBuild(job Job) (err error) {
 		sendResult(job.Context, job.ResultChan, "Error: "+buildErr.Error())
 		return fmt.Errorf("%w: %w", ErrBuildFailed, buildErr)
 	}
+	instructions, err = selectTargets(instructions, job.Targets)
+	if err != nil {
+		buildErr = fmt.Errorf("select targets in %s: %w", job.FileName, err)
+		sendResult(job.Context, job.ResultChan, "Error: "+buildErr.Error())
+		return fmt.Errorf("%w: %w", ErrBuildFailed, buildErr)
+	}
+	if err := validateSteps(instructions); err != nil {
+		buildErr = fmt.Errorf("parse %s: %w", job.FileName, err)
+		sendResult(job.Context, job.ResultChan, "Error: "+buildErr.Error())
+		return fmt.Errorf("%w: %w", ErrBuildFailed, buildErr)
+	}
+	if err := checkProvidedArgs(instructions, job.InitialArgs, filepath.Dir(absFileName)); err != nil {
+		buildErr = fmt.Errorf("check build args for %s: %w", job.FileName, err)
+		sendResult(job.Context, job.ResultChan, "Error: "+buildErr.Error())
+		return fmt.Errorf("%w: %w", ErrBuildFailed, buildErr)
+	}
 
 	execCtx, cancel := context.WithCancel(job.Context)
 	defer cancel()
 	state := &BuildState{
-		Context:    execCtx,
-		FileName:   absFileName,
-		BaseDir:    filepath.Dir(absFileName),
-		WorkDir:    filepath.Dir(absFileName),
-		BuildID:    job.BuildID,
-		WorkerNode: job.WorkerNode,
-		Args:       cloneStringMap(job.InitialArgs),
-		Env:        cloneStringMap(job.InitialEnv),
-		Boxes:      make(map[string]BoxInfo),
-		ResultChan: job.ResultChan,
-		Cancel:     cancel,
-		Depth:      job.Depth,
+		Context:      execCtx,
+		FileName:     absFileName,
+		BaseDir:      filepath.Dir(absFileName),
+		WorkDir:      filepath.Dir(absFileName),
+		BuildID:      job.BuildID,
+		WorkerNode:   job.WorkerNode,
+		Args:         cloneStringMap(job.InitialArgs),
+		Env:          cloneStringMap(job.InitialEnv),
+		Boxes:        make(map[string]BoxInfo),
+		ResultChan:   job.ResultChan,
+		Cancel:       cancel,
+		Depth:        job.Depth,
+		KeepGoing:    job.KeepGoing,
+		DryRun:       job.DryRun,
+		Strict:       job.Strict,
+		ExplainCache: job.ExplainCache,
+		Shell:        job.Shell,
+		Stats:        stats,
+	}
+	state.ProvidedArgs = make(map[string]bool, len(job.InitialArgs))
+	for key := range job.InitialArgs {
+		state.ProvidedArgs[key] = true
 	}
 	state.Args["BUILD_ID"] = job.BuildID
 	state.Args["WORKER_NODE"] = job.WorkerNode
@@ -224,102 +313,244 @@ func processBuild(job Job) (err error) {
 	return nil
 }
 
+// instructionRunner executes a (possibly nested) instruction list, tracking
+// the async workers and the deferred CMD shared by every block of a build.
+type instructionRunner struct {
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	tasks []*asyncTask
+	cmd   *Instruction
+	steps map[string]*stepNode
+	// failures holds the errors --keep-going recorded instead of stopping.
+	failures []error
+}
+
 func executeInstructions(state *BuildState, instructions []Instruction) error {
-	var wg sync.WaitGroup
+	runner := &instructionRunner{}
 	// Ensure async workers are drained even if a synchronous instruction panics,
 	// so processBuild does not close the result channel while a worker still
-	// writes to it.
-	defer wg.Wait()
-	errChan := make(chan error, len(instructions))
-	var cmdInstruction *Instruction
-	var syncErr error
+	// writes to it. Unfinished steps are released first so no worker is left
+	// waiting on a step that will never run.
+	defer func() {
+		runner.releaseSteps()
+		runner.wg.Wait()
+	}()
+
+	syncErr := runner.run(state, instructions)
+
+	runner.releaseSteps()
+	runner.wg.Wait()
+	errs := append(runner.failures, runner.unclaimedErrors()...)
+	if syncErr != nil {
+		errs = append([]error{syncErr}, errs...)
+	}
+	if len(errs) > 0 {
+		if runner.cmd != nil {
+			state.recordStep(*runner.cmd, stepSkipped, nil)
+		}
+		if len(errs) == 1 {
+			return errs[0]
+		}
+		return errors.Join(errs...)
+	}
 
+	if runner.cmd != nil {
+		if err := executeCMD(state, *runner.cmd); err != nil {
+			state.recordStep(*runner.cmd, stepFailed, err)
+			return fmt.Errorf("%s [%s%s %s]: %w", runner.cmd.location(), runner.cmd.Symbol, runner.cmd.Directive, runner.cmd.Args, err)
+		}
+		state.recordStep(*runner.cmd, stepPassed, nil)
+	}
+	return nil
+}
+
+// run executes instructions in order, recursing into the taken branch of IF
+// blocks and into each iteration of FOR blocks. Async instructions are
+// handed to the runner's shared wait group so those launched inside a branch
+// are joined with the rest of the build.
+func (runner *instructionRunner) run(state *BuildState, instructions []Instruction) error {
 	for i, inst := range instructions {
 		if err := state.Context.Err(); err != nil {
-			syncErr = err
-			break
+			return err
 		}
-		if inst.Directive == "CMD" {
-			if cmdInstruction != nil {
-				syncErr = fmt.Errorf("line %d: multiple CMD directives are not allowed", inst.Line)
+		count := i + 1
+		switch inst.Directive {
+		case "CMD":
+			if runner.cmd != nil {
 				state.cancel()
-				break
+				return fmt.Errorf("%s: multiple CMD directives are not allowed", inst.location())
 			}
 			cmdCopy := inst
-			cmdInstruction = &cmdCopy
+			runner.cmd = &cmdCopy
 			continue
-		}
-
-		count := i + 1
-		if inst.Symbol == "*" {
-			asyncState := state.snapshot()
-			state.PendingDeps = nil
-			state.PendingOuts = nil
-			state.CurrentCacheKey = ""
-
-			wg.Add(1)
-			go func(instruction Instruction, instructionNumber int, instructionState *BuildState) {
-				defer wg.Done()
-				// Recover panics in the worker goroutine: Go's recover only
-				// catches panics on its own stack, so without this a panic here
-				// would crash the whole CLI, bypassing processBuild's recover.
-				defer func() {
-					if r := recover(); r != nil {
-						errChan <- fmt.Errorf("(%d/%d) line %d [%s%s %s]: panic: %v", instructionNumber, len(instructions), instruction.Line, instruction.Symbol, instruction.Directive, instruction.Args, r)
-						instructionState.cancel()
-					}
-				}()
-				// SUB mostly waits on its own (already-throttled) child
-				// instructions rather than doing CPU-bound work. Holding a
-				// global semaphore slot across a nested build would let async
-				// SUBs starve their own children of slots and stall the build,
-				// so only leaf/CPU-bound directives consume a slot.
-				if instruction.Directive != "SUB" {
-					select {
-					case asyncSemaphore <- struct{}{}:
-						defer func() { <-asyncSemaphore }()
-					case <-instructionState.Context.Done():
-						errChan <- instructionState.Context.Err()
-						return
-					}
+		case "IF":
+			matched, err := evaluateCondition(state, inst.Args)
+			if err != nil {
+				if err := runner.stop(state, fmt.Errorf("(%d/%d) %s [%s%s %s]: %w", count, len(instructions), inst.location(), inst.Symbol, inst.Directive, inst.Args, err)); err != nil {
+					return err
+				}
+				continue
+			}
+			state.log("IF %s: %t", inst.Args, matched)
+			branch, skipped := inst.Body, inst.Else
+			if !matched {
+				branch, skipped = inst.Else, inst.Body
+			}
+			runner.skipSteps(skipped)
+			if err := runner.run(state, branch); err != nil {
+				return err
+			}
+			continue
+		case "FOR":
+			if err := runner.runLoop(state, inst); err != nil {
+				if err := runner.stop(state, fmt.Errorf("(%d/%d) %s [%s%s %s]: %w", count, len(instructions), inst.location(), inst.Symbol, inst.Directive, inst.Args, err)); err != nil {
+					return err
 				}
-				if err := executeInstruction(instructionState, instruction); err != nil {
-					errChan <- fmt.Errorf("(%d/%d) line %d [%s%s %s]: %w", instructionNumber, len(instructions), instruction.Line, instruction.Symbol, instruction.Directive, instruction.Args, err)
-					instructionState.cancel()
+			}
+			continue
+		case "WAIT":
+			if err := runner.wait(state, inst.Args); err != nil {
+				if err := runner.stop(state, fmt.Errorf("(%d/%d) %s [%s%s %s]: %w", count, len(instructions), inst.location(), inst.Symbol, inst.Directive, inst.Args, err)); err != nil {
+					return err
 				}
-			}(inst, count, asyncState)
+			}
 			continue
 		}
 
-		if err := executeInstruction(state, inst); err != nil {
-			syncErr = fmt.Errorf("(%d/%d) line %d [%s%s %s]: %w", count, len(instructions), inst.Line, inst.Symbol, inst.Directive, inst.Args, err)
-			state.cancel()
-			break
+		if inst.Symbol == "*" {
+			runner.launch(state, inst, count, len(instructions))
+			continue
 		}
-	}
 
-	wg.Wait()
-	close(errChan)
-	var asyncErrors []error
-	for err := range errChan {
-		asyncErrors = append(asyncErrors, err)
-	}
-	if syncErr != nil {
-		if len(asyncErrors) > 0 {
-			return errors.Join(append([]error{syncErr}, asyncErrors...)...)
+		if err := runner.execute(state, inst); err != nil {
+			if err := runner.stop(state, fmt.Errorf("(%d/%d) %s [%s%s %s]: %w", count, len(instructions), inst.location(), inst.Symbol, inst.Directive, inst.Args, err)); err != nil {
+				return err
+			}
 		}
-		return syncErr
 	}
-	if len(asyncErrors) > 0 {
-		return errors.Join(asyncErrors...)
+	return nil
+}
+
+// stop cancels the build and returns err. With --keep-going the error is
+// recorded instead and nil is returned, so the build continues with the
+// remaining instructions.
+func (runner *instructionRunner) stop(state *BuildState, err error) error {
+	if state.KeepGoing && state.Context.Err() == nil {
+		state.clearPendingCache()
+		runner.mu.Lock()
+		defer runner.mu.Unlock()
+		runner.failures = append(runner.failures, err)
+		return nil
+	}
+	state.cancel()
+	return err
+}
+
+// execute runs a synchronous step once its AFTER dependencies have finished.
+func (runner *instructionRunner) execute(state *BuildState, inst Instruction) error {
+	if err := runner.awaitSteps(state.Context, inst.After); err != nil {
+		return runner.skip(state, inst, err)
 	}
+	state.CacheHit = false
+	err := executeStep(state, inst)
+	return runner.complete(state, inst, err)
+}
+
+// skip records a step that did not run because a dependency failed. With
+// --keep-going that is not an error of its own: the failed dependency has
+// already been reported.
+func (runner *instructionRunner) skip(state *BuildState, inst Instruction, err error) error {
+	state.recordStep(inst, stepSkipped, err)
+	runner.finishStep(inst.ID, err)
+	if state.KeepGoing && state.Context.Err() == nil {
+		state.clearPendingCache()
+		return nil
+	}
+	return err
+}
+
+// complete records the outcome of an executed step and releases its
+// dependents. A failure allowed by --allow-failure is logged and treated as
+// success.
+func (runner *instructionRunner) complete(state *BuildState, inst Instruction, err error) error {
+	switch {
+	case err == nil && state.CacheHit:
+		state.recordStep(inst, stepCached, nil)
+	case err == nil:
+		state.recordStep(inst, stepPassed, nil)
+	case inst.Options["allow-failure"] == "true" && state.Context.Err() == nil:
+		state.recordStep(inst, stepAllowed, err)
+		state.log("ALLOWED FAILURE: %s [%s%s %s]: %v", inst.location(), inst.Symbol, inst.Directive, inst.Args, err)
+		state.clearPendingCache()
+		err = nil
+	default:
+		state.recordStep(inst, stepFailed, err)
+	}
+	runner.finishStep(inst.ID, err)
+	return err
+}
+
+// clearPendingCache drops the DEP and OUT declarations of a step that did
+// not complete, so they do not carry over to the next step.
+func (state *BuildState) clearPendingCache() {
+	state.PendingDeps = nil
+	state.PendingOuts = nil
+	state.CurrentCacheKey = ""
+}
 
-	if cmdInstruction != nil {
-		if err := executeCMD(state, *cmdInstruction); err != nil {
-			return fmt.Errorf("line %d [%s%s %s]: %w", cmdInstruction.Line, cmdInstruction.Symbol, cmdInstruction.Directive, cmdInstruction.Args, err)
+func (runner *instructionRunner) launch(state *BuildState, inst Instruction, instructionNumber int, total int) {
+	instructionState := state.snapshot()
+	state.PendingDeps = nil
+	state.PendingOuts = nil
+	state.CurrentCacheKey = ""
+
+	task := runner.track(inst)
+	runner.wg.Add(1)
+	go func() {
+		defer runner.wg.Done()
+		var err error
+		defer func() {
+			// Recover panics in the worker goroutine: Go's recover only
+			// catches panics on its own stack, so without this a panic here
+			// would crash the whole CLI, bypassing processBuild's recover.
+			if r := recover(); r != nil {
+				err = fmt.Errorf("(%d/%d) %s [%s%s %s]: panic: %v", instructionNumber, total, inst.location(), inst.Symbol, inst.Directive, inst.Args, r)
+				instructionState.recordStep(inst, stepFailed, err)
+			}
+			if err != nil && !instructionState.KeepGoing {
+				instructionState.cancel()
+			}
+			task.finish(err)
+			runner.finishStep(inst.ID, err)
+		}()
+		// Wait for AFTER dependencies before taking a semaphore slot, so a
+		// waiting worker cannot starve the steps it depends on.
+		if err = runner.awaitSteps(instructionState.Context, inst.After); err != nil {
+			if err = runner.skip(instructionState, inst, err); err != nil {
+				err = fmt.Errorf("(%d/%d) %s [%s%s %s]: %w", instructionNumber, total, inst.location(), inst.Symbol, inst.Directive, inst.Args, err)
+			}
+			return
 		}
-	}
-	return nil
+		// SUB and CALL mostly wait on their own (already-throttled) child
+		// instructions rather than doing CPU-bound work. Holding a
+		// global semaphore slot across a nested build would let async
+		// SUBs starve their own children of slots and stall the build,
+		// so only leaf/CPU-bound directives consume a slot.
+		if inst.Directive != "SUB" && inst.Directive != "CALL" {
+			select {
+			case asyncSemaphore <- struct{}{}:
+				defer func() { <-asyncSemaphore }()
+			case <-instructionState.Context.Done():
+				err = instructionState.Context.Err()
+				return
+			}
+		}
+		instructionState.CacheHit = false
+		err = executeStep(instructionState, inst)
+		if err = runner.complete(instructionState, inst, err); err != nil {
+			err = fmt.Errorf("(%d/%d) %s [%s%s %s]: %w", instructionNumber, total, inst.location(), inst.Symbol, inst.Directive, inst.Args, err)
+		}
+	}()
 }
 
 func sendResult(ctx context.Context, resultChan chan<- string, message string) {
@@ -336,6 +567,10 @@ func publishBuildInfo(ctx context.Context, buildInfoChan chan<- BuildInfo, build
 	if err := saveBuildInfo(buildInfo); err != nil {
 		logger.Printf("Warning: failed to save build status: %v", err)
 	}
+	sendBuildInfo(ctx, buildInfoChan, buildInfo)
+}
+
+func sendBuildInfo(ctx context.Context, buildInfoChan chan<- BuildInfo, buildInfo BuildInfo) {
 	if buildInfoChan == nil {
 		return
 	}
@@ -363,22 +598,30 @@ func cloneBoxMap(source map[string]BoxInfo) map[string]BoxInfo {
 
 func (state *BuildState) snapshot() *BuildState {
 	return &BuildState{
-		Context:         state.Context,
-		FileName:        state.FileName,
-		BaseDir:         state.BaseDir,
-		WorkDir:         state.WorkDir,
-		BuildID:         state.BuildID,
-		WorkerNode:      state.WorkerNode,
-		Args:            cloneStringMap(state.Args),
-		Env:             cloneStringMap(state.Env),
-		Boxes:           cloneBoxMap(state.Boxes),
-		DefaultBox:      state.DefaultBox,
-		ResultChan:      state.ResultChan,
-		Cancel:          state.Cancel,
-		Depth:           state.Depth,
-		PendingDeps:     append([]string(nil), state.PendingDeps...),
-		PendingOuts:     append([]string(nil), state.PendingOuts...),
-		CurrentCacheKey: state.CurrentCacheKey,
+		Context:            state.Context,
+		FileName:           state.FileName,
+		BaseDir:            state.BaseDir,
+		WorkDir:            state.WorkDir,
+		BuildID:            state.BuildID,
+		WorkerNode:         state.WorkerNode,
+		Args:               cloneStringMap(state.Args),
+		Env:                cloneStringMap(state.Env),
+		Boxes:              cloneBoxMap(state.Boxes),
+		DefaultBox:         state.DefaultBox,
+		ResultChan:         state.ResultChan,
+		Cancel:             state.Cancel,
+		Depth:              state.Depth,
+		PendingDeps:        append([]string(nil), state.PendingDeps...),
+		PendingOuts:        append([]string(nil), state.PendingOuts...),
+		CurrentCacheKey:    state.CurrentCacheKey,
+		CurrentCacheInputs: state.CurrentCacheInputs,
+		KeepGoing:          state.KeepGoing,
+		DryRun:             state.DryRun,
+		Strict:             state.Strict,
+		ExplainCache:       state.ExplainCache,
+		ProvidedArgs:       state.ProvidedArgs,
+		Shell:              state.Shell,
+		Stats:              state.Stats,
 	}
 }
 
@@ -521,11 +764,25 @@ func writeBuildInfosLocked(builds []BuildInfo) error {
 }
 
 func loadEnvFile(state *BuildState, filename string) error {
-	file, err := os.Open(filename)
+	values, err := readAssignmentFile(filename)
 	if err != nil {
 		return err
 	}
+	for k, v := range values {
+		state.Env[k] = v
+	}
+	return nil
+}
+
+// readAssignmentFile reads KEY=value lines, skipping blank lines, comments,
+// and lines without '='. Values may be wrapped in single or double quotes.
+func readAssignmentFile(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
+	values := make(map[string]string)
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
@@ -539,8 +796,8 @@ func loadEnvFile(state *BuildState, filename string) error {
 			if len(v) >= 2 && ((v[0] == '"' && v[len(v)-1] == '"') || (v[0] == '\'' && v[len(v)-1] == '\'')) {
 				v = v[1 : len(v)-1]
 			}
-			state.Env[k] = v
+			values[k] = v
 		}
 	}
-	return scanner.Err()
+	return values, scanner.Err()
 }
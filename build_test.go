@@ -492,6 +492,7 @@ func TestLoadEnvFile(t *testing.T) {
 }
 
 func TestProcessBuildEdgeCases(t *testing.T) {
+	t.Setenv(jettyStateDirEnv, t.TempDir())
 	// missing file name
 	job := Job{}
 	err := processBuild(job)
@@ -642,6 +643,7 @@ func TestExecuteInstructionsEdgeCases(t *testing.T) {
 }
 
 func TestPublishBuildInfoContextDone(t *testing.T) {
+	t.Setenv(jettyStateDirEnv, t.TempDir())
 	ctx, cancel := context.WithCancel(context.Background())
 	ch := make(chan BuildInfo)
 	cancel()
@@ -652,6 +654,7 @@ func TestPublishBuildInfoContextDone(t *testing.T) {
 }
 
 func TestPublishBuildInfoNilChan(t *testing.T) {
+	t.Setenv(jettyStateDirEnv, t.TempDir())
 	publishBuildInfo(context.Background(), nil, BuildInfo{})
 }
 
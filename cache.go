@@ -1,118 +1,170 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
-	"sync"
+	"strings"
 	"time"
-
-	"github.com/gofrs/flock"
 )
 
-var cacheStoreMu sync.Mutex
-
 // CacheEntry is a persisted DEP/OUT cache record keyed by a step's cache key.
 type CacheEntry struct {
 	Outputs map[string]string `json:"outputs"`
+	// Files are the OUT files the step produced, snapshotted in the blob
+	// store so they can be restored when they go missing.
+	Files []CachedFile `json:"files,omitempty"`
+	// Instruction, File and Line describe the step that produced the entry,
+	// for `jetty cache ls` and `jetty cache inspect`.
+	Instruction string    `json:"instruction,omitempty"`
+	File        string    `json:"file,omitempty"`
+	Line        int       `json:"line,omitempty"`
+	Created     time.Time `json:"created"`
+	// Inputs are the components of the entry's cache key.
+	Inputs *CacheInputs `json:"inputs,omitempty"`
+	// LastUsed is when the entry was last saved or hit; `jetty cache prune`
+	// evicts the entries unused the longest.
+	LastUsed time.Time `json:"last_used"`
 }
 
-func cacheStorePath() string {
-	stateDir := os.Getenv(jettyStateDirEnv)
-	if stateDir == "" {
-		stateDir = ".jetty"
-	}
-	return filepath.Join(stateDir, "cache.json")
+// CacheInputs are the components checkCache folds into a cache key, kept so
+// `jetty build --explain-cache` can tell which one changed when a step
+// misses. Command, Env and Args hold digests rather than values.
+type CacheInputs struct {
+	Command  string `json:"command"`
+	Shell    string `json:"shell,omitempty"`
+	DepsHash string `json:"deps_hash"`
+	// Deps maps each DEP file, relative to the working directory, to the
+	// digest of its content.
+	Deps map[string]string `json:"deps,omitempty"`
+	// Env and Args are keyed with the machine's value key, which KeyID
+	// identifies: digests made with different keys cannot be compared.
+	Env   map[string]string `json:"env,omitempty"`
+	Args  map[string]string `json:"args,omitempty"`
+	KeyID string            `json:"key_id,omitempty"`
 }
 
-func lockCacheStore() (func(), error) {
-	// Block on the in-process mutex rather than spin-with-timeout: concurrent
-	// async workers should wait their turn, not fail a correct build with a
-	// spurious timeout. The cross-process flock below keeps its bounded wait.
-	cacheStoreMu.Lock()
+// CachedFile is an OUT file recorded in a CacheEntry. Path is slash-separated
+// and relative to the step's working directory; outputs outside it are not
+// snapshotted.
+type CachedFile struct {
+	Path string      `json:"path"`
+	Blob string      `json:"blob"`
+	Mode os.FileMode `json:"mode"`
+}
 
-	lockPath := cacheStorePath() + ".lock"
-	stateDir := filepath.Dir(lockPath)
-	if err := os.MkdirAll(stateDir, 0755); err != nil {
-		cacheStoreMu.Unlock()
-		return nil, fmt.Errorf("failed to create cache lock directory: %w", err)
-	}
-	_ = hideFile(stateDir)
+// valid reports whether file names a blob by digest and a path that stays
+// inside the working directory. Entries can come from a shared cache, so
+// anything else is rejected rather than restored.
+func (file CachedFile) valid() bool {
+	return cacheDigestPattern.MatchString(file.Blob) &&
+		!strings.Contains(file.Path, `\`) &&
+		filepath.IsLocal(filepath.FromSlash(file.Path))
+}
 
-	fileLock := flock.New(lockPath)
-	locked, err := fileLock.TryLock()
-	if err != nil {
-		cacheStoreMu.Unlock()
-		return nil, fmt.Errorf("failed to check cache lock: %w", err)
+func (file CachedFile) resolve(workDir string) (string, error) {
+	if !file.valid() {
+		return "", fmt.Errorf("invalid cached file %q", file.Path)
 	}
+	return filepath.Join(workDir, filepath.FromSlash(file.Path)), nil
+}
 
-	if !locked {
-		logger.Printf("Waiting for lock on %s...", lockPath)
-		for i := 0; i < 50; i++ {
-			locked, err = fileLock.TryLock()
-			if err == nil && locked {
-				break
+// declaredOutput reports whether rel, a slash-separated path under workDir,
+// is matched by one of the OUT patterns, directly or through a directory.
+func declaredOutput(workDir string, patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if filepath.IsAbs(pattern) {
+			relPattern, err := filepath.Rel(workDir, pattern)
+			if err != nil {
+				continue
 			}
-			time.Sleep(100 * time.Millisecond)
+			pattern = relPattern
 		}
-		if !locked {
-			cacheStoreMu.Unlock()
-			return nil, fmt.Errorf("timeout waiting for lock on %s", lockPath)
+		pattern = filepath.ToSlash(filepath.Clean(pattern))
+		for candidate := rel; candidate != "."; candidate = path.Dir(candidate) {
+			if ok, _ := path.Match(pattern, candidate); ok {
+				return true
+			}
 		}
 	}
+	return false
+}
 
-	return func() {
-		if err := fileLock.Unlock(); err != nil {
-			logger.Printf("Warning: failed to unlock cache store: %v", err)
-		}
-		cacheStoreMu.Unlock()
-	}, nil
+// cacheStorePath is the directory of the local cache: one JSON file per cache
+// key, sharded by the key's first two hex digits. Entries are written on their
+// own, so concurrent steps never wait on each other to record a result.
+func cacheStorePath() string {
+	stateDir := os.Getenv(jettyStateDirEnv)
+	if stateDir == "" {
+		stateDir = ".jetty"
+	}
+	return filepath.Join(stateDir, "cache")
+}
+
+func cacheEntryPath(key string) string {
+	if len(key) < 2 {
+		return filepath.Join(cacheStorePath(), key+".json")
+	}
+	return filepath.Join(cacheStorePath(), key[:2], key+".json")
 }
 
-func readCacheLocked() (map[string]CacheEntry, error) {
-	cachePath := cacheStorePath()
-	data, err := os.ReadFile(cachePath)
+// readCacheEntry returns the local entry recorded for key. An entry that
+// cannot be decoded counts as a miss: the step runs again and rewrites it.
+func readCacheEntry(key string) (CacheEntry, bool, error) {
+	data, err := os.ReadFile(cacheEntryPath(key))
 	if err != nil {
 		if os.IsNotExist(err) {
-			return make(map[string]CacheEntry), nil
+			return CacheEntry{}, false, nil
 		}
-		return nil, err
+		return CacheEntry{}, false, err
 	}
-	var cache map[string]CacheEntry
-	if err := json.Unmarshal(data, &cache); err != nil {
-		return nil, err
+	var entry CacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return CacheEntry{}, false, nil
 	}
-	if cache == nil {
-		cache = make(map[string]CacheEntry)
-	}
-	return cache, nil
+	return entry, true, nil
 }
 
-func writeCacheLocked(cache map[string]CacheEntry) error {
-	cachePath := cacheStorePath()
-	data, err := json.MarshalIndent(cache, "", "  ")
+// writeCacheEntry records entry for key through a temporary file renamed into
+// place, so readers see either the old entry or the new one, and concurrent
+// writers of the same key leave one whole entry behind.
+func writeCacheEntry(key string, entry CacheEntry) error {
+	path := cacheEntryPath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	_ = hideFile(filepath.Dir(cacheStorePath()))
+
+	data, err := json.MarshalIndent(entry, "", "  ")
 	if err != nil {
 		return err
 	}
-
-	tempPath := cachePath + ".tmp"
-	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+	temp, err := os.CreateTemp(filepath.Dir(path), key+"-*.tmp")
+	if err != nil {
 		return err
 	}
-	defer os.Remove(tempPath)
-
-	return os.Rename(tempPath, cachePath)
-}
-
-func hashFiles(workDir string, patterns []string) (string, error) {
-	if len(patterns) == 0 {
-		return "none", nil
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
 	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
 
+// matchFiles returns the files the DEP or OUT patterns match, sorted and
+// without duplicates. Directories are walked.
+func matchFiles(workDir string, patterns []string) ([]string, error) {
 	var files []string
 	for _, pattern := range patterns {
 		globPattern := pattern
@@ -121,7 +173,7 @@ func hashFiles(workDir string, patterns []string) (string, error) {
 		}
 		matches, err := filepath.Glob(globPattern)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		for _, match := range matches {
 			info, err := os.Stat(match)
@@ -139,7 +191,7 @@ func hashFiles(workDir string, patterns []string) (string, error) {
 					return nil
 				})
 				if walkErr != nil {
-					return "", walkErr
+					return nil, walkErr
 				}
 			} else {
 				files = append(files, match)
@@ -147,10 +199,6 @@ func hashFiles(workDir string, patterns []string) (string, error) {
 		}
 	}
 
-	if len(files) == 0 {
-		return "missing", nil
-	}
-
 	// Deduplicate and sort
 	fileSet := make(map[string]struct{})
 	for _, f := range files {
@@ -161,6 +209,21 @@ func hashFiles(workDir string, patterns []string) (string, error) {
 		uniqueFiles = append(uniqueFiles, f)
 	}
 	sort.Strings(uniqueFiles)
+	return uniqueFiles, nil
+}
+
+func hashFiles(workDir string, patterns []string) (string, error) {
+	if len(patterns) == 0 {
+		return "none", nil
+	}
+
+	uniqueFiles, err := matchFiles(workDir, patterns)
+	if err != nil {
+		return "", err
+	}
+	if len(uniqueFiles) == 0 {
+		return "missing", nil
+	}
 
 	h := sha256.New()
 	for _, f := range uniqueFiles {
@@ -208,8 +271,22 @@ func checkCache(state *BuildState, inst Instruction) (bool, error) {
 		return false, err
 	}
 
+	key, err := valueKey()
+	if err != nil {
+		return false, err
+	}
+	inputs := &CacheInputs{DepsHash: depsHash, KeyID: keyedDigest(key, "jetty value key")}
 	keyHash := sha256.New()
-	fmt.Fprintf(keyHash, "%s:%s:%s", inst.Directive, inst.Symbol, inst.Args)
+	command := fmt.Sprintf("%s:%s:%s", inst.Directive, inst.Symbol, inst.Args)
+	if inst.Heredoc != nil {
+		command += fmt.Sprintf(":<<%s", inst.Heredoc.Body)
+	}
+	inputs.Command = valueDigest(command)
+	fmt.Fprint(keyHash, command)
+	if len(state.Shell) > 0 {
+		inputs.Shell = fmt.Sprintf("%q", state.Shell)
+		fmt.Fprintf(keyHash, ":shell=%s", inputs.Shell)
+	}
 	fmt.Fprintf(keyHash, ":%s", depsHash)
 
 	var envKeys []string
@@ -217,8 +294,10 @@ func checkCache(state *BuildState, inst Instruction) (bool, error) {
 		envKeys = append(envKeys, k)
 	}
 	sort.Strings(envKeys)
+	inputs.Env = make(map[string]string, len(envKeys))
 	for _, k := range envKeys {
 		fmt.Fprintf(keyHash, ":%s=%s", k, state.Env[k])
+		inputs.Env[k] = keyedDigest(key, state.Env[k])
 	}
 
 	// Fold in build ARGs so a change to an ARG referenced by the command
@@ -232,24 +311,34 @@ func checkCache(state *BuildState, inst Instruction) (bool, error) {
 		argKeys = append(argKeys, k)
 	}
 	sort.Strings(argKeys)
+	inputs.Args = make(map[string]string, len(argKeys))
 	for _, k := range argKeys {
 		fmt.Fprintf(keyHash, ":%s=%s", k, state.Args[k])
+		inputs.Args[k] = keyedDigest(key, state.Args[k])
 	}
 
 	state.CurrentCacheKey = fmt.Sprintf("%x", keyHash.Sum(nil))
+	state.CurrentCacheInputs = inputs
 
-	unlock, err := lockCacheStore()
-	if err != nil {
+	hit, err := lookupCache(state)
+	if err != nil || hit {
+		return hit, err
+	}
+	// The step is about to run: record the digest of each dependency, so a
+	// later miss can name the file that changed.
+	if inputs.Deps, err = digestFiles(state.WorkDir, state.PendingDeps); err != nil {
 		return false, err
 	}
-	defer unlock()
+	return false, nil
+}
 
-	cache, err := readCacheLocked()
+// lookupCache reports whether the entry for the current cache key records
+// the outputs the step's OUT files hold now.
+func lookupCache(state *BuildState) (bool, error) {
+	entry, ok, err := openCacheStore().Get(state.Context, state.CurrentCacheKey)
 	if err != nil {
 		return false, err
 	}
-
-	entry, ok := cache[state.CurrentCacheKey]
 	if !ok {
 		return false, nil
 	}
@@ -278,7 +367,93 @@ func checkCache(state *BuildState, inst Instruction) (bool, error) {
 	return true, nil
 }
 
-func saveCache(state *BuildState) error {
+// digestFiles returns the SHA-256 digest of each file the patterns match,
+// by path relative to workDir.
+func digestFiles(workDir string, patterns []string) (map[string]string, error) {
+	files, err := matchFiles(workDir, patterns)
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	digests := make(map[string]string, len(files))
+	for _, file := range files {
+		digest, err := fileDigest(file)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(workDir, file)
+		if err != nil {
+			rel = file
+		}
+		digests[filepath.ToSlash(rel)] = digest
+	}
+	return digests, nil
+}
+
+// valueDigest shortens a key component to a digest.
+func valueDigest(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// keyedDigest digests an ENV or ARG value with HMAC-SHA256. Values may be
+// short secrets and entries are shared through the remote cache, where a
+// plain digest could be reversed by trying every candidate value.
+func keyedDigest(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return fmt.Sprintf("%x", mac.Sum(nil)[:8])
+}
+
+// valueKeyPath is the file holding the random key ENV and ARG values are
+// digested with. It never leaves the machine.
+func valueKeyPath() string {
+	return filepath.Join(cacheStorePath(), "value.key")
+}
+
+// valueKey returns the value key, creating it on first use. A new key is
+// linked into place, so concurrent builds agree on one.
+func valueKey() ([]byte, error) {
+	path := valueKeyPath()
+	for {
+		key, err := os.ReadFile(path)
+		if err == nil {
+			if len(key) != sha256.Size {
+				return nil, fmt.Errorf("cache value key %s is corrupt; remove it to create a new one", path)
+			}
+			return key, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read cache value key: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		key = make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		temp, err := os.CreateTemp(filepath.Dir(path), "value-*.tmp")
+		if err != nil {
+			return nil, err
+		}
+		_, err = temp.Write(key)
+		if closeErr := temp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Link(temp.Name(), path)
+		}
+		os.Remove(temp.Name())
+		if err == nil {
+			return key, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+	}
+}
+
+func saveCache(state *BuildState, inst Instruction) error {
 	if state.CurrentCacheKey == "" {
 		return nil
 	}
@@ -287,23 +462,164 @@ func saveCache(state *BuildState) error {
 	if err != nil {
 		return err
 	}
-
-	unlock, err := lockCacheStore()
-	if err != nil {
-		return err
-	}
-	defer unlock()
-
-	cache, err := readCacheLocked()
+	files, err := snapshotOutputs(state.WorkDir, state.PendingOuts)
 	if err != nil {
 		return err
 	}
 
-	cache[state.CurrentCacheKey] = CacheEntry{
+	now := time.Now()
+	return openCacheStore().Put(state.Context, state.CurrentCacheKey, CacheEntry{
 		Outputs: map[string]string{
 			"hash": outsHash,
 		},
+		Files:       files,
+		Instruction: instructionText(inst),
+		File:        state.FileName,
+		Line:        inst.Line,
+		Created:     now,
+		LastUsed:    now,
+		Inputs:      state.CurrentCacheInputs,
+	})
+}
+
+// instructionText returns inst as written, without its options.
+func instructionText(inst Instruction) string {
+	words := []string{inst.Symbol + inst.Directive}
+	if inst.Args != "" {
+		words = append(words, inst.Args)
+	}
+	if inst.Heredoc != nil {
+		words = append(words, inst.Heredoc.Marker.Raw)
 	}
+	return strings.Join(words, " ")
+}
+
+// touchCacheEntry records that the local entry for key was just hit.
+func touchCacheEntry(key string) error {
+	entry, ok, err := readCacheEntry(key)
+	if err != nil || !ok {
+		return err
+	}
+	entry.LastUsed = time.Now()
+	return writeCacheEntry(key, entry)
+}
 
-	return writeCacheLocked(cache)
+// snapshotOutputs copies the files the OUT patterns match into the blob store.
+func snapshotOutputs(workDir string, patterns []string) ([]CachedFile, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	paths, err := matchFiles(workDir, patterns)
+	if err != nil {
+		return nil, err
+	}
+	var files []CachedFile
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(workDir, path)
+		if err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+		digest, err := storeBlob(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, CachedFile{Path: filepath.ToSlash(rel), Blob: digest, Mode: info.Mode().Perm()})
+	}
+	return files, nil
+}
+
+// restoreCache restores the outputs of the step checkCache just looked up
+// from the cache store, when its cache key is recorded but some of its OUT
+// files are missing. Outputs that exist must still hold the recorded
+// content: a changed output means the step has to run again. An entry naming
+// a file the step's OUT patterns do not match, or one outside its working
+// directory, is a miss. In a dry run
+// nothing is written; it only reports whether the outputs could be restored.
+func restoreCache(state *BuildState) (bool, error) {
+	if state.CurrentCacheKey == "" || len(state.PendingOuts) == 0 {
+		return false, nil
+	}
+	store := openCacheStore()
+	entry, ok, err := store.Get(state.Context, state.CurrentCacheKey)
+	if err != nil || !ok || len(entry.Files) == 0 {
+		return false, err
+	}
+
+	var missing []CachedFile
+	for _, file := range entry.Files {
+		path, err := file.resolve(state.WorkDir)
+		if err != nil || !declaredOutput(state.WorkDir, state.PendingOuts, file.Path) {
+			return false, nil
+		}
+		if _, err := os.Stat(path); err == nil {
+			if digest, err := fileDigest(path); err != nil || digest != file.Blob {
+				return false, nil
+			}
+			continue
+		} else if !os.IsNotExist(err) {
+			return false, nil
+		}
+		if ok, err := store.FetchBlob(state.Context, file.Blob); err != nil || !ok {
+			return false, err
+		}
+		missing = append(missing, file)
+	}
+	if len(missing) == 0 {
+		return false, nil
+	}
+	if state.DryRun {
+		return true, nil
+	}
+
+	for _, file := range missing {
+		path, _ := file.resolve(state.WorkDir)
+		if err := restoreBlob(file.Blob, path, file.Mode); err != nil {
+			if errors.Is(err, errBlobCorrupt) {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+	outsHash, err := hashFiles(state.WorkDir, state.PendingOuts)
+	if err != nil || outsHash != entry.Outputs["hash"] {
+		return false, nil
+	}
+	return true, nil
+}
+
+// skipCachedStep reports whether a cacheable step can be skipped: its
+// outputs are up to date (CACHED) or were restored from the blob store
+// (RESTORED). A skipped step consumes the pending DEP and OUT declarations.
+// With ExplainCache, a step that has to run logs why it missed.
+func skipCachedStep(state *BuildState, inst Instruction) (bool, error) {
+	cached, err := checkCache(state, inst)
+	if err != nil {
+		return false, err
+	}
+	label := "CACHED"
+	if !cached {
+		if cached, err = restoreCache(state); err != nil {
+			return false, err
+		}
+		label = "RESTORED"
+	}
+	if !cached {
+		if state.ExplainCache {
+			return false, explainCacheMiss(state, inst)
+		}
+		return false, nil
+	}
+	if err := touchCacheEntry(state.CurrentCacheKey); err != nil {
+		return false, err
+	}
+	state.log("%s: %s %s", label, inst.Directive, inst.Args)
+	state.CacheHit = true
+	state.PendingDeps = nil
+	state.PendingOuts = nil
+	state.CurrentCacheKey = ""
+	return true, nil
 }
@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -43,7 +47,7 @@ func TestCacheLogic(t *testing.T) {
 
 	// Simulate RUN generating the file
 	os.WriteFile(outFile, []byte("output content"), 0644)
-	err = saveCache(state)
+	err = saveCache(state, instRun)
 	if err != nil {
 		t.Fatalf("unexpected error saving cache: %v", err)
 	}
@@ -76,7 +80,7 @@ func TestCacheLogic(t *testing.T) {
 
 	// Simulate RUN generating new output
 	os.WriteFile(outFile, []byte("new output content"), 0644)
-	err = saveCache(state)
+	err = saveCache(state, instRun)
 	if err != nil {
 		t.Fatalf("unexpected error saving cache: %v", err)
 	}
@@ -92,16 +96,195 @@ func TestCacheLogic(t *testing.T) {
 		t.Fatalf("expected cache miss after output tampered, got hit")
 	}
 
-	// The cache lock blocks rather than timing out: acquire, release, and then
-	// re-acquire must all succeed without a spurious error or deadlock.
-	unlock, err := lockCacheStore()
+	// Each key is its own file, sharded by the key's first two hex digits.
+	if _, err := os.Stat(filepath.Join(tempDir, "cache", state.CurrentCacheKey[:2], state.CurrentCacheKey+".json")); err != nil {
+		t.Fatalf("expected a per-key cache file: %v", err)
+	}
+}
+
+func TestCacheEntriesWriteConcurrently(t *testing.T) {
+	t.Setenv(jettyStateDirEnv, t.TempDir())
+	const workers = 32
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*2)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("%064x", i)
+			// Every worker also rewrites a shared key; the last rename wins
+			// and the entry stays whole.
+			for _, k := range []string{key, strings.Repeat("f", 64)} {
+				if err := writeCacheEntry(k, CacheEntry{Outputs: map[string]string{"hash": key}}); err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("writeCacheEntry returned error: %v", err)
+	}
+	for i := 0; i < workers; i++ {
+		key := fmt.Sprintf("%064x", i)
+		entry, ok, err := readCacheEntry(key)
+		if err != nil || !ok || entry.Outputs["hash"] != key {
+			t.Fatalf("readCacheEntry(%s) = %#v %v %v", key, entry, ok, err)
+		}
+	}
+	if entry, ok, err := readCacheEntry(strings.Repeat("f", 64)); err != nil || !ok || len(entry.Outputs["hash"]) != 64 {
+		t.Fatalf("expected the shared key to hold one whole entry, got %#v %v %v", entry, ok, err)
+	}
+}
+
+func TestReadCacheEntryTreatsCorruptEntryAsMiss(t *testing.T) {
+	t.Setenv(jettyStateDirEnv, t.TempDir())
+	key := strings.Repeat("a", 64)
+	if err := os.MkdirAll(filepath.Dir(cacheEntryPath(key)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cacheEntryPath(key), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := readCacheEntry(key); ok || err != nil {
+		t.Fatalf("expected a corrupt entry to be a miss, got %v %v", ok, err)
+	}
+}
+
+func TestBuildRestoresOutputsFromBlobStore(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	if err := os.WriteFile(filepath.Join(dir, "input.txt"), []byte("input"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"DEP input.txt",
+		"OUT bin",
+		"RUN mkdir -p bin && echo x >> runs.txt && cp input.txt bin/app && chmod 755 bin/app",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := runBuildForTest(t, buildFile); err != nil {
+		t.Fatalf("first build failed: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "bin")); err != nil {
+		t.Fatal(err)
+	}
+	output, _, err := runBuildForTest(t, buildFile)
 	if err != nil {
-		t.Fatalf("unexpected error acquiring cache lock: %v", err)
+		t.Fatalf("second build failed: %v", err)
+	}
+	if !joinedOutputContains(output, "RESTORED: RUN mkdir -p bin") {
+		t.Fatalf("expected the outputs to be restored, got %q", output)
+	}
+	assertFileContent(t, filepath.Join(dir, "bin", "app"), "input")
+	assertFileContent(t, filepath.Join(dir, "runs.txt"), "x\n")
+	if info, err := os.Stat(filepath.Join(dir, "bin", "app")); err != nil || (runtime.GOOS != "windows" && info.Mode().Perm() != 0755) {
+		t.Fatalf("expected the restored file to keep its mode, got %v %v", info, err)
 	}
-	unlock()
-	unlock2, err := lockCacheStore()
+
+	output, _, err = runBuildForTest(t, buildFile)
+	if err != nil || !joinedOutputContains(output, "CACHED: RUN") {
+		t.Fatalf("expected the restored outputs to be a plain cache hit, got %q %v", output, err)
+	}
+
+	// A changed output is not overwritten: the step runs again.
+	if err := os.WriteFile(filepath.Join(dir, "bin", "app"), []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := runBuildForTest(t, buildFile); err != nil {
+		t.Fatalf("build after editing the output failed: %v", err)
+	}
+	assertFileContent(t, filepath.Join(dir, "runs.txt"), "x\nx\n")
+}
+
+func TestRestoreCacheIgnoresCorruptBlobs(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	if err := os.WriteFile(buildFile, []byte("OUT out.txt\nRUN echo x >> runs.txt && echo built > out.txt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := runBuildForTest(t, buildFile); err != nil {
+		t.Fatalf("first build failed: %v", err)
+	}
+	digest, err := fileDigest(filepath.Join(dir, "out.txt"))
 	if err != nil {
-		t.Fatalf("expected to re-acquire the cache lock after release: %v", err)
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blobPath(digest), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "out.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := runDryRunForTest(t, buildFile)
+	if err != nil || !joinedOutputContains(output, "RESTORED: RUN") {
+		t.Fatalf("expected the dry run to report the restore, got %q %v", output, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.txt")); !os.IsNotExist(err) {
+		t.Fatal("expected the dry run not to restore anything")
+	}
+
+	output, _, err = runBuildForTest(t, buildFile)
+	if err != nil {
+		t.Fatalf("second build failed: %v", err)
+	}
+	if joinedOutputContains(output, "RESTORED") {
+		t.Fatalf("expected a corrupt blob not to be restored, got %q", output)
+	}
+	assertFileContent(t, filepath.Join(dir, "out.txt"), "built\n")
+	assertFileContent(t, filepath.Join(dir, "runs.txt"), "x\nx\n")
+	assertFileContent(t, blobPath(digest), "built\n")
+}
+
+func TestRestoreCacheRejectsUnsafeEntries(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	workDir := filepath.Join(dir, "work")
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	buildFile := filepath.Join(workDir, "Jettyfile")
+	if err := os.WriteFile(buildFile, []byte("OUT out.txt\nRUN echo built > out.txt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := runBuildForTest(t, buildFile); err != nil {
+		t.Fatalf("first build failed: %v", err)
+	}
+	records, err := listCacheEntries()
+	if err != nil || len(records) != 1 {
+		t.Fatalf("expected one cache entry, got %#v %v", records, err)
+	}
+	key, entry := records[0].Key, records[0].Entry
+
+	escaped := filepath.Join(dir, "escaped.txt")
+	for _, path := range []string{"../escaped.txt", filepath.ToSlash(escaped), "other.txt"} {
+		tampered := entry
+		tampered.Files = []CachedFile{{Path: path, Blob: entry.Files[0].Blob, Mode: 0644}}
+		if err := writeCacheEntry(key, tampered); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(workDir, "out.txt")); err != nil {
+			t.Fatal(err)
+		}
+		output, _, err := runBuildForTest(t, buildFile)
+		if err != nil {
+			t.Fatalf("build failed: %v", err)
+		}
+		if joinedOutputContains(output, "RESTORED") {
+			t.Fatalf("expected an entry naming %s not to be restored, got %q", path, output)
+		}
+		for _, unexpected := range []string{escaped, filepath.Join(workDir, "other.txt")} {
+			if _, err := os.Stat(unexpected); !os.IsNotExist(err) {
+				t.Fatalf("expected %s not to be written for an entry naming %s", unexpected, path)
+			}
+		}
 	}
-	unlock2()
 }
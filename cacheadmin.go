@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// cacheRecord is a local cache entry as listed by `jetty cache`.
+type cacheRecord struct {
+	Key   string
+	Entry CacheEntry
+	// LastUsed falls back to the entry file's modification time for entries
+	// recorded before Jetty tracked it.
+	LastUsed time.Time
+	// EntrySize is the size of the entry file, and Size that plus the
+	// sizes of the blobs it names.
+	EntrySize int64
+	Size      int64
+}
+
+// listCacheEntries returns the local cache entries, most recently used
+// first.
+func listCacheEntries() ([]cacheRecord, error) {
+	var records []cacheRecord
+	err := filepath.WalkDir(cacheStorePath(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == cacheStorePath() {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		key := strings.TrimSuffix(filepath.Base(path), ".json")
+		entry, ok, err := readCacheEntry(key)
+		if err != nil || !ok {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		record := cacheRecord{Key: key, Entry: entry, LastUsed: entry.LastUsed, EntrySize: info.Size(), Size: info.Size()}
+		if record.LastUsed.IsZero() {
+			record.LastUsed = info.ModTime()
+		}
+		for _, digest := range entryBlobs(entry) {
+			record.Size += blobSize(digest)
+		}
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache: %w", err)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].LastUsed.After(records[j].LastUsed)
+	})
+	return records, nil
+}
+
+// entryBlobs returns the distinct blobs an entry names.
+func entryBlobs(entry CacheEntry) []string {
+	seen := make(map[string]bool)
+	var digests []string
+	for _, file := range entry.Files {
+		if !seen[file.Blob] {
+			seen[file.Blob] = true
+			digests = append(digests, file.Blob)
+		}
+	}
+	return digests
+}
+
+func blobSize(digest string) int64 {
+	info, err := os.Stat(blobPath(digest))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// findCacheEntry returns the entry whose key is key or starts with it.
+func findCacheEntry(key string) (cacheRecord, error) {
+	records, err := listCacheEntries()
+	if err != nil {
+		return cacheRecord{}, err
+	}
+	var matches []cacheRecord
+	for _, record := range records {
+		if record.Key == key {
+			return record, nil
+		}
+		if strings.HasPrefix(record.Key, key) {
+			matches = append(matches, record)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return cacheRecord{}, fmt.Errorf("%w: no cache entry %s", ErrInvalidInput, key)
+	case 1:
+		return matches[0], nil
+	}
+	return cacheRecord{}, fmt.Errorf("%w: cache key prefix %s is ambiguous (%d entries)", ErrInvalidInput, key, len(matches))
+}
+
+func printCacheEntries(w io.Writer, records []cacheRecord) error {
+	if len(records) == 0 {
+		_, err := fmt.Fprintln(w, "Cache is empty")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tLAST USED\tSIZE\tSOURCE\tINSTRUCTION")
+	for _, record := range records {
+		instruction := truncateRunes(record.Entry.Instruction, 50)
+		if instruction == "" {
+			instruction = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			record.Key[:min(12, len(record.Key))],
+			record.LastUsed.Format(time.RFC3339),
+			formatSize(record.Size),
+			cacheEntrySource(record.Entry),
+			instruction,
+		)
+	}
+	return tw.Flush()
+}
+
+func cacheEntrySource(entry CacheEntry) string {
+	if entry.File == "" {
+		return "-"
+	}
+	source := fmt.Sprintf("%s:%d", entry.File, entry.Line)
+	if runes := []rune(source); len(runes) > 40 {
+		source = "..." + string(runes[len(runes)-37:])
+	}
+	return source
+}
+
+func printCacheEntry(w io.Writer, record cacheRecord) error {
+	entry := record.Entry
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Key:\t%s\n", record.Key)
+	fmt.Fprintf(tw, "Instruction:\t%s\n", valueOrDash(entry.Instruction))
+	if entry.File != "" {
+		fmt.Fprintf(tw, "Source:\t%s:%d\n", entry.File, entry.Line)
+	} else {
+		fmt.Fprintf(tw, "Source:\t-\n")
+	}
+	fmt.Fprintf(tw, "Created:\t%s\n", formatCacheTime(entry.Created))
+	fmt.Fprintf(tw, "Last used:\t%s\n", record.LastUsed.Format(time.RFC3339))
+	fmt.Fprintf(tw, "Outputs hash:\t%s\n", valueOrDash(entry.Outputs["hash"]))
+	fmt.Fprintf(tw, "Size:\t%s\n", formatSize(record.Size))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(entry.Files) == 0 {
+		return nil
+	}
+	fmt.Fprintln(w, "\nFiles:")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, file := range entry.Files {
+		stored := "stored"
+		if _, err := os.Stat(blobPath(file.Blob)); err != nil {
+			stored = "missing"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", file.Path, formatSize(blobSize(file.Blob)), file.Blob[:min(12, len(file.Blob))], stored)
+	}
+	return tw.Flush()
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func formatCacheTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// pruneCache removes local entries not used within olderThan and then, while
+// the cache is larger than maxSize, the least recently used ones. A zero
+// limit is not applied. Blobs no remaining entry names are removed too. It
+// returns the number of entries and bytes removed.
+func pruneCache(olderThan time.Duration, maxSize int64) (int, int64, error) {
+	records, err := listCacheEntries()
+	if err != nil {
+		return 0, 0, err
+	}
+	refs := make(map[string]int)
+	var total int64
+	for _, record := range records {
+		total += record.EntrySize
+		for _, digest := range entryBlobs(record.Entry) {
+			if refs[digest] == 0 {
+				total += blobSize(digest)
+			}
+			refs[digest]++
+		}
+	}
+
+	removed, freed := 0, int64(0)
+	cutoff := time.Now().Add(-olderThan)
+	// records are most recently used first; evict from the end.
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		expired := olderThan > 0 && record.LastUsed.Before(cutoff)
+		oversized := maxSize > 0 && total > maxSize
+		if !expired && !oversized {
+			continue
+		}
+		if err := os.Remove(cacheEntryPath(record.Key)); err != nil && !os.IsNotExist(err) {
+			return removed, freed, err
+		}
+		removed++
+		freed += record.EntrySize
+		total -= record.EntrySize
+		for _, digest := range entryBlobs(record.Entry) {
+			if refs[digest]--; refs[digest] == 0 {
+				total -= blobSize(digest)
+			}
+		}
+	}
+
+	blobsFreed, err := removeUnreferencedBlobs(refs)
+	if err != nil {
+		return removed, freed, err
+	}
+	return removed, freed + blobsFreed, nil
+}
+
+// removeUnreferencedBlobs deletes the blobs with no references in refs and
+// returns the bytes freed. A blob of a step being saved concurrently may go
+// too; restoring that step then misses and runs it again.
+func removeUnreferencedBlobs(refs map[string]int) (int64, error) {
+	var freed int64
+	err := filepath.WalkDir(blobStorePath(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == blobStorePath() {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".tmp") || refs[d.Name()] > 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		freed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune blobs: %w", err)
+	}
+	return freed, nil
+}
+
+// clearCache removes every local cache entry and blob.
+func clearCache() error {
+	for _, dir := range []string{cacheStorePath(), blobStorePath()} {
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("failed to clear cache: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseSize parses a byte count such as 512, 200KB, 1.5GB or 2GiB.
+func parseSize(text string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   float64
+	}{
+		{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+		{"B", 1},
+	}
+	number, scale := strings.ToUpper(strings.TrimSpace(text)), 1.0
+	for _, unit := range units {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, scale = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix)), unit.size
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q: expected a byte count such as 500MB or 2GiB", text)
+	}
+	return int64(value * scale), nil
+}
+
+// formatSize renders a byte count with a binary unit.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// storeTestEntry records an entry for key whose single output holds content.
+func storeTestEntry(t *testing.T, key string, content string, lastUsed time.Time) {
+	t.Helper()
+	source := filepath.Join(t.TempDir(), "out.txt")
+	if err := os.WriteFile(source, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := storeBlob(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := CacheEntry{
+		Outputs:     map[string]string{"hash": "h"},
+		Files:       []CachedFile{{Path: "out.txt", Blob: digest, Mode: 0644}},
+		Instruction: "RUN make " + key[:4],
+		Created:     lastUsed,
+		LastUsed:    lastUsed,
+	}
+	if err := writeCacheEntry(key, entry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func cacheKeys(t *testing.T) []string {
+	t.Helper()
+	records, err := listCacheEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, record := range records {
+		keys = append(keys, record.Key[:4])
+	}
+	return keys
+}
+
+func TestCacheCommandsListAndInspectEntries(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	if err := os.WriteFile(buildFile, []byte("ARG V=1\nOUT out.txt\nRUN echo $V > out.txt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := runBuildForTest(t, buildFile); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	records, err := listCacheEntries()
+	if err != nil || len(records) != 1 {
+		t.Fatalf("expected one cache entry, got %#v %v", records, err)
+	}
+	entry := records[0].Entry
+	if entry.Instruction != "RUN echo $V > out.txt" || entry.File != buildFile || entry.Line != 3 || entry.Created.IsZero() {
+		t.Fatalf("unexpected entry metadata: %#v", entry)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if _, _, err := runBuildForTest(t, buildFile); err != nil {
+		t.Fatalf("second build failed: %v", err)
+	}
+	hit, err := findCacheEntry(records[0].Key[:8])
+	if err != nil || !hit.Entry.LastUsed.After(entry.Created) {
+		t.Fatalf("expected the hit to update the last use, got %#v %v", hit.Entry, err)
+	}
+
+	output := captureStdout(t)
+	ctx := context.Background()
+	if err := handleSubcommands(ctx, []string{"cache", "ls"}); err != nil {
+		t.Fatalf("cache ls returned error: %v", err)
+	}
+	for _, want := range []string{"KEY", records[0].Key[:12], "RUN echo $V > out.txt", ":3"} {
+		if !strings.Contains(output.String(), want) {
+			t.Fatalf("expected %q in cache ls output, got:\n%s", want, output.String())
+		}
+	}
+
+	output.Reset()
+	if err := handleSubcommands(ctx, []string{"cache", "inspect", records[0].Key[:8]}); err != nil {
+		t.Fatalf("cache inspect returned error: %v", err)
+	}
+	for _, want := range []string{"Key:", records[0].Key, "Source:", buildFile + ":3", "out.txt", "stored"} {
+		if !strings.Contains(output.String(), want) {
+			t.Fatalf("expected %q in cache inspect output, got:\n%s", want, output.String())
+		}
+	}
+
+	if err := handleSubcommands(ctx, []string{"cache", "inspect", "ffff"}); err == nil || !strings.Contains(err.Error(), "no cache entry ffff") {
+		t.Fatalf("expected an unknown key to be rejected, got %v", err)
+	}
+}
+
+func TestPrintCacheEntriesTruncatesByRune(t *testing.T) {
+	var output bytes.Buffer
+	records := []cacheRecord{{Key: "0123456789abcdef", Entry: CacheEntry{
+		Instruction: "RUN echo " + strings.Repeat("é", 60),
+		File:        strings.Repeat("ü", 50) + "/Jettyfile",
+		Line:        3,
+	}}}
+	if err := printCacheEntries(&output, records); err != nil {
+		t.Fatal(err)
+	}
+	if !utf8.Valid(output.Bytes()) || !strings.Contains(output.String(), "...") {
+		t.Fatalf("expected truncated cells to stay valid UTF-8, got %q", output.String())
+	}
+}
+
+func TestPruneCacheByAgeAndSize(t *testing.T) {
+	t.Setenv(jettyStateDirEnv, t.TempDir())
+	now := time.Now()
+	old, shared, recent := strings.Repeat("a", 64), strings.Repeat("b", 64), strings.Repeat("c", 64)
+	storeTestEntry(t, old, "only old", now.Add(-48*time.Hour))
+	storeTestEntry(t, shared, "shared", now.Add(-47*time.Hour))
+	storeTestEntry(t, recent, "shared", now)
+
+	removed, freed, err := pruneCache(24*time.Hour, 0)
+	if err != nil || removed != 2 || freed == 0 {
+		t.Fatalf("pruneCache = %d, %d, %v; want 2 entries removed", removed, freed, err)
+	}
+	if keys := cacheKeys(t); len(keys) != 1 || keys[0] != "cccc" {
+		t.Fatalf("expected only the recent entry to remain, got %v", keys)
+	}
+	onlyOld := fmt.Sprintf("%x", sha256.Sum256([]byte("only old")))
+	if _, err := os.Stat(blobPath(onlyOld)); !os.IsNotExist(err) {
+		t.Fatal("expected the blob only the old entry used to be removed")
+	}
+	if _, err := os.Stat(blobPath(fmt.Sprintf("%x", sha256.Sum256([]byte("shared"))))); err != nil {
+		t.Fatalf("expected a blob still in use to be kept: %v", err)
+	}
+
+	storeTestEntry(t, old, strings.Repeat("x", 4096), now.Add(-2*time.Hour))
+	storeTestEntry(t, shared, strings.Repeat("y", 4096), now.Add(-time.Hour))
+	if _, _, err := pruneCache(0, 6000); err != nil {
+		t.Fatal(err)
+	}
+	if keys := cacheKeys(t); len(keys) != 2 || keys[0] != "cccc" || keys[1] != "bbbb" {
+		t.Fatalf("expected the least recently used entry to be evicted, got %v", keys)
+	}
+}
+
+func TestCacheClearAndPruneFlags(t *testing.T) {
+	t.Setenv(jettyStateDirEnv, t.TempDir())
+	storeTestEntry(t, strings.Repeat("a", 64), "content", time.Now())
+	ctx := context.Background()
+
+	err := handleSubcommands(ctx, []string{"cache", "prune"})
+	if err == nil || !strings.Contains(err.Error(), "requires --older-than or --max-size") {
+		t.Fatalf("expected prune without limits to fail, got %v", err)
+	}
+	err = handleSubcommands(ctx, []string{"cache", "prune", "--max-size", "lots"})
+	if err == nil || !strings.Contains(err.Error(), `invalid size "lots"`) {
+		t.Fatalf("expected an invalid size to fail, got %v", err)
+	}
+
+	if err := handleSubcommands(ctx, []string{"cache", "clear"}); err != nil {
+		t.Fatalf("cache clear returned error: %v", err)
+	}
+	if keys := cacheKeys(t); len(keys) != 0 {
+		t.Fatalf("expected an empty cache, got %v", keys)
+	}
+	if _, err := os.Stat(blobStorePath()); !os.IsNotExist(err) {
+		t.Fatal("expected cache clear to remove the blobs")
+	}
+}
+
+func TestParseAndFormatSize(t *testing.T) {
+	tests := []struct {
+		text string
+		want int64
+	}{
+		{"512", 512},
+		{"200KB", 200000},
+		{"1.5gb", 1500000000},
+		{"2GiB", 2 << 30},
+		{"10 M", 10 << 20},
+	}
+	for _, tc := range tests {
+		if got, err := parseSize(tc.text); err != nil || got != tc.want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d", tc.text, got, err, tc.want)
+		}
+	}
+	if _, err := parseSize("-1"); err == nil {
+		t.Error("expected a negative size to be rejected")
+	}
+	if got := formatSize(512); got != "512B" {
+		t.Errorf("formatSize(512) = %q", got)
+	}
+	if got := formatSize(3 << 20); got != "3.0MiB" {
+		t.Errorf("formatSize(3MiB) = %q", got)
+	}
+}
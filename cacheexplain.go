@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// explainCacheMiss logs why the step checkCache just looked up missed the
+// cache. When no entry is recorded for its key, the key's components are
+// compared with those of the most recent local entry for the same
+// instruction: the same line of the same Jettyfile, or the same instruction
+// text when lines moved.
+func explainCacheMiss(state *BuildState, inst Instruction) error {
+	if state.CurrentCacheInputs == nil || state.CurrentCacheKey == "" {
+		return nil
+	}
+	reasons, err := cacheMissReasons(state, inst)
+	if err != nil {
+		return err
+	}
+	state.log("MISS: %s %s (%s)", inst.Directive, inst.Args, strings.Join(reasons, ", "))
+	return nil
+}
+
+func cacheMissReasons(state *BuildState, inst Instruction) ([]string, error) {
+	if _, ok, err := readCacheEntry(state.CurrentCacheKey); err != nil {
+		return nil, err
+	} else if ok {
+		outsHash, err := hashFiles(state.WorkDir, state.PendingOuts)
+		if err != nil || outsHash == "missing" {
+			return []string{"outputs are missing and cannot be restored"}, nil
+		}
+		return []string{"outputs changed since the step last ran"}, nil
+	}
+
+	previous, ok, err := previousCacheEntry(state.FileName, inst)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return []string{"no earlier run of this step is cached"}, nil
+	}
+	if previous.Inputs == nil {
+		return []string{"the cached run of this step does not record its cache key"}, nil
+	}
+	reasons := diffCacheInputs(previous, instructionText(inst), *state.CurrentCacheInputs)
+	if len(reasons) == 0 {
+		reasons = []string{"its cache entry was removed"}
+	}
+	return reasons, nil
+}
+
+// previousCacheEntry returns the most recently used local entry recorded
+// for inst in fileName.
+func previousCacheEntry(fileName string, inst Instruction) (CacheEntry, bool, error) {
+	records, err := listCacheEntries()
+	if err != nil {
+		return CacheEntry{}, false, err
+	}
+	text := instructionText(inst)
+	for _, record := range records {
+		entry := record.Entry
+		if entry.File == fileName && (entry.Line == inst.Line || entry.Instruction == text) {
+			return entry, true, nil
+		}
+	}
+	return CacheEntry{}, false, nil
+}
+
+// diffCacheInputs names the cache key components of current that differ
+// from those recorded in previous.
+func diffCacheInputs(previous CacheEntry, instruction string, current CacheInputs) []string {
+	old := *previous.Inputs
+	var reasons []string
+	if old.Command != current.Command {
+		if previous.Instruction != "" && previous.Instruction != instruction {
+			reasons = append(reasons, fmt.Sprintf("command changed from %q", previous.Instruction))
+		} else {
+			reasons = append(reasons, "command changed")
+		}
+	}
+	if old.Shell != current.Shell {
+		reasons = append(reasons, fmt.Sprintf("shell changed from %s to %s", valueOrDash(old.Shell), valueOrDash(current.Shell)))
+	}
+	if old.DepsHash != current.DepsHash {
+		deps := diffDigests("dep", old.Deps, current.Deps)
+		if len(deps) == 0 {
+			deps = []string{"deps changed"}
+		}
+		reasons = append(reasons, deps...)
+	}
+	if old.KeyID != current.KeyID {
+		// Values digested with another machine's key never match, so only
+		// added and removed names can be told apart.
+		reasons = append(reasons, "ENV and ARG values were recorded on another machine")
+		reasons = append(reasons, diffDigests("env", namesOnly(old.Env), namesOnly(current.Env))...)
+		reasons = append(reasons, diffDigests("ARG", namesOnly(old.Args), namesOnly(current.Args))...)
+		return reasons
+	}
+	reasons = append(reasons, diffDigests("env", old.Env, current.Env)...)
+	reasons = append(reasons, diffDigests("ARG", old.Args, current.Args)...)
+	return reasons
+}
+
+// namesOnly returns digests with every value blanked, for comparing names.
+func namesOnly(digests map[string]string) map[string]string {
+	names := make(map[string]string, len(digests))
+	for name := range digests {
+		names[name] = ""
+	}
+	return names
+}
+
+// diffDigests lists the names added to, removed from or changed between two
+// maps of digests, sorted by name.
+func diffDigests(kind string, old map[string]string, current map[string]string) []string {
+	names := make(map[string]bool)
+	for name := range old {
+		names[name] = true
+	}
+	for name := range current {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var changes []string
+	for _, name := range sorted {
+		before, hadBefore := old[name]
+		after, hasAfter := current[name]
+		switch {
+		case !hadBefore:
+			changes = append(changes, fmt.Sprintf("%s %s added", kind, name))
+		case !hasAfter:
+			changes = append(changes, fmt.Sprintf("%s %s removed", kind, name))
+		case before != after:
+			changes = append(changes, fmt.Sprintf("%s %s changed", kind, name))
+		}
+	}
+	return changes
+}
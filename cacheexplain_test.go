@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runExplainCacheForTest(t *testing.T, fileName string, args map[string]string) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resultChan := make(chan string)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- processBuild(Job{
+			BuildID:      "explain-cache",
+			FileName:     fileName,
+			ResultChan:   resultChan,
+			Context:      ctx,
+			InitialArgs:  args,
+			ExplainCache: true,
+		})
+	}()
+	var output []string
+	for result := range resultChan {
+		output = append(output, result)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	return output
+}
+
+func missLine(output []string) string {
+	for _, line := range output {
+		if strings.HasPrefix(line, "MISS: ") {
+			return line
+		}
+	}
+	return ""
+}
+
+func TestExplainCacheNamesChangedComponents(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buildFile := filepath.Join(dir, "Jettyfile")
+	writeBuild := func(command string) {
+		t.Helper()
+		content := "ARG MODE=debug\nENV TOKEN=supersecret\nDEP *.txt\nOUT out/app\n" + command + "\n"
+		if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeBuild("RUN mkdir -p out && cat a.txt b.txt > out/app")
+
+	output := runExplainCacheForTest(t, buildFile, nil)
+	if got := missLine(output); !strings.Contains(got, "no earlier run of this step is cached") {
+		t.Fatalf("unexpected first explanation %q in %q", got, output)
+	}
+	if output := runExplainCacheForTest(t, buildFile, nil); missLine(output) != "" || !joinedOutputContains(output, "CACHED: RUN") {
+		t.Fatalf("expected a hit without an explanation, got %q", output)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "b.txt"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output = runExplainCacheForTest(t, buildFile, map[string]string{"MODE": "release"})
+	got := missLine(output)
+	for _, want := range []string{"dep b.txt changed", "ARG MODE changed"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q in %q", want, got)
+		}
+	}
+	if strings.Contains(got, "dep a.txt") || strings.Contains(got, "TOKEN") {
+		t.Fatalf("expected unchanged components not to be named, got %q", got)
+	}
+
+	writeBuild("RUN mkdir -p out && cat b.txt a.txt > out/app")
+	output = runExplainCacheForTest(t, buildFile, map[string]string{"MODE": "release"})
+	if got := missLine(output); !strings.Contains(got, `command changed from "RUN mkdir -p out && cat a.txt b.txt > out/app"`) {
+		t.Fatalf("expected the command change to be named, got %q", got)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "out", "app"), []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output = runExplainCacheForTest(t, buildFile, map[string]string{"MODE": "release"})
+	if got := missLine(output); !strings.Contains(got, "outputs changed since the step last ran") {
+		t.Fatalf("expected the edited output to be named, got %q", got)
+	}
+
+	records, err := listCacheEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if record.Entry.Inputs == nil || record.Entry.Inputs.Env["TOKEN"] == "" || record.Entry.Inputs.KeyID == "" {
+			t.Fatalf("expected the key components to be recorded, got %#v", record.Entry)
+		}
+		if record.Entry.Inputs.Env["TOKEN"] == valueDigest("supersecret") {
+			t.Fatal("expected variable values to be digested with the machine's key")
+		}
+		data, err := os.ReadFile(cacheEntryPath(record.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "supersecret") || strings.Contains(string(data), "release") {
+			t.Fatalf("expected variable values not to be stored in cache entries:\n%s", data)
+		}
+	}
+}
+
+func TestDiffCacheInputs(t *testing.T) {
+	previous := CacheEntry{
+		Instruction: "RUN make",
+		Inputs: &CacheInputs{
+			Command:  "c1",
+			DepsHash: "d1",
+			Deps:     map[string]string{"go.mod": "1", "main.go": "1", "old.go": "1"},
+			Env:      map[string]string{"CC": "gcc"},
+			Args:     map[string]string{"MODE": "debug"},
+		},
+	}
+	current := CacheInputs{
+		Command:  "c1",
+		Shell:    `["bash" "-c"]`,
+		DepsHash: "d2",
+		Deps:     map[string]string{"go.mod": "1", "main.go": "2", "new.go": "1"},
+		Env:      map[string]string{"CC": "gcc", "CGO": "0"},
+		Args:     map[string]string{},
+	}
+	got := diffCacheInputs(previous, "RUN make", current)
+	want := []string{
+		`shell changed from - to ["bash" "-c"]`,
+		"dep main.go changed",
+		"dep new.go added",
+		"dep old.go removed",
+		"env CGO added",
+		"ARG MODE removed",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("diffCacheInputs = %q, want %q", got, want)
+	}
+
+	current.Shell, current.DepsHash, current.KeyID = "", "d1", "other"
+	got = diffCacheInputs(previous, "RUN make", current)
+	want = []string{"ENV and ARG values were recorded on another machine", "env CGO added", "ARG MODE removed"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("diffCacheInputs with another key = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// maxCacheEntrySize bounds the body of an entry PUT; blobs are unbounded.
+const maxCacheEntrySize = 1 << 20
+
+// cacheDigestPattern matches cache keys and blob digests, both hex SHA-256.
+var cacheDigestPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// cacheServer serves the remote cache protocol of httpCacheStore from a
+// directory: entries as entries/KEY.json and blobs as blobs/XX/DIGEST.
+type cacheServer struct {
+	dir   string
+	token string
+}
+
+func newCacheServerHandler(dir string, token string) http.Handler {
+	server := &cacheServer{dir: dir, token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /entries/{key}", server.getEntry)
+	mux.HandleFunc("PUT /entries/{key}", server.putEntry)
+	mux.HandleFunc("GET /blobs/{digest}", server.getBlob)
+	mux.HandleFunc("PUT /blobs/{digest}", server.putBlob)
+	return server.authorize(mux)
+}
+
+// serveCache runs a cache server on addr until ctx is done.
+func serveCache(ctx context.Context, addr string, dir string, token string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:           newCacheServerHandler(dir, token),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	logger.Printf("Serving cache from %s on http://%s", dir, listener.Addr())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (server *cacheServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.token != "" {
+			want := "Bearer " + server.token
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (server *cacheServer) entryPath(key string) string {
+	return filepath.Join(server.dir, "entries", key+".json")
+}
+
+func (server *cacheServer) blobPath(digest string) string {
+	return filepath.Join(server.dir, "blobs", digest[:2], digest)
+}
+
+func (server *cacheServer) getEntry(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !cacheDigestPattern.MatchString(key) {
+		http.Error(w, "invalid cache key", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	server.serveFile(w, r, server.entryPath(key))
+}
+
+func (server *cacheServer) putEntry(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !cacheDigestPattern.MatchString(key) {
+		http.Error(w, "invalid cache key", http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCacheEntrySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var entry CacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		http.Error(w, "invalid cache entry: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, file := range entry.Files {
+		if !file.valid() {
+			http.Error(w, "invalid file in cache entry", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := server.write(server.entryPath(key), bytes.NewReader(data), ""); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *cacheServer) getBlob(w http.ResponseWriter, r *http.Request) {
+	digest := r.PathValue("digest")
+	if !cacheDigestPattern.MatchString(digest) {
+		http.Error(w, "invalid blob digest", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	server.serveFile(w, r, server.blobPath(digest))
+}
+
+// putBlob stores a blob only if its content matches its digest.
+func (server *cacheServer) putBlob(w http.ResponseWriter, r *http.Request) {
+	digest := r.PathValue("digest")
+	if !cacheDigestPattern.MatchString(digest) {
+		http.Error(w, "invalid blob digest", http.StatusBadRequest)
+		return
+	}
+	if err := server.write(server.blobPath(digest), r.Body, digest); errors.Is(err, errBlobCorrupt) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *cacheServer) serveFile(w http.ResponseWriter, r *http.Request, path string) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	io.Copy(w, file)
+}
+
+// write stores r at path through a temporary file. With a digest, the data
+// must match it or nothing is written.
+func (server *cacheServer) write(path string, r io.Reader, digest string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), "put-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	written, err := copyWithDigest(temp, r)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if digest != "" && written != digest {
+		return errBlobCorrupt
+	}
+	return os.Rename(temp.Name(), path)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// jettyCacheURLEnv points builds at a shared HTTP cache, such as one run
+	// with `jetty cache serve`.
+	jettyCacheURLEnv = "JETTY_CACHE_URL"
+	// jettyCacheTokenEnv is sent as a bearer token to the shared cache, and
+	// required from clients by `jetty cache serve`.
+	jettyCacheTokenEnv = "JETTY_CACHE_TOKEN"
+
+	remoteCacheTimeout = 30 * time.Second
+)
+
+// cacheStore records cache entries by cache key and provides the output
+// blobs they name.
+type cacheStore interface {
+	// Get returns the entry recorded for key.
+	Get(ctx context.Context, key string) (CacheEntry, bool, error)
+	// Put records entry for key. The blobs of its files must already be in
+	// the local blob store.
+	Put(ctx context.Context, key string, entry CacheEntry) error
+	// FetchBlob makes the blob digest available in the local blob store and
+	// reports whether it could.
+	FetchBlob(ctx context.Context, digest string) (bool, error)
+}
+
+var (
+	remoteCacheStoresMu sync.Mutex
+	remoteCacheStores   = make(map[string]*httpCacheStore)
+)
+
+// openCacheStore returns the store named by JETTY_CACHE_URL, or the local
+// store under the state directory when it is unset. Remote stores are shared
+// across the process, so a server that went offline is only reported once.
+func openCacheStore() cacheStore {
+	baseURL := strings.TrimRight(os.Getenv(jettyCacheURLEnv), "/")
+	if baseURL == "" {
+		return localCacheStore{}
+	}
+	token := os.Getenv(jettyCacheTokenEnv)
+	remoteCacheStoresMu.Lock()
+	defer remoteCacheStoresMu.Unlock()
+	id := baseURL + "\x00" + token
+	store, ok := remoteCacheStores[id]
+	if !ok {
+		store = &httpCacheStore{
+			baseURL: baseURL,
+			token:   token,
+			client:  &http.Client{Timeout: remoteCacheTimeout},
+		}
+		remoteCacheStores[id] = store
+	}
+	return store
+}
+
+// localCacheStore keeps entries and blobs under the state directory.
+type localCacheStore struct{}
+
+func (localCacheStore) Get(ctx context.Context, key string) (CacheEntry, bool, error) {
+	return readCacheEntry(key)
+}
+
+func (localCacheStore) Put(ctx context.Context, key string, entry CacheEntry) error {
+	return writeCacheEntry(key, entry)
+}
+
+func (localCacheStore) FetchBlob(ctx context.Context, digest string) (bool, error) {
+	_, err := os.Stat(blobPath(digest))
+	return err == nil, nil
+}
+
+// httpCacheStore shares entries and blobs through an HTTP server with
+// GET and PUT on /entries/KEY and /blobs/DIGEST. It reads through and
+// writes through the local store, so a build keeps working from the local
+// cache alone once the server cannot be reached.
+type httpCacheStore struct {
+	baseURL string
+	token   string
+	client  *http.Client
+	local   localCacheStore
+	// offline is set after the first failed request; later requests skip
+	// the server.
+	offline atomic.Bool
+}
+
+func (store *httpCacheStore) Get(ctx context.Context, key string) (CacheEntry, bool, error) {
+	entry, ok, err := store.local.Get(ctx, key)
+	if err != nil || ok || store.offline.Load() {
+		return entry, ok, err
+	}
+	resp, err := store.do(ctx, http.MethodGet, "entries/"+key, nil)
+	if err != nil {
+		store.fail(ctx, err)
+		return CacheEntry{}, false, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return CacheEntry{}, false, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+		store.fail(ctx, fmt.Errorf("invalid entry %s: %w", key, err))
+		return CacheEntry{}, false, nil
+	}
+	if err := store.local.Put(ctx, key, entry); err != nil {
+		return CacheEntry{}, false, err
+	}
+	return entry, true, nil
+}
+
+func (store *httpCacheStore) Put(ctx context.Context, key string, entry CacheEntry) error {
+	if err := store.local.Put(ctx, key, entry); err != nil {
+		return err
+	}
+	if store.offline.Load() {
+		return nil
+	}
+	// Upload the blobs first, so the server never holds an entry whose
+	// outputs it cannot serve.
+	for _, file := range entry.Files {
+		if err := store.putBlob(ctx, file.Blob); err != nil {
+			store.fail(ctx, err)
+			return nil
+		}
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	resp, err := store.do(ctx, http.MethodPut, "entries/"+key, bytes.NewReader(data))
+	if err != nil {
+		store.fail(ctx, err)
+		return nil
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (store *httpCacheStore) putBlob(ctx context.Context, digest string) error {
+	blob, err := os.Open(blobPath(digest))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	resp, err := store.do(ctx, http.MethodPut, "blobs/"+digest, blob)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (store *httpCacheStore) FetchBlob(ctx context.Context, digest string) (bool, error) {
+	if ok, err := store.local.FetchBlob(ctx, digest); err != nil || ok || store.offline.Load() {
+		return ok, err
+	}
+	resp, err := store.do(ctx, http.MethodGet, "blobs/"+digest, nil)
+	if err != nil {
+		store.fail(ctx, err)
+		return false, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	written, err := writeBlob(resp.Body)
+	if err != nil {
+		store.fail(ctx, fmt.Errorf("download blob %s: %w", digest, err))
+		return false, nil
+	}
+	if written != digest {
+		os.Remove(blobPath(written))
+		return false, nil
+	}
+	return true, nil
+}
+
+// do sends a request to the server. A GET may return 404; any other status
+// that is not 2xx is an error.
+func (store *httpCacheStore) do(ctx context.Context, method string, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, store.baseURL+"/"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if store.token != "" {
+		req.Header.Set("Authorization", "Bearer "+store.token)
+	}
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 || (method == http.MethodGet && resp.StatusCode == http.StatusNotFound) {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+}
+
+// fail switches the store to local-only after a failed request. A request
+// that failed because the build was cancelled does not count.
+func (store *httpCacheStore) fail(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	if store.offline.CompareAndSwap(false, true) {
+		logger.Printf("Warning: remote cache %s is unavailable, using the local cache: %v", store.baseURL, err)
+	}
+}
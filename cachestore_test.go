@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeCheckout creates a checkout with a cached step that copies input.txt
+// to out/app and counts its runs in runs.txt.
+func writeCheckout(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "input.txt"), []byte("input"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := "DEP input.txt\nOUT out/app\nRUN echo x >> runs.txt && mkdir -p out && cp input.txt out/app\n"
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, buildFile
+}
+
+func TestRemoteCacheSharesOutputsAcrossCheckouts(t *testing.T) {
+	server := httptest.NewServer(newCacheServerHandler(t.TempDir(), "secret"))
+	defer server.Close()
+	t.Setenv(jettyCacheURLEnv, server.URL)
+	t.Setenv(jettyCacheTokenEnv, "secret")
+
+	first, firstBuild := writeCheckout(t)
+	t.Setenv(jettyStateDirEnv, filepath.Join(first, "state"))
+	if _, _, err := runBuildForTest(t, firstBuild); err != nil {
+		t.Fatalf("first build failed: %v", err)
+	}
+
+	second, secondBuild := writeCheckout(t)
+	t.Setenv(jettyStateDirEnv, filepath.Join(second, "state"))
+	output, _, err := runBuildForTest(t, secondBuild)
+	if err != nil {
+		t.Fatalf("second build failed: %v", err)
+	}
+	if !joinedOutputContains(output, "RESTORED: RUN") {
+		t.Fatalf("expected the second checkout to restore from the remote cache, got %q", output)
+	}
+	assertFileContent(t, filepath.Join(second, "out", "app"), "input")
+	if _, err := os.Stat(filepath.Join(second, "runs.txt")); !os.IsNotExist(err) {
+		t.Fatal("expected the step not to run in the second checkout")
+	}
+}
+
+func TestRemoteCacheFallsBackToLocal(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	t.Setenv(jettyCacheURLEnv, server.URL)
+	dir, buildFile := writeCheckout(t)
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+
+	var logs bytes.Buffer
+	previous := logger
+	logger = log.New(&logs, "", 0)
+	defer func() { logger = previous }()
+
+	if _, _, err := runBuildForTest(t, buildFile); err != nil {
+		t.Fatalf("first build failed: %v", err)
+	}
+	output, _, err := runBuildForTest(t, buildFile)
+	if err != nil || !joinedOutputContains(output, "CACHED: RUN") {
+		t.Fatalf("expected the local cache to be used, got %q %v", output, err)
+	}
+	if count := strings.Count(logs.String(), "is unavailable, using the local cache"); count != 1 {
+		t.Fatalf("expected one warning about the remote cache, got %d:\n%s", count, logs.String())
+	}
+}
+
+func TestCacheServerRejectsBadRequests(t *testing.T) {
+	server := httptest.NewServer(newCacheServerHandler(t.TempDir(), "secret"))
+	defer server.Close()
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte("blob")))
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		body   string
+		want   int
+	}{
+		{http.MethodGet, "/entries/" + digest, "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/entries/" + digest, "wrong", "", http.StatusUnauthorized},
+		{http.MethodGet, "/entries/" + digest, "secret", "", http.StatusNotFound},
+		{http.MethodGet, "/entries/..%2Fsecret", "secret", "", http.StatusBadRequest},
+		{http.MethodPut, "/blobs/" + digest, "secret", "other", http.StatusBadRequest},
+		{http.MethodPut, "/blobs/" + digest, "secret", "blob", http.StatusNoContent},
+		{http.MethodGet, "/blobs/" + digest, "secret", "", http.StatusOK},
+		{http.MethodPut, "/entries/" + digest, "secret", "{", http.StatusBadRequest},
+		{http.MethodPut, "/entries/" + digest, "secret", `{"outputs":{"hash":"none"}}`, http.StatusNoContent},
+		{http.MethodPut, "/entries/" + digest, "secret", `{"files":[{"path":"../../etc/passwd","blob":"` + digest + `"}]}`, http.StatusBadRequest},
+		{http.MethodPut, "/entries/" + digest, "secret", `{"files":[{"path":"/etc/passwd","blob":"` + digest + `"}]}`, http.StatusBadRequest},
+		{http.MethodPut, "/entries/" + digest, "secret", `{"files":[{"path":"out/app","blob":"../blob"}]}`, http.StatusBadRequest},
+		{http.MethodPut, "/entries/" + digest, "secret", `{"files":[{"path":"out/app","blob":"` + digest + `"}]}`, http.StatusNoContent},
+		{http.MethodDelete, "/entries/" + digest, "secret", "", http.StatusMethodNotAllowed},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest(tc.method, server.URL+tc.path, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s %s = %d, want %d", tc.method, tc.path, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestCacheCommandRequiresSubcommand(t *testing.T) {
+	err := handleSubcommands(context.Background(), []string{"cache"})
+	if err == nil || !strings.Contains(err.Error(), "cache requires a subcommand") {
+		t.Fatalf("expected cache without a subcommand to fail, got %v", err)
+	}
+	err = handleSubcommands(context.Background(), []string{"cache", "serve", "extra"})
+	if err == nil || !strings.Contains(err.Error(), "cache serve does not accept arguments") {
+		t.Fatalf("expected cache serve to reject arguments, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// isCapture reports whether inst is a `$RUN NAME command` or
+// `&RUN NAME command`, which store the command's output in a variable.
+func isCapture(inst Instruction) bool {
+	return inst.Directive == "RUN" && (inst.Symbol == "$" || inst.Symbol == "&")
+}
+
+// parseCapture splits the arguments of a capturing RUN into the variable name,
+// as written, and the command.
+func parseCapture(inst Instruction) (string, string, error) {
+	name, command := strings.TrimSpace(inst.Args), ""
+	if i := strings.IndexAny(name, " \t\n"); i >= 0 {
+		name, command = name[:i], strings.TrimSpace(name[i:])
+	}
+	if name == "" {
+		return "", "", fmt.Errorf("%sRUN requires a variable name and command", inst.Symbol)
+	}
+	if command == "" && inst.Heredoc == nil {
+		return "", "", fmt.Errorf("%sRUN requires a command", inst.Symbol)
+	}
+	return name, command, nil
+}
+
+// executeCapture runs the command of a capturing RUN and stores its trimmed
+// standard output: in Env for $RUN, in Args for &RUN. Standard error is
+// logged as usual. With --status=NAME the exit code is stored in NAME as
+// well, and a command that exits non-zero does not fail the build.
+func executeCapture(state *BuildState, inst Instruction) error {
+	rawName, command, err := parseCapture(inst)
+	if err != nil {
+		return err
+	}
+	name, err := state.expand(rawName)
+	if err != nil {
+		return err
+	}
+	variables := state.Env
+	if inst.Symbol == "&" {
+		variables = state.Args
+	}
+	if !isValidName(name) {
+		return fmt.Errorf("invalid variable name: %s", name)
+	}
+	statusName := inst.Options["status"]
+	inst.Args = command
+	var output bytes.Buffer
+	status := 0
+	if err := executeShell(state, inst.Symbol+"RUN", inst, &output); err != nil {
+		var exitErr *exec.ExitError
+		if statusName == "" || !errors.As(err, &exitErr) || state.Context.Err() != nil {
+			return err
+		}
+		status = exitErr.ExitCode()
+	}
+	variables[name] = strings.TrimSpace(output.String())
+	if statusName == "" {
+		state.log("%sRUN: %s set", inst.Symbol, name)
+		return nil
+	}
+	variables[statusName] = strconv.Itoa(status)
+	state.log("%sRUN: %s set, %s=%d", inst.Symbol, name, statusName, status)
+	return nil
+}
+
+// planCapture logs the command a capturing RUN would run. Its variable is
+// left unset.
+func planCapture(state *BuildState, inst Instruction) error {
+	name, command, err := parseCapture(inst)
+	if err != nil {
+		return err
+	}
+	inst.Args = command
+	script, _, err := state.shellScript(inst)
+	if err != nil {
+		return err
+	}
+	state.log("PLAN %sRUN %s in %s: %s", inst.Symbol, name, state.WorkDir, script)
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildCapturesCommandOutput(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"ARG PREFIX=v",
+		"$RUN VERSION printf '  %s1.2.3\\n\\n' $PREFIX",
+		"&RUN --status=CODE OWNER echo jetty; echo oops >&2; exit 3",
+		"$RUN LINES <<EOF",
+		"echo one",
+		"echo two",
+		"EOF",
+		"^FMT out.txt \"%s|%s|%s|%s\" $VERSION $OWNER $CODE \"$LINES\"",
+		"$RUN --status=OK EMPTY true",
+		"^FMT status.txt \"%s:%s\" \"$EMPTY\" $OK",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, _, err := runBuildForTest(t, buildFile)
+	if err != nil {
+		t.Fatalf("build returned error: %v\noutput:\n%s", err, strings.Join(output, "\n"))
+	}
+	assertFileContent(t, filepath.Join(dir, "out.txt"), "v1.2.3|jetty|3|one\ntwo")
+	assertFileContent(t, filepath.Join(dir, "status.txt"), ":0")
+	if !joinedOutputContains(output, "oops") || joinedOutputContains(output, "] jetty") {
+		t.Fatalf("expected stderr to be logged and stdout to be captured, got %v", output)
+	}
+	if !joinedOutputContains(output, "&RUN: OWNER set, CODE=3") {
+		t.Fatalf("expected the capture to be logged, got %v", output)
+	}
+}
+
+func TestBuildCaptureFailsWithoutStatus(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	if err := os.WriteFile(buildFile, []byte("$RUN OUT exit 2\nRUN touch after.txt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := runBuildForTest(t, buildFile)
+	if err == nil || !strings.Contains(err.Error(), "line 1 [$RUN OUT exit 2]: shell command failed") {
+		t.Fatalf("expected the capture to fail the build, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "after.txt")); !os.IsNotExist(err) {
+		t.Fatal("expected the build to stop after the failed capture")
+	}
+}
+
+func TestParseFileValidatesCaptureOptions(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"RUN --status=CODE echo\n", "line 1: option --status requires a capturing ($ or &) instruction"},
+		{"$RUN --status=1X OUT echo\n", "line 1: invalid --status \"1X\": expected a variable name"},
+		{"^RUN echo\n", "line 1: modifier ^ is not supported for directive RUN"},
+	}
+	for _, tc := range tests {
+		fileName := filepath.Join(t.TempDir(), "Jettyfile")
+		if err := os.WriteFile(fileName, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := parseFile(fileName)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parseFile(%q) error = %v, want %q", tc.content, err, tc.want)
+		}
+	}
+}
+
+func TestDryRunPlansCaptures(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	if err := os.WriteFile(buildFile, []byte("ARG REF=HEAD\n$RUN SHA touch ran.txt; echo $REF\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err := runDryRunForTest(t, buildFile)
+	if err != nil {
+		t.Fatalf("dry run returned error: %v", err)
+	}
+	if !joinedOutputContains(output, "PLAN $RUN SHA in "+dir+": touch ran.txt; echo HEAD") {
+		t.Fatalf("expected the capture to be planned, got %v", output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ran.txt")); !os.IsNotExist(err) {
+		t.Fatal("expected the dry run not to run the command")
+	}
+}
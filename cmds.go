@@ -133,30 +133,248 @@ func registerCommands() {
 			if err != nil {
 				return fmt.Errorf("validation failed: %w", err)
 			}
-			logger.Printf("Successfully validated %s (%d instructions)", fileName, len(instructions))
+			if err := validateBuild(instructions); err != nil {
+				return fmt.Errorf("validation failed: %w", err)
+			}
+			logger.Printf("Successfully validated %s (%d instructions)", fileName, countInstructions(instructions))
 			return nil
 		},
 		MinArgs: 0,
 		MaxArgs: 1,
 	})
+	registerCommand("fmt", Command{
+		Name:        "fmt",
+		Description: "Format Jettyfiles in canonical style",
+		Usage:       "fmt [-w] [--check] [files...]",
+		Run: func(ctx context.Context, args []string) error {
+			fs := flag.NewFlagSet("fmt", flag.ContinueOnError)
+			fs.SetOutput(os.Stderr)
+			writeFlag := fs.Bool("w", false, "Write the result back to each file instead of printing it")
+			checkFlag := fs.Bool("check", false, "List files that are not formatted and fail if there are any")
+			if err := fs.Parse(args); err != nil {
+				return err
+			}
+			if *writeFlag && *checkFlag {
+				return fmt.Errorf("%w: fmt accepts either -w or --check", ErrInvalidInput)
+			}
+			fileNames := fs.Args()
+			if len(fileNames) == 0 {
+				fileNames = []string{"Jettyfile"}
+			}
+			return formatFiles(fileNames, *writeFlag, *checkFlag)
+		},
+		MinArgs: 0,
+		MaxArgs: 0,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("fmt", flag.ContinueOnError)
+			fs.Bool("w", false, "Write the result back to each file instead of printing it")
+			fs.Bool("check", false, "List files that are not formatted and fail if there are any")
+			return fs
+		}(),
+	})
+	registerCommand("lint", Command{
+		Name:        "lint",
+		Description: "Check Jettyfiles for likely mistakes",
+		Usage:       "lint [--format text|json] [files...]",
+		Run: func(ctx context.Context, args []string) error {
+			fs := flag.NewFlagSet("lint", flag.ContinueOnError)
+			fs.SetOutput(os.Stderr)
+			formatFlag := fs.String("format", "text", "Output format: text or json")
+			if err := fs.Parse(args); err != nil {
+				return err
+			}
+			fileNames := fs.Args()
+			if len(fileNames) == 0 {
+				fileNames = []string{"Jettyfile"}
+			}
+			var findings []lintFinding
+			for _, fileName := range fileNames {
+				fileFindings, err := lintFile(fileName)
+				if err != nil {
+					return fmt.Errorf("lint %s: %w", fileName, err)
+				}
+				findings = append(findings, fileFindings...)
+			}
+			if err := writeLintFindings(stdout, findings, *formatFlag); err != nil {
+				return err
+			}
+			if len(findings) > 0 {
+				return fmt.Errorf("lint found %d problem(s)", len(findings))
+			}
+			return nil
+		},
+		MinArgs: 0,
+		MaxArgs: 0,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("lint", flag.ContinueOnError)
+			fs.String("format", "text", "Output format: text or json")
+			return fs
+		}(),
+	})
+	registerCommand("lsp", Command{
+		Name:        "lsp",
+		Description: "Run the Jettyfile language server over stdio",
+		Usage:       "lsp",
+		Run: func(ctx context.Context, args []string) error {
+			if len(args) != 0 {
+				return fmt.Errorf("%w: lsp does not accept arguments", ErrInvalidInput)
+			}
+			return serveLSP(ctx, os.Stdin, stdout)
+		},
+		MinArgs:   0,
+		MaxArgs:   0,
+		NoTimeout: true,
+	})
+	registerCommand("params", Command{
+		Name:        "params",
+		Description: "List the build parameters a Jettyfile accepts",
+		Usage:       "params [filename]",
+		Run: func(ctx context.Context, args []string) error {
+			fileName := "Jettyfile"
+			if len(args) > 0 {
+				fileName = args[0]
+			}
+			return listParams(fileName)
+		},
+		MinArgs: 0,
+		MaxArgs: 1,
+	})
+	registerCommand("cache", Command{
+		Name:        "cache",
+		Description: "Manage the DEP/OUT step cache",
+		Usage:       "cache <subcommand> [args...]",
+		MinArgs:     0,
+		MaxArgs:     0,
+		Subcommands: map[string]*Command{
+			"ls": {
+				Name:        "cache ls",
+				Description: "List local cache entries, most recently used first",
+				Usage:       "ls",
+				Run: func(ctx context.Context, args []string) error {
+					if len(args) != 0 {
+						return fmt.Errorf("%w: cache ls does not accept arguments", ErrInvalidInput)
+					}
+					records, err := listCacheEntries()
+					if err != nil {
+						return err
+					}
+					return printCacheEntries(stdout, records)
+				},
+			},
+			"inspect": {
+				Name:        "cache inspect",
+				Description: "Show a cache entry and its output files",
+				Usage:       "inspect <key>",
+				Run: func(ctx context.Context, args []string) error {
+					record, err := findCacheEntry(args[0])
+					if err != nil {
+						return err
+					}
+					return printCacheEntry(stdout, record)
+				},
+				MinArgs: 1,
+				MaxArgs: 1,
+			},
+			"prune": {
+				Name:        "cache prune",
+				Description: "Remove old cache entries and the outputs only they use",
+				Usage:       "prune [--older-than duration] [--max-size size]",
+				Run: func(ctx context.Context, args []string) error {
+					fs := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+					fs.SetOutput(os.Stderr)
+					olderThanFlag := fs.Duration("older-than", 0, "Remove entries not used within this duration, e.g. 168h")
+					maxSizeFlag := fs.String("max-size", "", "Then remove the least recently used entries until the cache fits, e.g. 2GiB")
+					if err := fs.Parse(args); err != nil {
+						return err
+					}
+					if fs.NArg() != 0 {
+						return fmt.Errorf("%w: cache prune does not accept arguments", ErrInvalidInput)
+					}
+					if *olderThanFlag < 0 {
+						return fmt.Errorf("%w: --older-than must not be negative", ErrInvalidInput)
+					}
+					var maxSize int64
+					if *maxSizeFlag != "" {
+						size, err := parseSize(*maxSizeFlag)
+						if err != nil {
+							return fmt.Errorf("%w: --max-size: %w", ErrInvalidInput, err)
+						}
+						maxSize = size
+					}
+					if *olderThanFlag == 0 && maxSize == 0 {
+						return fmt.Errorf("%w: cache prune requires --older-than or --max-size", ErrInvalidInput)
+					}
+					removed, freed, err := pruneCache(*olderThanFlag, maxSize)
+					if err != nil {
+						return err
+					}
+					logger.Printf("Pruned %d cache entries, freed %s", removed, formatSize(freed))
+					return nil
+				},
+			},
+			"clear": {
+				Name:        "cache clear",
+				Description: "Remove every local cache entry and output",
+				Usage:       "clear",
+				Run: func(ctx context.Context, args []string) error {
+					if len(args) != 0 {
+						return fmt.Errorf("%w: cache clear does not accept arguments", ErrInvalidInput)
+					}
+					if err := clearCache(); err != nil {
+						return err
+					}
+					logger.Println("Cleared the cache")
+					return nil
+				},
+			},
+			"serve": {
+				Name:        "cache serve",
+				Description: "Serve a shared step cache over HTTP",
+				Usage:       "serve [--addr host:port] [--dir directory]",
+				Run: func(ctx context.Context, args []string) error {
+					fs := flag.NewFlagSet("cache serve", flag.ContinueOnError)
+					fs.SetOutput(os.Stderr)
+					addrFlag := fs.String("addr", "localhost:7878", "Address to listen on")
+					dirFlag := fs.String("dir", filepath.Join(filepath.Dir(cacheStorePath()), "cache-server"), "Directory to store cache entries and blobs in")
+					if err := fs.Parse(args); err != nil {
+						return err
+					}
+					if fs.NArg() != 0 {
+						return fmt.Errorf("%w: cache serve does not accept arguments", ErrInvalidInput)
+					}
+					return serveCache(ctx, *addrFlag, *dirFlag, os.Getenv(jettyCacheTokenEnv))
+				},
+				NoTimeout: true,
+			},
+		},
+	})
 	registerCommand("build", Command{
 		Name:        "build",
 		Description: "Run a new build",
-		Usage:       "build [-f filename] [--env-file filename] [filename]",
+		Usage:       "build [-f filename] [--env-file filename] [--build-arg KEY=value]... [--build-arg-file filename] [--keep-going] [--dry-run] [--strict] [--explain-cache] [--help-args] [filename] [target...]",
 		Run: func(ctx context.Context, args []string) error {
 			fs := flag.NewFlagSet("build", flag.ContinueOnError)
 			fs.SetOutput(os.Stderr)
 			fileFlag := fs.String("f", "", "Specify the build file")
 			envFileFlag := fs.String("env-file", "", "Specify an environment variable file to load")
+			keepGoingFlag := fs.Bool("keep-going", false, "Keep running independent steps after a failure and print a summary")
+			dryRunFlag := fs.Bool("dry-run", false, "Print the commands the build would run without running them")
+			strictFlag := fs.Bool("strict", false, "Fail on references to undefined variables")
+			explainCacheFlag := fs.Bool("explain-cache", false, "Explain why each cacheable step that runs missed the cache")
+			helpArgsFlag := fs.Bool("help-args", false, "List the build arguments the build file accepts and exit")
+			buildArgs := buildArgFlag{}
+			fs.Var(buildArgs, "build-arg", "Set a build argument as KEY=value (repeatable)")
+			buildArgFileFlag := fs.String("build-arg-file", "", "Load build arguments from a KEY=value file")
 			if err := fs.Parse(args); err != nil {
 				return err
 			}
-			fileName := *fileFlag
-			if fileName == "" && fs.NArg() > 0 {
-				fileName = fs.Arg(0)
+			initialArgs, err := loadBuildArgs(*buildArgFileFlag, buildArgs)
+			if err != nil {
+				return err
 			}
-			if fs.NArg() > 1 || (fileName != "" && *fileFlag != "" && fs.NArg() > 0) {
-				return fmt.Errorf("%w: build accepts either -f or one positional file", ErrInvalidInput)
+			fileName, targets, err := splitBuildArgs(*fileFlag, fs.Args())
+			if err != nil {
+				return err
 			}
 			if fileName == "" {
 				if _, err := os.Stat("Jettyfile"); err == nil {
@@ -167,6 +385,9 @@ func registerCommands() {
 					return fmt.Errorf("failed to inspect Jettyfile: %w", err)
 				}
 			}
+			if *helpArgsFlag {
+				return listParams(fileName)
+			}
 
 			resultChan := make(chan string)
 			buildInfoChan := make(chan BuildInfo)
@@ -177,7 +398,21 @@ func registerCommands() {
 			start := time.Now()
 
 			go func() {
-				errChan <- build(ctx, fileName, buildID, workerNode, resultChan, buildInfoChan, *envFileFlag)
+				errChan <- processBuild(Job{
+					BuildID:       buildID,
+					FileName:      fileName,
+					ResultChan:    resultChan,
+					BuildInfoChan: buildInfoChan,
+					WorkerNode:    workerNode,
+					Context:       ctx,
+					EnvFile:       *envFileFlag,
+					InitialArgs:   initialArgs,
+					Targets:       targets,
+					KeepGoing:     *keepGoingFlag,
+					DryRun:        *dryRunFlag,
+					Strict:        *strictFlag,
+					ExplainCache:  *explainCacheFlag,
+				})
 			}()
 
 			resultOpen := true
@@ -204,8 +439,12 @@ func registerCommands() {
 					return ctx.Err()
 				}
 			}
-			if err := <-errChan; err != nil {
-				return err
+			buildErr := <-errChan
+			if len(lastBuildInfo.Steps) > 0 && (*keepGoingFlag || hasFailedSteps(lastBuildInfo.Steps)) {
+				printStepSummary(stdout, lastBuildInfo.Steps)
+			}
+			if buildErr != nil {
+				return buildErr
 			}
 			logger.Printf("Build %s completed in %v. Status: %s, Worker: %s",
 				lastBuildInfo.ID, time.Since(start), lastBuildInfo.Status, lastBuildInfo.WorkerNode)
@@ -220,11 +459,123 @@ func registerCommands() {
 			fs := flag.NewFlagSet("build", flag.ContinueOnError)
 			fs.String("f", "", "Specify the build file")
 			fs.String("env-file", "", "Specify an environment variable file to load")
+			fs.Bool("keep-going", false, "Keep running independent steps after a failure and print a summary")
+			fs.Bool("dry-run", false, "Print the commands the build would run without running them")
+			fs.Bool("strict", false, "Fail on references to undefined variables")
+			fs.Bool("explain-cache", false, "Explain why each cacheable step that runs missed the cache")
+			fs.Bool("help-args", false, "List the build arguments the build file accepts and exit")
+			fs.Var(buildArgFlag{}, "build-arg", "Set a build argument as KEY=value (repeatable)")
+			fs.String("build-arg-file", "", "Load build arguments from a KEY=value file")
 			return fs
 		}(),
 	})
 }
 
+// listParams prints the parameters of fileName and the SUB files it reaches.
+func listParams(fileName string) error {
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return fmt.Errorf("file not found: %s", fileName)
+	}
+	params, err := collectParams(fileName)
+	if err != nil {
+		return err
+	}
+	return printParams(stdout, params)
+}
+
+// splitBuildArgs separates build's positional arguments into the build file
+// and the targets to run. Without -f, a leading argument naming an existing
+// file is taken as the build file, and one that does not exist is an error
+// rather than a target name when it has a directory separator, or a file
+// extension and the default Jettyfile has no target of that name. Every
+// other argument is a target name.
+func splitBuildArgs(fileFlag string, positional []string) (string, []string, error) {
+	if len(positional) == 0 {
+		return fileFlag, nil, nil
+	}
+	if isRegularFile(positional[0]) {
+		if fileFlag != "" {
+			return "", nil, fmt.Errorf("%w: build accepts either -f or one positional file", ErrInvalidInput)
+		}
+		return positional[0], positional[1:], nil
+	}
+	if fileFlag == "" {
+		arg := positional[0]
+		isPath := strings.ContainsRune(arg, '/') || strings.ContainsRune(arg, filepath.Separator)
+		if isPath || (filepath.Ext(arg) != "" && !definesTarget("Jettyfile", arg)) {
+			return "", nil, fmt.Errorf("%w: build file %s not found", ErrInvalidInput, arg)
+		}
+	}
+	return fileFlag, positional, nil
+}
+
+// definesTarget reports whether the Jettyfile fileName parses and declares
+// the target name.
+func definesTarget(fileName string, name string) bool {
+	instructions, err := parseFile(fileName)
+	if err != nil {
+		return false
+	}
+	graph, err := newTargetGraph(instructions)
+	if err != nil {
+		return false
+	}
+	_, ok := graph.headers[name]
+	return ok
+}
+
+// buildArgFlag collects repeatable --build-arg KEY=value flags.
+type buildArgFlag map[string]string
+
+func (f buildArgFlag) String() string {
+	keys := make([]string, 0, len(f))
+	for key := range f {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + f[key]
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f buildArgFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || !isValidName(key) {
+		return fmt.Errorf("invalid build argument %q, expected KEY=value", value)
+	}
+	f[key] = val
+	return nil
+}
+
+// loadBuildArgs merges the build arguments from --build-arg-file with the
+// --build-arg flags, which take precedence.
+func loadBuildArgs(fileName string, flags buildArgFlag) (map[string]string, error) {
+	args := make(map[string]string)
+	if fileName != "" {
+		values, err := readAssignmentFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load build arg file %s: %w", fileName, err)
+		}
+		for key, value := range values {
+			if !isValidName(key) {
+				return nil, fmt.Errorf("%w: invalid build argument name %q in %s", ErrInvalidInput, key, fileName)
+			}
+			args[key] = value
+		}
+	}
+	for key, value := range flags {
+		args[key] = value
+	}
+	return args, nil
+}
+
+func isRegularFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
 // isUnsafeCleanTarget reports whether removing dir would be dangerous, i.e. it
 // resolves to the filesystem root, the user's home directory, or the current
 // working directory rather than a dedicated Jetty state directory.
@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -120,3 +121,63 @@ func TestRegisteredCommandsEdges(t *testing.T) {
 		t.Errorf("expected status to fail with positional arguments")
 	}
 }
+
+func TestBuildHelpDocumentsEveryFlag(t *testing.T) {
+	build := commands["build"]
+	for _, word := range strings.Fields(build.Usage) {
+		name, ok := strings.CutPrefix(strings.Trim(word, "[]."), "-")
+		if !ok {
+			continue
+		}
+		if name = strings.TrimPrefix(name, "-"); build.Flags.Lookup(name) == nil {
+			t.Errorf("build help does not document -%s", name)
+		}
+	}
+}
+
+func TestBuildCommandAppliesBuildArgs(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"ARG MODE=debug",
+		"ARG TAG",
+		"ARG NAME=default",
+		"ARG NAME=$NAME-override",
+		"^FMT out.txt \"%s %s %s\" $MODE $TAG $NAME",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	argFile := filepath.Join(dir, "args.env")
+	if err := os.WriteFile(argFile, []byte("# release args\nTAG=\"v1.2\"\nMODE=file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := handleSubcommands(ctx, []string{"build", "--build-arg", "MODE=release", "--build-arg-file", argFile, "-f", buildFile})
+	if err != nil {
+		t.Fatalf("handleSubcommands returned error: %v", err)
+	}
+	assertFileContent(t, filepath.Join(dir, "out.txt"), "release v1.2 default-override")
+
+	err = handleSubcommands(ctx, []string{"build", "-f", buildFile})
+	if err == nil || !strings.Contains(err.Error(), "required ARG TAG is not set") {
+		t.Fatalf("expected a missing required ARG to fail the build, got %v", err)
+	}
+
+	err = handleSubcommands(ctx, []string{"build", "--build-arg", "1BAD=x", "-f", buildFile})
+	if err == nil || !strings.Contains(err.Error(), "invalid build argument") {
+		t.Fatalf("expected an invalid --build-arg to be rejected, got %v", err)
+	}
+
+	if err := os.WriteFile(argFile, []byte("BAD-NAME=x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = handleSubcommands(ctx, []string{"build", "--build-arg-file", argFile, "-f", buildFile})
+	if err == nil || !strings.Contains(err.Error(), "invalid build argument name") {
+		t.Fatalf("expected an invalid build arg file to be rejected, got %v", err)
+	}
+}
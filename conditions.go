@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// condition is a parsed IF expression. Operands are kept unexpanded so they
+// are resolved against the build state at the point the IF executes.
+type condition struct {
+	negate   bool
+	kind     string
+	operands []string
+}
+
+// parseCondition parses the arguments of an IF directive:
+//
+//	IF [NOT] DEFINED name   name is set as an ARG, ENV, or host variable
+//	IF [NOT] EXISTS path    path exists relative to the working directory
+//	IF [NOT] OS name        runtime.GOOS equals name
+//	IF [NOT] a == b         the expanded operands are equal
+//	IF [NOT] a != b         the expanded operands differ
+func parseCondition(args string) (condition, error) {
+	parts, err := splitArgs(args)
+	if err != nil {
+		return condition{}, err
+	}
+	var cond condition
+	if len(parts) > 0 && parts[0] == "NOT" {
+		cond.negate = true
+		parts = parts[1:]
+	}
+	if len(parts) == 0 {
+		return condition{}, fmt.Errorf("IF requires a condition")
+	}
+	switch {
+	case parts[0] == "DEFINED" || parts[0] == "EXISTS" || parts[0] == "OS":
+		if len(parts) != 2 {
+			return condition{}, fmt.Errorf("IF %s requires exactly one operand", parts[0])
+		}
+		cond.kind = parts[0]
+		cond.operands = parts[1:]
+	case len(parts) == 3 && (parts[1] == "==" || parts[1] == "!="):
+		cond.kind = parts[1]
+		cond.operands = []string{parts[0], parts[2]}
+	default:
+		return condition{}, fmt.Errorf("invalid IF condition: %s", strings.TrimSpace(args))
+	}
+	return cond, nil
+}
+
+// evaluateCondition parses and evaluates an IF condition against state.
+func evaluateCondition(state *BuildState, args string) (bool, error) {
+	cond, err := parseCondition(args)
+	if err != nil {
+		return false, err
+	}
+	operands, err := state.expandAll(cond.operands)
+	if err != nil {
+		return false, err
+	}
+	var matched bool
+	switch cond.kind {
+	case "DEFINED":
+		matched = state.isDefined(operands[0])
+	case "EXISTS":
+		_, statErr := os.Stat(state.resolvePath(operands[0]))
+		matched = statErr == nil
+	case "OS":
+		matched = strings.EqualFold(runtime.GOOS, operands[0])
+	case "==":
+		matched = operands[0] == operands[1]
+	case "!=":
+		matched = operands[0] != operands[1]
+	}
+	return matched != cond.negate, nil
+}
+
+// isDefined reports whether name is set as a build ARG, a build ENV, or in the
+// host environment commands inherit (so `IF DEFINED CI` works on CI runners).
+func (state *BuildState) isDefined(name string) bool {
+	if _, ok := state.Args[name]; ok {
+		return true
+	}
+	if _, ok := state.Env[name]; ok {
+		return true
+	}
+	_, ok := os.LookupEnv(name)
+	return ok
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseCondition(t *testing.T) {
+	valid := []string{
+		"DEFINED CI",
+		"NOT DEFINED CI",
+		"EXISTS go.mod",
+		"OS linux",
+		"$MODE == release",
+		"NOT $MODE != \"a b\"",
+	}
+	for _, args := range valid {
+		if _, err := parseCondition(args); err != nil {
+			t.Errorf("parseCondition(%q) returned error: %v", args, err)
+		}
+	}
+	invalid := []string{
+		"",
+		"NOT",
+		"DEFINED",
+		"EXISTS a b",
+		"$MODE = release",
+		"a == b == c",
+		"\"unterminated",
+	}
+	for _, args := range invalid {
+		if _, err := parseCondition(args); err == nil {
+			t.Errorf("parseCondition(%q) expected an error", args)
+		}
+	}
+}
+
+func TestEvaluateCondition(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "present.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JETTY_TEST_HOST_VAR", "1")
+	state := &BuildState{
+		Context: context.Background(),
+		WorkDir: dir,
+		Args:    map[string]string{"MODE": "release"},
+		Env:     map[string]string{"TOKEN": "secret"},
+	}
+	tests := []struct {
+		args string
+		want bool
+	}{
+		{"DEFINED MODE", true},
+		{"DEFINED TOKEN", true},
+		{"DEFINED JETTY_TEST_HOST_VAR", true},
+		{"DEFINED MISSING", false},
+		{"NOT DEFINED MISSING", true},
+		{"EXISTS present.txt", true},
+		{"EXISTS absent.txt", false},
+		{"OS " + runtime.GOOS, true},
+		{"OS plan9-not-really", false},
+		{"$MODE == release", true},
+		{"$MODE == debug", false},
+		{"$MODE != debug", true},
+		{"NOT $MODE == release", false},
+	}
+	for _, tc := range tests {
+		got, err := evaluateCondition(state, tc.args)
+		if err != nil {
+			t.Errorf("evaluateCondition(%q) returned error: %v", tc.args, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("evaluateCondition(%q) = %v, want %v", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestParseFileNestsConditionalBlocks(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"IF DEFINED CI",
+		"  RUN echo ci",
+		"  IF OS linux",
+		"    RUN echo linux",
+		"  END",
+		"ELSE",
+		"  RUN echo local",
+		"END",
+		"RUN echo after",
+		"",
+	}, "\n")
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	instructions, err := parseFile(fileName)
+	if err != nil {
+		t.Fatalf("parseFile returned error: %v", err)
+	}
+	if len(instructions) != 2 {
+		t.Fatalf("expected IF block and trailing RUN, got %d instructions", len(instructions))
+	}
+	block := instructions[0]
+	if block.Directive != "IF" || len(block.Body) != 2 || len(block.Else) != 1 {
+		t.Fatalf("unexpected IF block: %#v", block)
+	}
+	if block.Body[1].Directive != "IF" || len(block.Body[1].Body) != 1 {
+		t.Fatalf("expected nested IF block, got %#v", block.Body[1])
+	}
+}
+
+func TestParseFileRejectsMalformedBlocks(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"IF DEFINED CI\nRUN echo hi\n", "unterminated IF block"},
+		{"RUN echo hi\nEND\n", "END without matching block"},
+		{"ELSE\n", "ELSE without matching IF"},
+		{"IF DEFINED CI\nELSE\nELSE\nEND\n", "duplicate ELSE"},
+		{"IF DEFINED CI\nTGT build\nEND\n", "TGT is not allowed inside the IF block"},
+		{"IF CI\nEND\n", "invalid IF condition"},
+		{"END now\n", "END does not take arguments"},
+	}
+	dir := t.TempDir()
+	for i, tc := range tests {
+		fileName := filepath.Join(dir, "Jettyfile"+string(rune('a'+i)))
+		if err := os.WriteFile(fileName, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := parseFile(fileName)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parseFile(%q) error = %v, want %q", tc.content, err, tc.want)
+		}
+	}
+}
+
+func TestBuildHonorsConditionalBranches(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	if err := os.WriteFile(filepath.Join(dir, "source.txt"), []byte("copied"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"ARG MODE=release",
+		"IF $MODE == release",
+		"  *CPY source.txt out/async.txt",
+		"  &FMT PICKED \"%s\" release",
+		"ELSE",
+		"  CPY source.txt out/debug.txt",
+		"  &FMT PICKED \"%s\" debug",
+		"END",
+		"IF NOT EXISTS source.txt",
+		"  CPY missing.txt out/never.txt",
+		"END",
+		"CMD cat out/async.txt && echo \" $PICKED\"",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, _, err := runBuildForTest(t, buildFile)
+	if err != nil {
+		t.Fatalf("build returned error: %v\noutput:\n%s", err, strings.Join(output, "\n"))
+	}
+	assertFileContent(t, filepath.Join(dir, "out", "async.txt"), "copied")
+	if _, err := os.Stat(filepath.Join(dir, "out", "debug.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected ELSE branch to be skipped, stat err = %v", err)
+	}
+	// CMD must observe the async copy launched inside the taken branch.
+	if !joinedOutputContains(output, "CMD: copied release") {
+		t.Fatalf("expected CMD to see the async branch output, got %q", output)
+	}
+}
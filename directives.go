@@ -19,7 +19,7 @@ import (
 )
 
 const (
-	// remoteFetchTimeout bounds how long a remote SUB fetch may take.
+	// remoteFetchTimeout bounds how long a remote SUB or INC fetch may take.
 	remoteFetchTimeout = 30 * time.Second
 	// maxRemoteJettyfileSize caps the size of a remotely fetched Jettyfile.
 	maxRemoteJettyfileSize = 10 << 20 // 10 MiB
@@ -29,6 +29,9 @@ const (
 )
 
 func executeInstruction(state *BuildState, inst Instruction) error {
+	if state.DryRun && dryRunPlanned(inst) {
+		return planInstruction(state, inst)
+	}
 	switch inst.Directive {
 	case "DEP":
 		args, err := splitArgs(inst.Args)
@@ -36,7 +39,11 @@ func executeInstruction(state *BuildState, inst Instruction) error {
 			return err
 		}
 		for _, arg := range args {
-			state.PendingDeps = append(state.PendingDeps, state.expand(arg))
+			expanded, err := state.expand(arg)
+			if err != nil {
+				return err
+			}
+			state.PendingDeps = append(state.PendingDeps, expanded)
 		}
 	case "OUT":
 		args, err := splitArgs(inst.Args)
@@ -44,37 +51,45 @@ func executeInstruction(state *BuildState, inst Instruction) error {
 			return err
 		}
 		for _, arg := range args {
-			state.PendingOuts = append(state.PendingOuts, state.expand(arg))
+			expanded, err := state.expand(arg)
+			if err != nil {
+				return err
+			}
+			state.PendingOuts = append(state.PendingOuts, expanded)
 		}
 	case "ARG":
-		key, value, err := parseAssignment(inst.Args, "ARG")
-		if err != nil {
+		if err := executeArg(state, inst); err != nil {
 			return err
 		}
-		state.Args[key] = state.expand(value)
 	case "ENV":
 		key, value, err := parseAssignment(inst.Args, "ENV")
 		if err != nil {
 			return err
 		}
-		state.Env[key] = state.expand(value)
+		expanded, err := state.expand(value)
+		if err != nil {
+			return err
+		}
+		state.Env[key] = expanded
 		state.log("ENV: %s set", key)
 	case "RUN":
-		if cached, err := checkCache(state, inst); err != nil {
+		if isCapture(inst) {
+			if err := executeCapture(state, inst); err != nil {
+				return err
+			}
+			break
+		}
+		if skipped, err := skipCachedStep(state, inst); err != nil {
 			return err
-		} else if cached {
-			state.log("CACHED: RUN %s", inst.Args)
-			state.PendingDeps = nil
-			state.PendingOuts = nil
-			state.CurrentCacheKey = ""
+		} else if skipped {
 			break
 		}
 
-		if err := executeShell(state, "RUN", inst.Args); err != nil {
+		if err := executeShell(state, "RUN", inst, nil); err != nil {
 			return err
 		}
 
-		if err := saveCache(state); err != nil {
+		if err := saveCache(state, inst); err != nil {
 			return err
 		}
 		state.PendingDeps = nil
@@ -104,13 +119,9 @@ func executeInstruction(state *BuildState, inst Instruction) error {
 		state.WorkDir = dir
 		state.log("WDR: %s", dir)
 	case "CPY":
-		if cached, err := checkCache(state, inst); err != nil {
+		if skipped, err := skipCachedStep(state, inst); err != nil {
 			return err
-		} else if cached {
-			state.log("CACHED: CPY %s", inst.Args)
-			state.PendingDeps = nil
-			state.PendingOuts = nil
-			state.CurrentCacheKey = ""
+		} else if skipped {
 			break
 		}
 
@@ -118,7 +129,7 @@ func executeInstruction(state *BuildState, inst Instruction) error {
 			return err
 		}
 
-		if err := saveCache(state); err != nil {
+		if err := saveCache(state, inst); err != nil {
 			return err
 		}
 		state.PendingDeps = nil
@@ -128,8 +139,16 @@ func executeInstruction(state *BuildState, inst Instruction) error {
 		if err := executeSubBuild(state, inst.Args); err != nil {
 			return err
 		}
+	case "CALL":
+		if err := executeCall(state, inst); err != nil {
+			return err
+		}
 	case "FRM":
-		box, err := parseImageReference(strings.TrimSpace(state.expand(inst.Args)))
+		image, err := state.expand(inst.Args)
+		if err != nil {
+			return err
+		}
+		box, err := parseImageReference(strings.TrimSpace(image))
 		if err != nil {
 			return err
 		}
@@ -140,14 +159,14 @@ func executeInstruction(state *BuildState, inst Instruction) error {
 		if err := executeBox(state, inst.Args); err != nil {
 			return err
 		}
+	case "SHELL":
+		if err := executeShellDirective(state, inst.Args); err != nil {
+			return err
+		}
 	case "USE":
-		if cached, err := checkCache(state, inst); err != nil {
+		if skipped, err := skipCachedStep(state, inst); err != nil {
 			return err
-		} else if cached {
-			state.log("CACHED: USE %s", inst.Args)
-			state.PendingDeps = nil
-			state.PendingOuts = nil
-			state.CurrentCacheKey = ""
+		} else if skipped {
 			break
 		}
 
@@ -155,7 +174,7 @@ func executeInstruction(state *BuildState, inst Instruction) error {
 			return err
 		}
 
-		if err := saveCache(state); err != nil {
+		if err := saveCache(state, inst); err != nil {
 			return err
 		}
 		state.PendingDeps = nil
@@ -169,6 +188,12 @@ func executeInstruction(state *BuildState, inst Instruction) error {
 		if err := executePlugin(state, inst.Args); err != nil {
 			return err
 		}
+	case "TGT":
+		name, _, err := parseTargetHeader(inst.Args)
+		if err != nil {
+			return err
+		}
+		state.log("TGT: %s", name)
 	default:
 		return fmt.Errorf("unknown directive: %s", inst.Directive)
 	}
@@ -176,20 +201,38 @@ func executeInstruction(state *BuildState, inst Instruction) error {
 }
 
 func executeCMD(state *BuildState, inst Instruction) error {
-	return executeShell(state, "CMD", inst.Args)
+	if state.DryRun {
+		command, _, err := state.shellScript(inst)
+		if err != nil {
+			return err
+		}
+		state.log("PLAN CMD in %s: %s", state.WorkDir, command)
+		return nil
+	}
+	return executeShell(state, "CMD", inst, nil)
 }
 
-func executeShell(state *BuildState, label string, script string) error {
-	expandedScript := strings.TrimSpace(state.expand(script))
+// executeShell runs the script of a RUN or CMD instruction through the shell.
+// Its output is logged line by line, unless output is non-nil, in which case
+// standard output is written there instead.
+func executeShell(state *BuildState, label string, inst Instruction, output io.Writer) error {
+	expandedScript, stdin, err := state.shellScript(inst)
+	if err != nil {
+		return err
+	}
 	if err := validateLinuxCommand(expandedScript); err != nil {
 		return fmt.Errorf("invalid %s command: %w", label, err)
 	}
-	cmd := shellCommand(state.Context, expandedScript)
+	cmd := shellCommand(state.Context, state.Shell, expandedScript)
+	cmd.Stdin = stdin
 	cmd.Dir = state.WorkDir
 	cmd.Env = state.commandEnv()
 	lw := &lineWriter{label: label, state: state}
 	defer lw.Close()
 	cmd.Stdout = lw
+	if output != nil {
+		cmd.Stdout = output
+	}
 	cmd.Stderr = lw
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("shell command failed: %w", err)
@@ -205,8 +248,14 @@ func executeCopy(state *BuildState, args string) error {
 	if len(parts) != 2 {
 		return fmt.Errorf("CPY requires exactly two arguments: source and destination")
 	}
-	src := state.resolvePath(state.expand(parts[0]))
-	dst := state.resolvePath(state.expand(parts[1]))
+	src, err := state.expandPath(parts[0])
+	if err != nil {
+		return err
+	}
+	dst, err := state.expandPath(parts[1])
+	if err != nil {
+		return err
+	}
 	srcInfo, err := os.Stat(src)
 	if err != nil {
 		return fmt.Errorf("source does not exist: %s", src)
@@ -251,8 +300,35 @@ func parseGithubImport(rawArg string) (string, error) {
 	return fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s/%s", owner, repo, ref, path), nil
 }
 
+// fetchRemoteJettyfile downloads a Jettyfile from a URL returned by
+// parseGithubImport, capped at maxRemoteJettyfileSize.
+func fetchRemoteJettyfile(ctx context.Context, githubURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, githubURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request for remote Jettyfile: %w", err)
+	}
+	client := &http.Client{Timeout: remoteFetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch remote Jettyfile: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch remote Jettyfile: HTTP %s (url: %s)", resp.Status, githubURL)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteJettyfileSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read remote Jettyfile: %w", err)
+	}
+	return content, nil
+}
+
 func executeSubBuild(state *BuildState, args string) error {
-	rawArg := strings.TrimSpace(state.expand(args))
+	rawArg, err := state.expand(args)
+	if err != nil {
+		return err
+	}
+	rawArg = strings.TrimSpace(rawArg)
 	var referencedFile string
 
 	githubURL, err := parseGithubImport(rawArg)
@@ -262,25 +338,16 @@ func executeSubBuild(state *BuildState, args string) error {
 
 	if githubURL != "" {
 		state.log("SUB: Fetching %s", rawArg)
-		req, err := http.NewRequestWithContext(state.Context, http.MethodGet, githubURL, nil)
-		if err != nil {
-			return fmt.Errorf("failed to build request for remote Jettyfile: %w", err)
-		}
-		client := &http.Client{Timeout: remoteFetchTimeout}
-		resp, err := client.Do(req)
+		content, err := fetchRemoteJettyfile(state.Context, githubURL)
 		if err != nil {
-			return fmt.Errorf("failed to fetch remote Jettyfile: %w", err)
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("failed to fetch remote Jettyfile: HTTP %s (url: %s)", resp.Status, githubURL)
+			return err
 		}
 		tmpFile, err := os.CreateTemp("", "jettyfile-*")
 		if err != nil {
 			return fmt.Errorf("failed to create temp file for remote Jettyfile: %w", err)
 		}
 		defer os.Remove(tmpFile.Name())
-		if _, err := io.Copy(tmpFile, io.LimitReader(resp.Body, maxRemoteJettyfileSize)); err != nil {
+		if _, err := tmpFile.Write(content); err != nil {
 			tmpFile.Close()
 			return fmt.Errorf("failed to write remote Jettyfile: %w", err)
 		}
@@ -325,6 +392,11 @@ func executeSubBuild(state *BuildState, args string) error {
 		InitialArgs:   state.Args,
 		InitialEnv:    state.Env,
 		Depth:         state.Depth + 1,
+		KeepGoing:     state.KeepGoing,
+		DryRun:        state.DryRun,
+		Strict:        state.Strict,
+		ExplainCache:  state.ExplainCache,
+		Shell:         state.Shell,
 		// A remote Jettyfile lives in a shared temp dir; do not auto-load a
 		// .env from there (an attacker on a multi-user host could plant one).
 		SkipDefaultEnv: githubURL != "",
@@ -351,14 +423,18 @@ func executeBox(state *BuildState, args string) error {
 	if len(parts) != 2 && len(parts) != 3 {
 		return fmt.Errorf("BOX requires name and image, or name, repository, and tag")
 	}
-	name := state.expand(parts[0])
+	parts, err = state.expandAll(parts)
+	if err != nil {
+		return err
+	}
+	name := parts[0]
 	var box BoxInfo
 	if len(parts) == 2 {
-		box, err = parseImageReference(state.expand(parts[1]))
+		box, err = parseImageReference(parts[1])
 	} else {
 		box = BoxInfo{
-			Repository: state.expand(parts[1]),
-			Tag:        state.expand(parts[2]),
+			Repository: parts[1],
+			Tag:        parts[2],
 		}
 	}
 	if err != nil {
@@ -373,18 +449,31 @@ func executeBox(state *BuildState, args string) error {
 }
 
 func executeUse(state *BuildState, args string) error {
-	parts, err := splitArgs(args)
+	box, command, err := resolveUse(state, args)
 	if err != nil {
 		return err
 	}
+	return execInContainer(state.Context, command, state.Env, box, state.WorkDir, state)
+}
+
+// resolveUse picks the box a USE instruction runs in and returns it with the
+// expanded command.
+func resolveUse(state *BuildState, args string) (BoxInfo, string, error) {
+	parts, err := splitArgs(args)
+	if err != nil {
+		return BoxInfo{}, "", err
+	}
 	if len(parts) == 0 {
-		return fmt.Errorf("USE requires a box name and command, or a default FRM box and command")
+		return BoxInfo{}, "", fmt.Errorf("USE requires a box name and command, or a default FRM box and command")
 	}
 
 	boxName := state.DefaultBox
 	trimmedArgs := strings.TrimSpace(args)
 	command := trimmedArgs
-	candidateBoxName := state.expand(parts[0])
+	candidateBoxName, err := state.expand(parts[0])
+	if err != nil {
+		return BoxInfo{}, "", err
+	}
 	// Only treat the first token as a box name when the raw args literally begin
 	// with it; otherwise (e.g. a quoted token) TrimPrefix would fail to strip it
 	// and leak the box name into the command run in the container.
@@ -393,15 +482,18 @@ func executeUse(state *BuildState, args string) error {
 		command = strings.TrimSpace(strings.TrimPrefix(trimmedArgs, parts[0]))
 	}
 	if boxName == "" {
-		return fmt.Errorf("USE requires a known box name when no FRM default is configured")
+		return BoxInfo{}, "", fmt.Errorf("USE requires a known box name when no FRM default is configured")
 	}
 	if strings.TrimSpace(command) == "" {
-		return fmt.Errorf("USE requires a command")
+		return BoxInfo{}, "", fmt.Errorf("USE requires a command")
 	}
-	box := state.Boxes[boxName]
 	// Expand Jetty ARG/ENV references so USE behaves consistently with RUN,
 	// which pre-expands its script via state.expand before executing.
-	return execInContainer(state.Context, state.expand(command), state.Env, box, state.WorkDir, state)
+	command, err = state.expand(command)
+	if err != nil {
+		return BoxInfo{}, "", err
+	}
+	return state.Boxes[boxName], command, nil
 }
 
 func executeFormat(state *BuildState, inst Instruction) error {
@@ -409,43 +501,71 @@ func executeFormat(state *BuildState, inst Instruction) error {
 	if err != nil {
 		return err
 	}
-	if len(parts) == 0 {
+	words := len(parts)
+	if inst.Heredoc != nil {
+		// The heredoc stands in for the format string.
+		words++
+	}
+	if words == 0 {
 		return fmt.Errorf("FMT requires a format string")
 	}
 
 	switch inst.Symbol {
 	case "":
-		formatted := sprintfExpanded(state, parts[0], parts[1:])
+		formatted, err := formatText(state, inst, parts)
+		if err != nil {
+			return err
+		}
 		state.log("FMT: %s", formatted)
 	case "^":
-		if len(parts) < 2 {
+		if words < 2 {
 			return fmt.Errorf("^FMT requires a file and format string")
 		}
-		file := state.resolvePath(state.expand(parts[0]))
-		formatted := sprintfExpanded(state, parts[1], parts[2:])
+		file, err := state.expandPath(parts[0])
+		if err != nil {
+			return err
+		}
+		formatted, err := formatText(state, inst, parts[1:])
+		if err != nil {
+			return err
+		}
 		if err := appendToFile(file, formatted); err != nil {
 			return fmt.Errorf("failed to append to file: %w", err)
 		}
 		state.log("^FMT: %s", file)
 	case "$":
-		if len(parts) < 2 {
+		if words < 2 {
 			return fmt.Errorf("$FMT requires an environment variable and format string")
 		}
-		name := state.expand(parts[0])
+		name, err := state.expand(parts[0])
+		if err != nil {
+			return err
+		}
 		if !isValidName(name) {
 			return fmt.Errorf("invalid environment variable name: %s", name)
 		}
-		state.Env[name] = sprintfExpanded(state, parts[1], parts[2:])
+		formatted, err := formatText(state, inst, parts[1:])
+		if err != nil {
+			return err
+		}
+		state.Env[name] = formatted
 		state.log("$FMT: %s set", name)
 	case "&":
-		if len(parts) < 2 {
+		if words < 2 {
 			return fmt.Errorf("&FMT requires an argument name and format string")
 		}
-		name := state.expand(parts[0])
+		name, err := state.expand(parts[0])
+		if err != nil {
+			return err
+		}
 		if !isValidName(name) {
 			return fmt.Errorf("invalid argument name: %s", name)
 		}
-		state.Args[name] = sprintfExpanded(state, parts[1], parts[2:])
+		formatted, err := formatText(state, inst, parts[1:])
+		if err != nil {
+			return err
+		}
+		state.Args[name] = formatted
 		state.log("&FMT: %s set", name)
 	default:
 		return fmt.Errorf("unsupported FMT modifier: %s", inst.Symbol)
@@ -461,7 +581,30 @@ func executePlugin(state *BuildState, args string) error {
 	if len(parts) == 0 {
 		return fmt.Errorf("JET requires a plugin name")
 	}
-	pluginName := state.expand(parts[0])
+	parts, err = state.expandAll(parts)
+	if err != nil {
+		return err
+	}
+	pluginName := parts[0]
+	pluginPath := resolvePluginPath(state, pluginName)
+	pluginArgs := parts[1:]
+	cmd := exec.CommandContext(state.Context, pluginPath, pluginArgs...)
+	cmd.Dir = state.WorkDir
+	cmd.Env = state.commandEnv()
+	lw := &lineWriter{label: "JET " + pluginName, state: state}
+	defer lw.Close()
+	cmd.Stdout = lw
+	cmd.Stderr = lw
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("plugin %s failed: %w", pluginName, err)
+	}
+	return nil
+}
+
+// resolvePluginPath maps a JET plugin name to its executable: bare names are
+// looked up in plugins/, and on Windows a missing path is retried with the
+// usual executable extensions.
+func resolvePluginPath(state *BuildState, pluginName string) string {
 	pluginPath := pluginName
 	if !filepath.IsAbs(pluginPath) && filepath.Base(pluginPath) == pluginPath {
 		pluginPath = filepath.Join("plugins", pluginPath)
@@ -479,20 +622,14 @@ func executePlugin(state *BuildState, args string) error {
 			}
 		}
 	}
+	return pluginPath
+}
 
-	pluginArgs := make([]string, len(parts)-1)
-	for i, arg := range parts[1:] {
-		pluginArgs[i] = state.expand(arg)
-	}
-	cmd := exec.CommandContext(state.Context, pluginPath, pluginArgs...)
-	cmd.Dir = state.WorkDir
-	cmd.Env = state.commandEnv()
-	lw := &lineWriter{label: "JET " + pluginName, state: state}
-	defer lw.Close()
-	cmd.Stdout = lw
-	cmd.Stderr = lw
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("plugin %s failed: %w", pluginName, err)
+// requireArg implements a bare `ARG KEY`, which fails the build unless KEY
+// was provided or set earlier.
+func requireArg(state *BuildState, key string) error {
+	if _, ok := state.Args[key]; !ok {
+		return fmt.Errorf("required ARG %s is not set; pass --build-arg %s=value", key, key)
 	}
 	return nil
 }
@@ -532,7 +669,7 @@ func (state *BuildState) singlePath(args string, directive string) (string, erro
 	if len(parts) != 1 {
 		return "", fmt.Errorf("%s requires exactly one path argument", directive)
 	}
-	return state.resolvePath(state.expand(parts[0])), nil
+	return state.expandPath(parts[0])
 }
 
 func isSubpath(parent string, child string) bool {
@@ -582,24 +719,15 @@ func (state *BuildState) log(format string, v ...any) {
 	sendResult(state.Context, state.ResultChan, fmt.Sprintf(format, v...))
 }
 
-func (state *BuildState) expand(value string) string {
-	return os.Expand(value, func(key string) string {
-		if arg, ok := state.Args[key]; ok {
-			return arg
-		}
-		if env, ok := state.Env[key]; ok {
-			return env
-		}
-		return "$" + key
-	})
-}
-
-func sprintfExpanded(state *BuildState, format string, values []string) string {
+func sprintfExpanded(state *BuildState, format string, values []string) (string, error) {
 	expanded := make([]any, len(values))
 	for i, value := range values {
-		expanded[i] = state.expand(value)
+		var err error
+		if expanded[i], err = state.expand(value); err != nil {
+			return "", err
+		}
 	}
-	return fmt.Sprintf(format, expanded...)
+	return fmt.Sprintf(format, expanded...), nil
 }
 
 func parseImageReference(image string) (BoxInfo, error) {
@@ -656,7 +784,7 @@ func execInContainer(ctx context.Context, command string, env map[string]string,
 	}
 	execDone := make(chan execResult, 1)
 	go func() {
-		code, e := resource.Exec([]string{"/bin/sh", "-c", command}, dockertest.ExecOptions{
+		code, e := resource.Exec(shellArgs(state.Shell, []string{"/bin/sh", "-c"}, command), dockertest.ExecOptions{
 			Env:    formatEnv(env),
 			StdOut: lw,
 			StdErr: lw,
@@ -500,6 +500,7 @@ func TestDirectivesHelpers(t *testing.T) {
 
 func TestExecuteSubBuild(t *testing.T) {
 	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
 	subFile := filepath.Join(dir, "SubJettyfile")
 	err := os.WriteFile(subFile, []byte("ARG TEST_SUB=1\n"), 0644)
 	if err != nil {
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dryRunPlanned reports whether a directive has side effects and so is only
+// planned, not executed, in a dry run. Instructions that only update the
+// build state (ARG, ENV, $FMT, &FMT, FRM, BOX, DEP, OUT) still run, and SUB
+// runs its sub-build in dry-run mode too.
+func dryRunPlanned(inst Instruction) bool {
+	switch inst.Directive {
+	case "RUN", "CPY", "USE", "JET", "DIR", "WDR":
+		return true
+	case "FMT":
+		return inst.Symbol == "^"
+	}
+	return false
+}
+
+// planInstruction logs what a side-effecting instruction would do, with its
+// arguments expanded against the current build state. Cacheable steps are
+// checked against the cache and reported as CACHED when they would be skipped,
+// or as RESTORED when their outputs would be restored from the blob store.
+// With ExplainCache, the steps that would run are reported with the reason
+// they miss the cache.
+func planInstruction(state *BuildState, inst Instruction) error {
+	if isCapture(inst) {
+		return planCapture(state, inst)
+	}
+	switch inst.Directive {
+	case "RUN", "CPY", "USE":
+		label := "CACHED"
+		cached, err := checkCache(state, inst)
+		if err == nil && !cached {
+			label = "RESTORED"
+			cached, err = restoreCache(state)
+		}
+		if err == nil && !cached && state.ExplainCache {
+			err = explainCacheMiss(state, inst)
+		}
+		state.PendingDeps = nil
+		state.PendingOuts = nil
+		state.CurrentCacheKey = ""
+		if err != nil {
+			return err
+		}
+		if cached {
+			state.log("%s: %s %s", label, inst.Directive, inst.Args)
+			state.CacheHit = true
+			return nil
+		}
+	}
+
+	switch inst.Directive {
+	case "RUN":
+		script, _, err := state.shellScript(inst)
+		if err != nil {
+			return err
+		}
+		if err := validateLinuxCommand(script); err != nil {
+			return fmt.Errorf("invalid RUN command: %w", err)
+		}
+		state.log("PLAN RUN in %s: %s", state.WorkDir, script)
+	case "CPY":
+		parts, err := splitArgs(inst.Args)
+		if err != nil {
+			return err
+		}
+		if len(parts) != 2 {
+			return fmt.Errorf("CPY requires exactly two arguments: source and destination")
+		}
+		src, err := state.expandPath(parts[0])
+		if err != nil {
+			return err
+		}
+		dst, err := state.expandPath(parts[1])
+		if err != nil {
+			return err
+		}
+		state.log("PLAN CPY in %s: %s -> %s", state.WorkDir, src, dst)
+	case "USE":
+		box, command, err := resolveUse(state, inst.Args)
+		if err != nil {
+			return err
+		}
+		state.log("PLAN USE %s:%s in %s: %s", box.Repository, box.Tag, state.WorkDir, command)
+	case "JET":
+		parts, err := splitArgs(inst.Args)
+		if err != nil {
+			return err
+		}
+		if len(parts) == 0 {
+			return fmt.Errorf("JET requires a plugin name")
+		}
+		command, err := state.expandAll(parts)
+		if err != nil {
+			return err
+		}
+		command[0] = resolvePluginPath(state, command[0])
+		state.log("PLAN JET in %s: %s", state.WorkDir, strings.Join(command, " "))
+	case "DIR":
+		dir, err := state.singlePath(inst.Args, "DIR")
+		if err != nil {
+			return err
+		}
+		state.log("PLAN DIR: %s", dir)
+	case "WDR":
+		// The directory may be created by a DIR that was only planned, so it
+		// is not required to exist yet.
+		dir, err := state.singlePath(inst.Args, "WDR")
+		if err != nil {
+			return err
+		}
+		state.WorkDir = dir
+		state.log("WDR: %s", dir)
+	case "FMT":
+		parts, err := splitArgs(inst.Args)
+		if err != nil {
+			return err
+		}
+		words := len(parts)
+		if inst.Heredoc != nil {
+			words++
+		}
+		if words < 2 {
+			return fmt.Errorf("^FMT requires a file and format string")
+		}
+		file, err := state.expandPath(parts[0])
+		if err != nil {
+			return err
+		}
+		formatted, err := formatText(state, inst, parts[1:])
+		if err != nil {
+			return err
+		}
+		state.log("PLAN ^FMT %s: %s", file, formatted)
+	}
+	return nil
+}
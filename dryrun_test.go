@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runDryRunForTest(t *testing.T, fileName string) ([]string, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resultChan := make(chan string)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- processBuild(Job{
+			BuildID:    "dry-run",
+			FileName:   fileName,
+			ResultChan: resultChan,
+			Context:    ctx,
+			DryRun:     true,
+		})
+	}()
+	var output []string
+	for result := range resultChan {
+		output = append(output, result)
+	}
+	return output, <-errChan
+}
+
+func TestDryRunPlansWithoutSideEffects(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "Jettyfile"), []byte("RUN touch sub-ran.txt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "input.txt"), []byte("input"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"ARG NAME=jetty",
+		"&FMT GREETING \"hello-%s\" $NAME",
+		"DIR out",
+		"WDR out",
+		"RUN echo $GREETING > greeting.txt",
+		"^FMT notes.txt \"%s\" $NAME",
+		"CPY ../input.txt copy.txt",
+		"SUB ../sub/Jettyfile",
+		"CMD touch cmd.txt",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := runDryRunForTest(t, buildFile)
+	if err != nil {
+		t.Fatalf("dry run returned error: %v\noutput:\n%s", err, strings.Join(output, "\n"))
+	}
+	outDir := filepath.Join(dir, "out")
+	for _, want := range []string{
+		"PLAN DIR: " + outDir,
+		"WDR: " + outDir,
+		"PLAN RUN in " + outDir + ": echo hello-jetty > greeting.txt",
+		"PLAN ^FMT " + filepath.Join(outDir, "notes.txt") + ": jetty",
+		"PLAN CPY in " + outDir + ": " + filepath.Join(dir, "input.txt") + " -> " + filepath.Join(outDir, "copy.txt"),
+		"PLAN RUN in " + filepath.Join(dir, "sub") + ": touch sub-ran.txt",
+		"PLAN CMD in " + outDir + ": touch cmd.txt",
+	} {
+		if !joinedOutputContains(output, want) {
+			t.Errorf("expected dry run output to contain %q, got:\n%s", want, strings.Join(output, "\n"))
+		}
+	}
+	for _, path := range []string{outDir, filepath.Join(dir, "sub", "sub-ran.txt")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected dry run not to create %s, stat err = %v", path, err)
+		}
+	}
+	builds, err := readBuildInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 0 {
+		t.Fatalf("expected dry runs not to be recorded, got %#v", builds)
+	}
+}
+
+func TestDryRunReportsCachedSteps(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	if err := os.WriteFile(filepath.Join(dir, "input.txt"), []byte("input"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"DEP input.txt",
+		"OUT output.txt",
+		"CPY input.txt output.txt",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if output, _, err := runBuildForTest(t, buildFile); err != nil {
+		t.Fatalf("build returned error: %v\noutput:\n%s", err, strings.Join(output, "\n"))
+	}
+
+	output, err := runDryRunForTest(t, buildFile)
+	if err != nil {
+		t.Fatalf("dry run returned error: %v", err)
+	}
+	if !joinedOutputContains(output, "CACHED: CPY input.txt output.txt") || joinedOutputContains(output, "PLAN CPY") {
+		t.Fatalf("expected the cached step to be reported as CACHED, got %q", output)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "input.txt"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err = runDryRunForTest(t, buildFile)
+	if err != nil {
+		t.Fatalf("dry run returned error: %v", err)
+	}
+	if !joinedOutputContains(output, "PLAN CPY") {
+		t.Fatalf("expected a changed input to plan the step, got %q", output)
+	}
+	assertFileContent(t, filepath.Join(dir, "output.txt"), "input")
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// expand substitutes $NAME and ${NAME} references from the build's Args and
+// Env, in that order. Braced references support shell-style operators:
+//
+//	${NAME:-default}  default when NAME is unset or empty
+//	${NAME:?message}  fail with message when NAME is unset or empty
+//	${NAME:+alt}      alt when NAME is set and non-empty, else empty
+//	${NAME:off[:len]} substring (a negative offset needs a space: ${NAME: -3})
+//	${NAME/old/new}   replace the first occurrence of old (// replaces all)
+//	${NAME^^} ${NAME,,} ${NAME^} ${NAME,}  upper/lower case all or the first rune
+//	${#NAME}          length in runes
+//
+// `$$` is a literal `$`, so `$$f` reaches the shell as `$f` and `$$$$` as
+// its process ID. An undefined variable is left as written, operators
+// included, so the shell can still expand it, unless the build is strict:
+// then it is an error, except for variables set in Jetty's own process
+// environment.
+func (state *BuildState) expand(value string) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(value); {
+		if value[i] != '$' || i+1 == len(value) {
+			out.WriteByte(value[i])
+			i++
+			continue
+		}
+		next := value[i+1]
+		switch {
+		case next == '$':
+			out.WriteByte('$')
+			i += 2
+		case next == '{':
+			end := closingBrace(value, i+2)
+			if end < 0 {
+				out.WriteString(value[i:])
+				return out.String(), nil
+			}
+			expanded, err := state.expandBraced(value[i+2:end], value[i:end+1])
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(expanded)
+			i = end + 1
+		case isNameStart(next):
+			end := i + 1
+			for end < len(value) && isNameByte(value[end]) {
+				end++
+			}
+			name := value[i+1 : end]
+			resolved, err := state.lookupVariable(name, value[i:end])
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(resolved)
+			i = end
+		default:
+			// Positional and special parameters ($1, $@, $?) belong to the shell.
+			out.WriteByte('$')
+			i++
+		}
+	}
+	return out.String(), nil
+}
+
+// expandPath expands a path argument and resolves it against the working
+// directory.
+func (state *BuildState) expandPath(value string) (string, error) {
+	expanded, err := state.expand(value)
+	if err != nil {
+		return "", err
+	}
+	return state.resolvePath(expanded), nil
+}
+
+// expandAll expands each value in turn.
+func (state *BuildState) expandAll(values []string) ([]string, error) {
+	expanded := make([]string, len(values))
+	for i, value := range values {
+		var err error
+		if expanded[i], err = state.expand(value); err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
+
+func (state *BuildState) variable(name string) (string, bool) {
+	if arg, ok := state.Args[name]; ok {
+		return arg, true
+	}
+	if env, ok := state.Env[name]; ok {
+		return env, true
+	}
+	return "", false
+}
+
+// lookupVariable resolves a plain reference, returning raw (the reference as
+// written) when the variable is undefined.
+func (state *BuildState) lookupVariable(name string, raw string) (string, error) {
+	if value, ok := state.variable(name); ok {
+		return value, nil
+	}
+	return state.undefined(name, raw)
+}
+
+func (state *BuildState) undefined(name string, raw string) (string, error) {
+	if state.Strict {
+		if _, ok := os.LookupEnv(name); !ok {
+			return "", fmt.Errorf("undefined variable %s", name)
+		}
+	}
+	return raw, nil
+}
+
+func (state *BuildState) expandBraced(expr string, raw string) (string, error) {
+	if rest, ok := strings.CutPrefix(expr, "#"); ok && isValidName(rest) {
+		value, defined := state.variable(rest)
+		if !defined {
+			return state.undefined(rest, raw)
+		}
+		return strconv.Itoa(utf8.RuneCountInString(value)), nil
+	}
+	nameEnd := 0
+	if nameEnd < len(expr) && isNameStart(expr[0]) {
+		for nameEnd < len(expr) && isNameByte(expr[nameEnd]) {
+			nameEnd++
+		}
+	}
+	name, op := expr[:nameEnd], expr[nameEnd:]
+	if name == "" {
+		// ${1}, ${@} and friends are left for the shell.
+		return raw, nil
+	}
+	value, defined := state.variable(name)
+	switch {
+	case op == "":
+		if !defined {
+			return state.undefined(name, raw)
+		}
+		return value, nil
+	case strings.HasPrefix(op, ":-"):
+		if !defined || value == "" {
+			return state.expand(op[2:])
+		}
+		return value, nil
+	case strings.HasPrefix(op, ":?"):
+		if !defined || value == "" {
+			message, err := state.expand(op[2:])
+			if err != nil {
+				return "", err
+			}
+			if message == "" {
+				message = "parameter is not set"
+			}
+			return "", fmt.Errorf("%s: %s", name, message)
+		}
+		return value, nil
+	case strings.HasPrefix(op, ":+"):
+		if defined && value != "" {
+			return state.expand(op[2:])
+		}
+		return "", nil
+	}
+	// Other operators only apply to Jetty's variables; a shell-local one
+	// such as ${f%.txt} in a RUN script is the shell's to expand.
+	if !defined {
+		return state.undefined(name, raw)
+	}
+
+	var result string
+	var err error
+	switch {
+	case strings.HasPrefix(op, ":"):
+		result, err = substring(value, op[1:])
+	case strings.HasPrefix(op, "/"):
+		result, err = state.replace(value, op[1:])
+	case op == "^^":
+		result = strings.ToUpper(value)
+	case op == ",,":
+		result = strings.ToLower(value)
+	case op == "^":
+		result = changeFirstRune(value, strings.ToUpper)
+	case op == ",":
+		result = changeFirstRune(value, strings.ToLower)
+	default:
+		return "", fmt.Errorf("bad substitution: %s", raw)
+	}
+	if err != nil {
+		return "", fmt.Errorf("bad substitution %s: %w", raw, err)
+	}
+	return result, nil
+}
+
+// substring implements ${NAME:offset[:length]} with bash semantics: a
+// negative offset counts from the end, and a negative length stops that many
+// runes before the end.
+func substring(value string, spec string) (string, error) {
+	offsetSpec, lengthSpec, hasLength := strings.Cut(spec, ":")
+	runes := []rune(value)
+	offset, err := strconv.Atoi(strings.TrimSpace(offsetSpec))
+	if err != nil {
+		return "", fmt.Errorf("invalid offset %q", offsetSpec)
+	}
+	if offset < 0 {
+		offset += len(runes)
+	}
+	offset = max(0, min(offset, len(runes)))
+	end := len(runes)
+	if hasLength {
+		length, err := strconv.Atoi(strings.TrimSpace(lengthSpec))
+		if err != nil {
+			return "", fmt.Errorf("invalid length %q", lengthSpec)
+		}
+		if length < 0 {
+			end = len(runes) + length
+		} else {
+			end = offset + length
+		}
+		end = max(offset, min(end, len(runes)))
+	}
+	return string(runes[offset:end]), nil
+}
+
+// replace implements ${NAME/old/new} and ${NAME//old/new}. Both old and new
+// are expanded and old is matched literally.
+func (state *BuildState) replace(value string, spec string) (string, error) {
+	count := 1
+	if rest, ok := strings.CutPrefix(spec, "/"); ok {
+		count = -1
+		spec = rest
+	}
+	pattern, replacement, _ := strings.Cut(spec, "/")
+	pattern, err := state.expand(pattern)
+	if err != nil {
+		return "", err
+	}
+	if pattern == "" {
+		return "", fmt.Errorf("empty pattern")
+	}
+	replacement, err = state.expand(replacement)
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(value, pattern, replacement, count), nil
+}
+
+func changeFirstRune(value string, change func(string) string) string {
+	_, size := utf8.DecodeRuneInString(value)
+	return change(value[:size]) + value[size:]
+}
+
+// closingBrace returns the index of the `}` that closes a `${` whose body
+// starts at start, allowing nested references in defaults.
+func closingBrace(value string, start int) int {
+	depth := 1
+	for i := start; i < len(value); i++ {
+		switch value[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+func isNameByte(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpand(t *testing.T) {
+	state := &BuildState{
+		Args: map[string]string{"NAME": "Jetty Build", "EMPTY": "", "PATHS": "a/b/a/b", "VERSION": "v1.2.3"},
+		Env:  map[string]string{"NAME": "env-loses", "MODE": "release"},
+	}
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"$NAME and ${MODE}", "Jetty Build and release"},
+		{"$MISSING ${MISSING} $1 $@ ${1}", "$MISSING ${MISSING} $1 $@ ${1}"},
+		{"cost: $$5 $$NAME pid $$$$", "cost: $5 $NAME pid $$"},
+		{"for f in *.txt; do mv $f ${f%.txt}.md; done", "for f in *.txt; do mv $f ${f%.txt}.md; done"},
+		{"${MISSING:-fallback} ${EMPTY:-empty} ${NAME:-unused}", "fallback empty Jetty Build"},
+		{"${MISSING:-${MODE}}", "release"},
+		{"[${NAME:+set}] [${EMPTY:+set}] [${MISSING:+set}]", "[set] [] []"},
+		{"${VERSION:1} ${VERSION:1:3} ${VERSION: -1} ${VERSION:0:-2}", "1.2.3 1.2 3 v1.2"},
+		{"${PATHS/a/x} ${PATHS//a/x} ${VERSION//./-}", "x/b/a/b x/b/x/b v1-2-3"},
+		{"${NAME^^} ${NAME,,} ${MODE^} ${NAME,}", "JETTY BUILD jetty build Release jetty Build"},
+		{"${#NAME} ${#EMPTY}", "11 0"},
+		{"trailing $ and ${unterminated", "trailing $ and ${unterminated"},
+	}
+	for _, tc := range tests {
+		got, err := state.expand(tc.input)
+		if err != nil {
+			t.Errorf("expand(%q) returned error: %v", tc.input, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("expand(%q) = %q, want %q", tc.input, got, tc.want)
+		}
+	}
+
+	failures := []struct {
+		input string
+		want  string
+	}{
+		{"${MISSING:?set MISSING first}", "MISSING: set MISSING first"},
+		{"${EMPTY:?}", "EMPTY: parameter is not set"},
+		{"${NAME:x}", "bad substitution ${NAME:x}"},
+		{"${NAME%%suffix}", "bad substitution: ${NAME%%suffix}"},
+		{"${NAME//}", "empty pattern"},
+	}
+	for _, tc := range failures {
+		_, err := state.expand(tc.input)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("expand(%q) error = %v, want %q", tc.input, err, tc.want)
+		}
+	}
+}
+
+func TestExpandStrict(t *testing.T) {
+	t.Setenv("JETTY_TEST_HOST_VAR", "host")
+	state := &BuildState{Args: map[string]string{"NAME": "jetty"}, Env: map[string]string{}, Strict: true}
+	got, err := state.expand("$NAME ${MISSING:-default} $JETTY_TEST_HOST_VAR $1 $$HOME")
+	if err != nil {
+		t.Fatalf("expand returned error: %v", err)
+	}
+	if got != "jetty default $JETTY_TEST_HOST_VAR $1 $HOME" {
+		t.Fatalf("unexpected strict expansion: %q", got)
+	}
+	for _, input := range []string{"$JETTY_TEST_UNDEFINED", "${JETTY_TEST_UNDEFINED^^}", "${#JETTY_TEST_UNDEFINED}", "${JETTY_TEST_UNDEFINED%.txt}"} {
+		_, err := state.expand(input)
+		if err == nil || !strings.Contains(err.Error(), "undefined variable JETTY_TEST_UNDEFINED") {
+			t.Errorf("expand(%q) error = %v, want undefined variable", input, err)
+		}
+	}
+}
+
+func TestBuildStrictReportsUndefinedVariableLine(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"ARG NAME=jetty",
+		"DIR $NAME",
+		"DIR ${JETTY_TEST_TYPO}",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := processBuild(Job{FileName: buildFile, Context: ctx, Strict: true})
+	if err == nil || !strings.Contains(err.Error(), "line 3") || !strings.Contains(err.Error(), "undefined variable JETTY_TEST_TYPO") {
+		t.Fatalf("expected strict mode to fail on line 3, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "jetty")); err != nil {
+		t.Fatalf("expected instructions before the error to run: %v", err)
+	}
+}
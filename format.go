@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// formatIndent indents the body of an IF, FOR or DEF block per level.
+	formatIndent = "  "
+	// continuationIndent indents the continuation lines of an instruction.
+	continuationIndent = "    "
+)
+
+// blockOpeners start a block closed by END.
+var blockOpeners = map[string]bool{
+	"IF":  true,
+	"FOR": true,
+	"DEF": true,
+}
+
+// formatSource renders a parsed Jettyfile in canonical form: upper-case
+// directives with the modifier directly in front, single spaces between
+// words, block bodies indented by formatIndent, continuation lines indented
+// by continuationIndent, comments indented with the instruction they
+// precede, runs of blank lines collapsed to one and a blank line before
+// every TGT. Line breaks within an instruction and heredoc bodies are kept.
+func formatSource(file *SourceFile) ([]byte, error) {
+	if _, err := nestBlocks(file.Instructions()); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	lastLine := 0
+	gap := func(line int, blank bool) {
+		if lastLine > 0 && (blank || line > lastLine+1) {
+			out.WriteByte('\n')
+		}
+	}
+	writeComments := func(comments []Comment, indent string, blank bool) {
+		for i, comment := range comments {
+			gap(comment.Pos.Line, blank && i == 0)
+			out.WriteString(indent + comment.Text + "\n")
+			lastLine = comment.Pos.Line
+		}
+	}
+	depth := 0
+	for _, node := range file.Nodes {
+		level := depth
+		switch node.Directive {
+		case "END":
+			depth--
+			level = depth
+		case "ELSE":
+			level = depth - 1
+		}
+		indent := strings.Repeat(formatIndent, level)
+		blank := node.Directive == "TGT"
+		writeComments(node.Comments, indent, blank)
+		gap(node.Start.Line, blank && len(node.Comments) == 0)
+		out.WriteString(formatNode(node, indent) + "\n")
+		lastLine = node.Start.Line + len(node.Lines) - 1
+		if node.Heredoc != nil {
+			for _, line := range node.Heredoc.Lines {
+				out.WriteString(line + "\n")
+			}
+			lastLine += len(node.Heredoc.Lines)
+		}
+		if blockOpeners[node.Directive] {
+			depth++
+		}
+	}
+	writeComments(file.Trailing, "", false)
+	return out.Bytes(), nil
+}
+
+// formatNode renders one instruction at the given indentation. Words keep
+// the physical line they were written on. An instruction with a quoted word
+// spanning lines is left as written. A heredoc body is not part of the
+// result; formatSource copies it as written.
+func formatNode(node *Node, indent string) string {
+	words := append(append([]Token(nil), node.Options...), node.Args...)
+	if node.Heredoc != nil {
+		words = append(words, node.Heredoc.Marker)
+	}
+	for _, word := range words {
+		if strings.Contains(word.Raw, "\n") {
+			return strings.Join(node.Lines, "\n")
+		}
+	}
+	lines := []string{indent + node.Symbol + node.Directive}
+	line := node.Keyword.Start.Line
+	for _, word := range words {
+		if word.Start.Line != line {
+			lines = append(lines, indent+continuationIndent+word.Raw)
+			line = word.Start.Line
+			continue
+		}
+		lines[len(lines)-1] += " " + word.Raw
+	}
+	return strings.Join(lines, " \\\n")
+}
+
+// formatFiles formats each file. By default the result is printed; with
+// write, files that change are rewritten in place; with check, the names of
+// files that are not formatted are printed and an error is returned if there
+// are any.
+func formatFiles(fileNames []string, write bool, check bool) error {
+	unformatted := 0
+	for _, fileName := range fileNames {
+		content, err := os.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+		file, err := parseReader(fileName, bytes.NewReader(content))
+		if err != nil {
+			return fmt.Errorf("%s: %w", fileName, err)
+		}
+		formatted, err := formatSource(file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fileName, err)
+		}
+		changed := !bytes.Equal(content, formatted)
+		switch {
+		case check:
+			if changed {
+				fmt.Fprintln(stdout, fileName)
+				unformatted++
+			}
+		case write:
+			if !changed {
+				continue
+			}
+			info, err := os.Stat(fileName)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(fileName, formatted, info.Mode().Perm()); err != nil {
+				return fmt.Errorf("failed to write %s: %w", fileName, err)
+			}
+			logger.Printf("Formatted %s", fileName)
+		default:
+			if _, err := stdout.Write(formatted); err != nil {
+				return err
+			}
+		}
+	}
+	if unformatted > 0 {
+		return fmt.Errorf("%d file(s) are not formatted; run jetty fmt -w", unformatted)
+	}
+	return nil
+}
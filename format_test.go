@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func formatForTest(t *testing.T, content string) string {
+	t.Helper()
+	file, err := parseReader("Jettyfile", strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("parseReader returned error: %v", err)
+	}
+	formatted, err := formatSource(file)
+	if err != nil {
+		t.Fatalf("formatSource returned error: %v", err)
+	}
+	return string(formatted)
+}
+
+func TestFormatSource(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "casing and spacing",
+			in:   "arg   NAME=x\n*run   --timeout=5s   echo \"a  b\"\n",
+			want: "ARG NAME=x\n*RUN --timeout=5s echo \"a  b\"\n",
+		},
+		{
+			name: "continuations",
+			in:   "RUN go build \\\n-o  bin/app \\\n      ./cmd/app\n",
+			want: "RUN go build \\\n    -o bin/app \\\n    ./cmd/app\n",
+		},
+		{
+			name: "blocks",
+			in:   "if $A == 1\nfor i IN 1 2\nRUN echo $i\nend\n    else\n# fallback\nRUN echo none\nEND\n",
+			want: "IF $A == 1\n  FOR i IN 1 2\n    RUN echo $i\n  END\nELSE\n  # fallback\n  RUN echo none\nEND\n",
+		},
+		{
+			name: "blank lines and comments",
+			in:   "\n\n# header\n\n\nARG A=1\nTGT build\n   # compile\nRUN make\n\n\n\n# trailing\n",
+			want: "# header\n\nARG A=1\n\nTGT build\n# compile\nRUN make\n\n# trailing\n",
+		},
+		{
+			name: "macros",
+			in:   "DEF greet NAME\n^FMT out.txt \"%s\" $NAME\nEND\nCALL greet world\n",
+			want: "DEF greet NAME\n  ^FMT out.txt \"%s\" $NAME\nEND\nCALL greet world\n",
+		},
+		{
+			name: "heredocs kept",
+			in:   "if $A == 1\nrun   cat  <<-EOF\n\techo  hi\n\n\n\tEOF\nend\n",
+			want: "IF $A == 1\n  RUN cat <<-EOF\n\techo  hi\n\n\n\tEOF\nEND\n",
+		},
+		{
+			name: "quoted newline kept",
+			in:   "RUN echo \"a \\\nb\"\n",
+			want: "RUN echo \"a \\\nb\"\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := formatForTest(t, tc.in)
+			if got != tc.want {
+				t.Fatalf("formatSource() =\n%s\nwant\n%s", got, tc.want)
+			}
+			if again := formatForTest(t, got); again != got {
+				t.Fatalf("formatSource is not idempotent:\n%s", again)
+			}
+		})
+	}
+}
+
+func TestFormatSourceRejectsUnbalancedBlocks(t *testing.T) {
+	file, err := parseReader("", strings.NewReader("IF $A == 1\nRUN echo\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := formatSource(file); err == nil || !strings.Contains(err.Error(), "unterminated IF block") {
+		t.Fatalf("expected an unterminated block error, got %v", err)
+	}
+}
+
+func TestParseFileAcceptsLowercaseDirectives(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "Jettyfile")
+	if err := os.WriteFile(fileName, []byte("arg A=1\n*run echo $A\nwait\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	instructions, err := parseFile(fileName)
+	if err != nil {
+		t.Fatalf("parseFile returned error: %v", err)
+	}
+	if len(instructions) != 3 || instructions[1].Directive != "RUN" || instructions[1].Symbol != "*" || instructions[2].Directive != "WAIT" {
+		t.Fatalf("unexpected instructions: %#v", instructions)
+	}
+}
+
+func TestFmtCommand(t *testing.T) {
+	dir := t.TempDir()
+	messy := filepath.Join(dir, "messy.jetty")
+	clean := filepath.Join(dir, "clean.jetty")
+	if err := os.WriteFile(messy, []byte("run  echo hi\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(clean, []byte("RUN echo hi\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := captureStdout(t)
+	if err := handleSubcommands(context.Background(), []string{"fmt", messy}); err != nil {
+		t.Fatalf("fmt returned error: %v", err)
+	}
+	if output.String() != "RUN echo hi\n" {
+		t.Fatalf("fmt printed %q", output.String())
+	}
+
+	output.Reset()
+	err := handleSubcommands(context.Background(), []string{"fmt", "--check", clean, messy})
+	if err == nil || !strings.Contains(err.Error(), "1 file(s) are not formatted") {
+		t.Fatalf("expected --check to fail, got %v", err)
+	}
+	if output.String() != messy+"\n" {
+		t.Fatalf("--check listed %q", output.String())
+	}
+
+	if err := handleSubcommands(context.Background(), []string{"fmt", "-w", messy}); err != nil {
+		t.Fatalf("fmt -w returned error: %v", err)
+	}
+	assertFileContent(t, messy, "RUN echo hi\n")
+	if info, err := os.Stat(messy); err != nil || (runtime.GOOS != "windows" && info.Mode().Perm() != 0600) {
+		t.Fatalf("expected fmt -w to keep the file mode, got %v %v", info, err)
+	}
+	if err := handleSubcommands(context.Background(), []string{"fmt", "--check", clean, messy}); err != nil {
+		t.Fatalf("expected --check to pass after -w, got %v", err)
+	}
+}
@@ -24,7 +24,7 @@ func BenchmarkExpand(b *testing.B) {
 	input := `Testing expand: $ENV_VAR and &ARG_VAR and ${MISSING} and &{MISSING}`
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_ = state.expand(input)
+		_, _ = state.expand(input)
 	}
 }
 
@@ -99,7 +99,7 @@ func FuzzExpand(f *testing.F) {
 
 	f.Fuzz(func(t *testing.T, orig string) {
 		// Should not panic on any input
-		_ = state.expand(orig)
+		_, _ = state.expand(orig)
 	})
 }
 
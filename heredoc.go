@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Heredoc is the here-document of an instruction: the lines after an
+// instruction ending in `<<EOF`, up to a line holding just `EOF`. With `<<-`,
+// leading tabs are stripped from the body and the closing line; a quoted
+// delimiter (`<<'EOF'` or `<<"EOF"`) turns off Jetty variable expansion in
+// the body. Body ends with a newline unless it is empty.
+type Heredoc struct {
+	Marker    Token
+	Delimiter string
+	StripTabs bool
+	Quoted    bool
+	Body      string
+	// Lines holds the source lines after the instruction, closing line
+	// included.
+	Lines []string
+}
+
+// heredocDirectives accept a heredoc. For RUN and CMD it is the script, or
+// the standard input of the command when one is given; for FMT it is the
+// text, written without format processing.
+var heredocDirectives = map[string]bool{
+	"RUN": true,
+	"CMD": true,
+	"FMT": true,
+}
+
+var heredocMarkerPattern = regexp.MustCompile(`^<<(-?)(?:([A-Za-z_][A-Za-z0-9_]*)|'([A-Za-z_][A-Za-z0-9_]*)'|"([A-Za-z_][A-Za-z0-9_]*)")$`)
+
+// parseHeredocMarker returns the heredoc a `<<EOF` word opens, without its
+// body, or nil when the word is not a heredoc marker.
+func parseHeredocMarker(token Token) *Heredoc {
+	match := heredocMarkerPattern.FindStringSubmatch(token.Raw)
+	if match == nil {
+		return nil
+	}
+	heredoc := &Heredoc{Marker: token, StripTabs: match[1] == "-", Delimiter: match[2]}
+	if heredoc.Delimiter == "" {
+		heredoc.Delimiter = match[3] + match[4]
+		heredoc.Quoted = true
+	}
+	return heredoc
+}
+
+// add records a source line of the heredoc and reports whether it closes
+// it.
+func (heredoc *Heredoc) add(line string) bool {
+	heredoc.Lines = append(heredoc.Lines, line)
+	text := strings.TrimSuffix(line, "\r")
+	if heredoc.StripTabs {
+		text = strings.TrimLeft(text, "\t")
+	}
+	if text == heredoc.Delimiter {
+		return true
+	}
+	heredoc.Body += text + "\n"
+	return false
+}
+
+// startHeredoc moves a trailing heredoc marker of node out of its arguments.
+func startHeredoc(node *Node) *Heredoc {
+	if !heredocDirectives[node.Directive] || len(node.Args) == 0 {
+		return nil
+	}
+	marker := node.Args[len(node.Args)-1]
+	heredoc := parseHeredocMarker(marker)
+	if heredoc == nil {
+		return nil
+	}
+	node.Args = node.Args[:len(node.Args)-1]
+	node.Text = strings.TrimSpace(strings.TrimSuffix(node.Text, marker.Raw))
+	node.Heredoc = heredoc
+	return heredoc
+}
+
+// heredocText returns the body of a heredoc, with variables expanded unless
+// its delimiter is quoted.
+func (state *BuildState) heredocText(heredoc *Heredoc) (string, error) {
+	if heredoc.Quoted {
+		return heredoc.Body, nil
+	}
+	return state.expand(heredoc.Body)
+}
+
+// shellScript returns the script a RUN or CMD instruction runs and, when its
+// heredoc feeds a command, the command's standard input.
+func (state *BuildState) shellScript(inst Instruction) (string, io.Reader, error) {
+	if inst.Heredoc == nil {
+		script, err := state.expand(inst.Args)
+		return strings.TrimSpace(script), nil, err
+	}
+	body, err := state.heredocText(inst.Heredoc)
+	if err != nil {
+		return "", nil, err
+	}
+	if inst.Args == "" {
+		return strings.TrimSpace(body), nil, nil
+	}
+	script, err := state.expand(inst.Args)
+	return strings.TrimSpace(script), strings.NewReader(body), err
+}
+
+// formatText returns the text of a FMT instruction: its heredoc, or words[0]
+// formatted with the expanded remaining words.
+func formatText(state *BuildState, inst Instruction, words []string) (string, error) {
+	if inst.Heredoc == nil {
+		return sprintfExpanded(state, words[0], words[1:])
+	}
+	if len(words) > 0 {
+		return "", fmt.Errorf("%sFMT with a heredoc takes no format arguments", inst.Symbol)
+	}
+	return state.heredocText(inst.Heredoc)
+}
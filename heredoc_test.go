@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseReaderHeredocs(t *testing.T) {
+	content := strings.Join([]string{
+		"RUN <<EOF",
+		"echo \"it's\" \\",
+		"",
+		"# not a comment",
+		"EOF",
+		"*RUN --timeout=5s python3 <<-'PY'",
+		"\tprint('$HOME')",
+		"\t\tPY",
+		"^FMT out.conf <<\"END\"",
+		"END",
+		"RUN cat <<EOF > file.txt",
+		"",
+	}, "\n")
+	file, err := parseReader("", strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("parseReader returned error: %v", err)
+	}
+	if len(file.Nodes) != 4 {
+		t.Fatalf("expected 4 nodes, got %d", len(file.Nodes))
+	}
+
+	script := file.Nodes[0]
+	if script.Heredoc == nil || script.Text != "" || len(script.Args) != 0 {
+		t.Fatalf("unexpected heredoc node: %#v", script)
+	}
+	if script.Heredoc.Body != "echo \"it's\" \\\n\n# not a comment\n" || script.Heredoc.Quoted || len(script.Heredoc.Lines) != 4 {
+		t.Fatalf("unexpected heredoc: %#v", script.Heredoc)
+	}
+
+	python := file.Nodes[1]
+	if python.Text != "python3" || python.OptionArgs["timeout"] != "5s" || python.Symbol != "*" {
+		t.Fatalf("unexpected command node: %#v", python)
+	}
+	if heredoc := python.Heredoc; heredoc == nil || !heredoc.StripTabs || !heredoc.Quoted || heredoc.Delimiter != "PY" || heredoc.Body != "print('$HOME')\n" {
+		t.Fatalf("unexpected <<- heredoc: %#v", python.Heredoc)
+	}
+
+	if heredoc := file.Nodes[2].Heredoc; heredoc == nil || heredoc.Body != "" || heredoc.Delimiter != "END" {
+		t.Fatalf("unexpected empty heredoc: %#v", heredoc)
+	}
+	if redirect := file.Nodes[3]; redirect.Heredoc != nil || redirect.Text != "cat <<EOF > file.txt" {
+		t.Fatalf("expected a marker before other words to stay in the command, got %#v", redirect)
+	}
+	if instructions := file.Instructions(); instructions[1].Heredoc != python.Heredoc || instructions[1].Args != "python3" {
+		t.Fatalf("expected the heredoc to reach the instruction, got %#v", instructions[1])
+	}
+}
+
+func TestParseReaderUnterminatedHeredoc(t *testing.T) {
+	_, err := parseReader("", strings.NewReader("ARG A=1\nRUN  <<-EOF\n\techo\n EOF\n"))
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || err.Error() != "line 2: unterminated heredoc: missing closing EOF" || parseErr.Pos.String() != "2:6" {
+		t.Fatalf("expected an unterminated heredoc error, got %v", err)
+	}
+}
+
+func TestBuildHeredocs(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"ARG NAME=jetty",
+		"RUN <<EOF",
+		"printf '%s\\n' \"it's $NAME\" > script.txt",
+		"printf 'second line\\n' >> script.txt",
+		"EOF",
+		"RUN cat > stdin.txt <<'EOF'",
+		"$NAME is not expanded",
+		"EOF",
+		"IF $NAME == jetty",
+		"\t^FMT app.conf <<-EOF",
+		"\tname = $NAME",
+		"\t\tratio = 100%",
+		"\tEOF",
+		"END",
+		"$FMT GREETING <<EOF",
+		"hello $NAME",
+		"EOF",
+		"^FMT greeting.txt \"%s\" $GREETING",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := runBuildForTest(t, buildFile); err != nil {
+		t.Fatalf("build returned error: %v", err)
+	}
+	assertFileContent(t, filepath.Join(dir, "script.txt"), "it's jetty\nsecond line\n")
+	assertFileContent(t, filepath.Join(dir, "stdin.txt"), "$NAME is not expanded\n")
+	assertFileContent(t, filepath.Join(dir, "app.conf"), "name = jetty\nratio = 100%\n")
+	assertFileContent(t, filepath.Join(dir, "greeting.txt"), "hello jetty\n")
+}
+
+func TestBuildHeredocRejectsFormatArguments(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	if err := os.WriteFile(buildFile, []byte("^FMT out.txt \"%s\" <<EOF\nbody\nEOF\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := runBuildForTest(t, buildFile)
+	if err == nil || !strings.Contains(err.Error(), "^FMT with a heredoc takes no format arguments") {
+		t.Fatalf("expected format arguments to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// remoteFetcher returns the content of the remote Jettyfile at url.
+type remoteFetcher func(url string) ([]byte, error)
+
+// includeSource identifies a Jettyfile read at parse time: a local path or
+// the URL of a remote file. name is how messages refer to it. fetch reads
+// remote files, which are downloaded directly when it is nil.
+type includeSource struct {
+	name  string
+	path  string
+	url   string
+	fetch remoteFetcher
+}
+
+func (source includeSource) same(other includeSource) bool {
+	return source.path == other.path && source.url == other.url
+}
+
+// resolve returns the source an INC argument refers to. A relative path is
+// resolved against the directory of the including file, or against its URL
+// when the including file is remote.
+func (source includeSource) resolve(arg string) (includeSource, error) {
+	githubURL, err := parseGithubImport(arg)
+	if err != nil {
+		return includeSource{}, err
+	}
+	if githubURL != "" {
+		return includeSource{name: arg, url: githubURL, fetch: source.fetch}, nil
+	}
+	if source.url != "" {
+		if filepath.IsAbs(arg) {
+			return includeSource{}, fmt.Errorf("remote Jettyfile cannot include local file %s", arg)
+		}
+		base, err := url.Parse(source.url)
+		if err != nil {
+			return includeSource{}, err
+		}
+		resolved := base.ResolveReference(&url.URL{Path: filepath.ToSlash(arg)})
+		return includeSource{name: arg, url: resolved.String(), fetch: source.fetch}, nil
+	}
+	path := arg
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(source.path), path)
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return includeSource{}, err
+	}
+	return includeSource{name: arg, path: path, fetch: source.fetch}, nil
+}
+
+func (source includeSource) read() ([]Instruction, error) {
+	if source.url != "" {
+		fetch := source.fetch
+		if fetch == nil {
+			fetch = func(url string) ([]byte, error) {
+				return fetchRemoteJettyfile(context.Background(), url)
+			}
+		}
+		content, err := fetch(source.url)
+		if err != nil {
+			return nil, err
+		}
+		return scanInstructions(bytes.NewReader(content))
+	}
+	file, err := os.Open(source.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return scanInstructions(file)
+}
+
+// resolveIncludes replaces each INC in a flat instruction list with the
+// instructions of the file it names, recursively. stack holds the files
+// currently being included, outermost first, to detect include cycles.
+func resolveIncludes(instructions []Instruction, source includeSource, stack []includeSource) ([]Instruction, error) {
+	if source.name == "" {
+		source.name = filepath.Base(source.path)
+		if path, err := filepath.Abs(source.path); err == nil {
+			source.path = path
+		}
+	}
+	stack = append(stack[:len(stack):len(stack)], source)
+	var resolved []Instruction
+	for _, inst := range instructions {
+		if inst.Directive != "INC" {
+			resolved = append(resolved, inst)
+			continue
+		}
+		included, err := includeFile(inst, source, stack)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: INC %s: %w", inst.Line, inst.Args, err)
+		}
+		resolved = append(resolved, included...)
+	}
+	return resolved, nil
+}
+
+// includeFile reads the file an INC names and returns its instructions,
+// located in that file and positioned at the INC's line. Each included file
+// must be self-contained: its blocks are balanced and its ID/AFTER labels
+// apply to steps within it.
+func includeFile(inst Instruction, source includeSource, stack []includeSource) ([]Instruction, error) {
+	args, err := splitArgs(inst.Args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("INC requires exactly one file")
+	}
+	target, err := source.resolve(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if target.path != "" {
+		// Name local files relative to the top-level Jettyfile.
+		if rel, err := filepath.Rel(filepath.Dir(stack[0].path), target.path); err == nil && !strings.HasPrefix(rel, "..") {
+			target.name = filepath.ToSlash(rel)
+		}
+	}
+	for i, open := range stack {
+		if open.same(target) {
+			var cycle []string
+			for _, file := range stack[i:] {
+				cycle = append(cycle, file.name)
+			}
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(cycle, " -> "), target.name)
+		}
+	}
+	instructions, err := target.read()
+	if err != nil {
+		return nil, err
+	}
+	instructions, err = resolveIncludes(instructions, target, stack)
+	if err != nil {
+		return nil, err
+	}
+	nested, err := nestBlocks(instructions)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := attachStepLabels(nested); err != nil {
+		return nil, err
+	}
+	for i := range instructions {
+		if instructions[i].File == "" {
+			instructions[i].File = target.name
+			instructions[i].FileLine = instructions[i].Line
+		}
+		instructions[i].Line = inst.Line
+	}
+	return instructions, nil
+}
+
+// location describes where an instruction was written for error messages:
+// its line, and for an included instruction also its file and line there.
+func (inst Instruction) location() string {
+	if inst.File == "" {
+		return fmt.Sprintf("line %d", inst.Line)
+	}
+	return fmt.Sprintf("line %d (%s line %d)", inst.Line, inst.File, inst.FileLine)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeIncludeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseFileSplicesIncludes(t *testing.T) {
+	dir := t.TempDir()
+	writeIncludeFiles(t, dir, map[string]string{
+		"Jettyfile":        "ARG A=1\nINC lib/common.jetty\nRUN echo $B\n",
+		"lib/common.jetty": "# shared settings\nENV B=2\nINC more.jetty\n",
+		"lib/more.jetty":   "IF A == 1\nARG C=3\nEND\n",
+	})
+
+	instructions, err := parseFile(filepath.Join(dir, "Jettyfile"))
+	if err != nil {
+		t.Fatalf("parseFile returned error: %v", err)
+	}
+	var got []string
+	for _, inst := range instructions {
+		got = append(got, inst.Directive+"@"+inst.location())
+	}
+	want := []string{
+		"ARG@line 1",
+		"ENV@line 2 (lib/common.jetty line 2)",
+		"IF@line 2 (lib/more.jetty line 1)",
+		"RUN@line 3",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("instructions = %v, want %v", got, want)
+	}
+	if len(instructions[2].Body) != 1 || instructions[2].Body[0].Args != "C=3" {
+		t.Fatalf("expected included IF body to be nested, got %#v", instructions[2].Body)
+	}
+}
+
+func TestParseFileIncludeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{
+			name:  "cycle",
+			files: map[string]string{"Jettyfile": "INC a.jetty\n", "a.jetty": "INC b.jetty\n", "b.jetty": "\nINC a.jetty\n"},
+			want:  "line 1: INC a.jetty: line 1: INC b.jetty: line 2: INC a.jetty: include cycle: a.jetty -> b.jetty -> a.jetty",
+		},
+		{
+			name:  "self",
+			files: map[string]string{"Jettyfile": "INC Jettyfile\n"},
+			want:  "include cycle: Jettyfile -> Jettyfile",
+		},
+		{
+			name:  "invalid directive",
+			files: map[string]string{"Jettyfile": "ARG A=1\nINC lib.jetty\n", "lib.jetty": "ENV B=2\nNOPE x\n"},
+			want:  "line 2: INC lib.jetty: line 2: invalid directive: NOPE",
+		},
+		{
+			name:  "unbalanced block",
+			files: map[string]string{"Jettyfile": "INC lib.jetty\nEND\n", "lib.jetty": "IF A == 1\n"},
+			want:  "line 1: INC lib.jetty: line 1: unterminated IF block",
+		},
+		{
+			name:  "dangling label",
+			files: map[string]string{"Jettyfile": "INC lib.jetty\nRUN echo\n", "lib.jetty": "ID build\n"},
+			want:  "line 1: INC lib.jetty: line 1: ID/AFTER must be followed by a step",
+		},
+		{
+			name:  "missing file",
+			files: map[string]string{"Jettyfile": "INC missing.jetty\n"},
+			want:  "line 1: INC missing.jetty:",
+		},
+		{
+			name:  "arguments",
+			files: map[string]string{"Jettyfile": "INC a.jetty b.jetty\n"},
+			want:  "INC requires exactly one file",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeIncludeFiles(t, dir, tc.files)
+			_, err := parseFile(filepath.Join(dir, "Jettyfile"))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("parseFile error = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestIncludeSourceResolve(t *testing.T) {
+	remote := includeSource{url: "https://raw.githubusercontent.com/owner/repo/main/ci/Jettyfile"}
+	resolved, err := remote.resolve("../lib/common.jetty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.url != "https://raw.githubusercontent.com/owner/repo/main/lib/common.jetty" {
+		t.Fatalf("relative remote include resolved to %q", resolved.url)
+	}
+	resolved, err = remote.resolve("github.com/other/repo@v1/base.jetty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.url != "https://raw.githubusercontent.com/other/repo/v1/base.jetty" {
+		t.Fatalf("github include resolved to %q", resolved.url)
+	}
+	if _, err := remote.resolve(filepath.Join(t.TempDir(), "local.jetty")); err == nil {
+		t.Fatal("expected a remote file to be unable to include a local absolute path")
+	}
+}
+
+func TestBuildIncludeSharesArgsAndReportsIncludedLine(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	writeIncludeFiles(t, dir, map[string]string{
+		"Jettyfile":  "INC vars.jetty\n^FMT out.txt \"%s-%s\" $NAME $MODE\n",
+		"vars.jetty": "ARG NAME=jetty\nENV MODE=release\n",
+	})
+	if _, _, err := runBuildForTest(t, filepath.Join(dir, "Jettyfile")); err != nil {
+		t.Fatalf("build returned error: %v", err)
+	}
+	assertFileContent(t, filepath.Join(dir, "out.txt"), "jetty-release")
+
+	writeIncludeFiles(t, dir, map[string]string{
+		"Jettyfile":  "ARG A=1\nINC fail.jetty\n",
+		"fail.jetty": "\n\nCPY missing.txt dst.txt\n",
+	})
+	_, _, err := runBuildForTest(t, filepath.Join(dir, "Jettyfile"))
+	if err == nil || !strings.Contains(err.Error(), "line 2 (fail.jetty line 3) [CPY missing.txt dst.txt]") {
+		t.Fatalf("expected error to name the included file and line, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// defaultRetryBackoff is the delay before the first retry when --retries is
+// given without --backoff. The delay doubles after every failed attempt.
+const defaultRetryBackoff = time.Second
+
+// stepLimits holds the --timeout, --retries and --backoff options of an
+// instruction.
+type stepLimits struct {
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+}
+
+func parseStepLimits(options map[string]string) (stepLimits, error) {
+	limits := stepLimits{backoff: defaultRetryBackoff}
+	if value, ok := options["timeout"]; ok {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return stepLimits{}, fmt.Errorf("invalid --timeout %q: expected a positive duration such as 30s", value)
+		}
+		limits.timeout = timeout
+	}
+	if value, ok := options["retries"]; ok {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return stepLimits{}, fmt.Errorf("invalid --retries %q: expected a non-negative integer", value)
+		}
+		limits.retries = retries
+	}
+	if value, ok := options["backoff"]; ok {
+		if _, hasRetries := options["retries"]; !hasRetries {
+			return stepLimits{}, fmt.Errorf("--backoff requires --retries")
+		}
+		backoff, err := time.ParseDuration(value)
+		if err != nil || backoff < 0 {
+			return stepLimits{}, fmt.Errorf("invalid --backoff %q: expected a duration such as 2s", value)
+		}
+		limits.backoff = backoff
+	}
+	return limits, nil
+}
+
+// executeStep runs an instruction under its --timeout and --retries options.
+// Each attempt runs with a context derived from the build's, swapped into
+// state for the duration of the attempt, so a timeout stops only this step.
+func executeStep(state *BuildState, inst Instruction) error {
+	limits, err := parseStepLimits(inst.Options)
+	if err != nil {
+		return err
+	}
+	if limits.timeout == 0 && limits.retries == 0 {
+		return executeInstruction(state, inst)
+	}
+	parent := state.Context
+	backoff := limits.backoff
+	for attempt := 1; ; attempt++ {
+		err = executeAttempt(state, inst, limits.timeout)
+		state.Context = parent
+		if err == nil && attempt > 1 {
+			state.log("RETRY: %s%s %s succeeded on attempt %d", inst.Symbol, inst.Directive, inst.Args, attempt)
+		}
+		if err == nil || parent.Err() != nil || attempt > limits.retries {
+			return err
+		}
+		if state.Stats != nil {
+			state.Stats.retries.Add(1)
+		}
+		state.log("RETRY (%d/%d) in %s: %s%s %s: %v", attempt, limits.retries, backoff, inst.Symbol, inst.Directive, inst.Args, err)
+		select {
+		case <-time.After(backoff):
+		case <-parent.Done():
+			return parent.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func executeAttempt(state *BuildState, inst Instruction, timeout time.Duration) error {
+	if timeout == 0 {
+		return executeInstruction(state, inst)
+	}
+	ctx, cancel := context.WithTimeout(state.Context, timeout)
+	defer cancel()
+	state.Context = ctx
+	err := executeInstruction(state, inst)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s: %w", timeout, err)
+	}
+	return err
+}
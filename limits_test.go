@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStepLimits(t *testing.T) {
+	limits, err := parseStepLimits(map[string]string{"timeout": "30s", "retries": "3", "backoff": "250ms"})
+	if err != nil {
+		t.Fatalf("parseStepLimits returned error: %v", err)
+	}
+	if limits.timeout != 30*time.Second || limits.retries != 3 || limits.backoff != 250*time.Millisecond {
+		t.Fatalf("unexpected limits: %#v", limits)
+	}
+
+	limits, err = parseStepLimits(nil)
+	if err != nil || limits.timeout != 0 || limits.retries != 0 || limits.backoff != defaultRetryBackoff {
+		t.Fatalf("unexpected default limits: %#v (err %v)", limits, err)
+	}
+
+	tests := []struct {
+		options map[string]string
+		want    string
+	}{
+		{map[string]string{"timeout": "soon"}, "invalid --timeout"},
+		{map[string]string{"timeout": "0s"}, "invalid --timeout"},
+		{map[string]string{"retries": "-1"}, "invalid --retries"},
+		{map[string]string{"backoff": "1s"}, "--backoff requires --retries"},
+		{map[string]string{"retries": "1", "backoff": "fast"}, "invalid --backoff"},
+	}
+	for _, tc := range tests {
+		_, err := parseStepLimits(tc.options)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parseStepLimits(%v) error = %v, want %q", tc.options, err, tc.want)
+		}
+	}
+}
+
+func TestBuildRetriesFailedInstruction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		if _, err := exec.LookPath("sh"); err != nil {
+			t.Skip("requires sh for portable test command")
+		}
+	}
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"RUN --retries=2 --backoff=10ms test -f marker || { touch marker; exit 1; }",
+		"*RUN --retries=1 --backoff=10ms exit 4",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, infos, err := runBuildForTest(t, buildFile)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected the async step to fail after its retries, got %v", err)
+	}
+	if !joinedOutputContains(output, "succeeded on attempt 2") {
+		t.Fatalf("expected the retried step to report its successful attempt, got %q", output)
+	}
+	if !joinedOutputContains(output, "RETRY (1/1) in 10ms: *RUN exit 4") {
+		t.Fatalf("expected the async retry to be logged, got %q", output)
+	}
+	final := infos[len(infos)-1]
+	if final.Retries != 2 {
+		t.Fatalf("expected 2 retries in the build record, got %d", final.Retries)
+	}
+}
+
+func TestBuildTimesOutInstruction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		if _, err := exec.LookPath("sh"); err != nil {
+			t.Skip("requires sh for portable sleep command")
+		}
+	}
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	if err := os.WriteFile(buildFile, []byte("RUN --timeout=200ms sleep 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, _, err := runBuildForTest(t, buildFile)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 200ms") {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Fatalf("expected the timeout to stop the step early, took %s", elapsed)
+	}
+}
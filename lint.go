@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// lintRules describes every rule jetty lint checks, by rule ID.
+var lintRules = map[string]string{
+	"orphan-cache-decl":   "DEP or OUT is not followed by a cacheable RUN, CPY or USE step",
+	"use-without-image":   "USE runs before any FRM or BOX defines an image",
+	"undefined-variable":  "a variable is referenced but never defined",
+	"arg-shadows-env":     "an ARG has the same name as an ENV, and ARG values take precedence",
+	"wdr-before-dir":      "WDR changes to a directory that a later DIR creates",
+	"async-race":          "an instruction reads a path an async instruction may still be writing",
+	"duplicate-box":       "a BOX name is defined more than once",
+	"cmd-not-last":        "CMD is not the last instruction, although it always runs last",
+	"lint-ignore-unknown": "a jetty:ignore comment names an unknown rule",
+}
+
+// lintFinding is one problem reported by jetty lint.
+type lintFinding struct {
+	Rule    string `json:"rule"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+	// line is the top-level line the finding is suppressed by.
+	line int
+}
+
+// linter collects the findings for one Jettyfile.
+type linter struct {
+	fileName string
+	columns  map[int]int
+	findings []lintFinding
+}
+
+func (l *linter) report(inst Instruction, rule string, format string, args ...any) {
+	finding := lintFinding{
+		Rule:    rule,
+		File:    l.fileName,
+		Line:    inst.Line,
+		Message: fmt.Sprintf(format, args...),
+		line:    inst.Line,
+	}
+	if inst.File != "" {
+		finding.File = inst.File
+		finding.Line = inst.FileLine
+	} else {
+		finding.Column = l.columns[inst.Line]
+	}
+	l.findings = append(l.findings, finding)
+}
+
+// lintFile parses and checks a Jettyfile. Findings are suppressed by a
+// `# jetty:ignore rule...` comment directly above the instruction, or a
+// `# jetty:ignore-file rule...` comment anywhere in the file; without rule
+// IDs, both suppress every rule.
+func lintFile(fileName string) ([]lintFinding, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return lintSource(fileName, content)
+}
+
+// lintSource checks the content of the Jettyfile fileName.
+func lintSource(fileName string, content []byte) ([]lintFinding, error) {
+	return lintSourceWith(fileName, content, nil)
+}
+
+// lintSourceWith is lintSource with remote includes read through fetch.
+func lintSourceWith(fileName string, content []byte, fetch remoteFetcher) ([]lintFinding, error) {
+	source, err := parseReader(fileName, bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	instructions, err := parseSourceWith(bytes.NewReader(content), fileName, fetch)
+	if err != nil {
+		return nil, err
+	}
+	l := &linter{fileName: fileName, columns: make(map[int]int)}
+	for _, node := range source.Nodes {
+		l.columns[node.Start.Line] = node.Start.Column
+	}
+	flat := flattenInstructions(instructions)
+	l.checkCacheDeclarations(instructions)
+	checked := make(map[*Instruction]bool)
+	for _, inst := range flat {
+		if inst.Macro != nil && !checked[inst.Macro] {
+			checked[inst.Macro] = true
+			l.checkCacheDeclarations(inst.Macro.Body)
+		}
+	}
+	l.checkImages(flat)
+	l.checkVariables(flat)
+	l.checkDirectories(flat)
+	l.checkAsyncRaces(flat)
+	l.checkCMD(instructions, false)
+
+	suppressions := l.collectSuppressions(source)
+	var findings []lintFinding
+	for _, finding := range l.findings {
+		if !suppressions.matches(finding) {
+			findings = append(findings, finding)
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].line != findings[j].line {
+			return findings[i].line < findings[j].line
+		}
+		return findings[i].Line < findings[j].Line
+	})
+	return findings, nil
+}
+
+// flattenInstructions lists instructions in file order, descending into
+// targets, both branches of IF blocks, FOR bodies and, once each, the macros
+// CALLs expand.
+func flattenInstructions(instructions []Instruction) []Instruction {
+	var flat []Instruction
+	seen := make(map[*Instruction]bool)
+	var walk func([]Instruction)
+	walk = func(instructions []Instruction) {
+		for _, inst := range instructions {
+			flat = append(flat, inst)
+			walk(inst.Body)
+			walk(inst.Else)
+			if inst.Macro != nil && !seen[inst.Macro] {
+				seen[inst.Macro] = true
+				walk(inst.Macro.Body)
+			}
+		}
+	}
+	walk(instructions)
+	return flat
+}
+
+type lintSuppressions struct {
+	file  map[string]bool
+	lines map[int]map[string]bool
+}
+
+func (s lintSuppressions) matches(finding lintFinding) bool {
+	if s.file[""] || s.file[finding.Rule] {
+		return true
+	}
+	rules := s.lines[finding.line]
+	return rules != nil && (rules[""] || rules[finding.Rule])
+}
+
+func (l *linter) collectSuppressions(source *SourceFile) lintSuppressions {
+	suppressions := lintSuppressions{file: make(map[string]bool), lines: make(map[int]map[string]bool)}
+	parse := func(comment Comment, node *Node) {
+		text := strings.TrimSpace(strings.TrimPrefix(comment.Text, "#"))
+		directive, rest, _ := strings.Cut(text, " ")
+		var rules map[string]bool
+		switch directive {
+		case "jetty:ignore-file":
+			rules = suppressions.file
+		case "jetty:ignore":
+			if node == nil {
+				return
+			}
+			if suppressions.lines[node.Start.Line] == nil {
+				suppressions.lines[node.Start.Line] = make(map[string]bool)
+			}
+			rules = suppressions.lines[node.Start.Line]
+		default:
+			return
+		}
+		ids := strings.FieldsFunc(rest, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		if len(ids) == 0 {
+			rules[""] = true
+		}
+		for _, id := range ids {
+			if _, ok := lintRules[id]; !ok {
+				l.findings = append(l.findings, lintFinding{
+					Rule:    "lint-ignore-unknown",
+					File:    l.fileName,
+					Line:    comment.Pos.Line,
+					Column:  comment.Pos.Column,
+					Message: fmt.Sprintf("unknown lint rule %s", id),
+					line:    comment.Pos.Line,
+				})
+				continue
+			}
+			rules[id] = true
+		}
+	}
+	for _, node := range source.Nodes {
+		for _, comment := range node.Comments {
+			parse(comment, node)
+		}
+	}
+	for _, comment := range source.Trailing {
+		parse(comment, nil)
+	}
+	return suppressions
+}
+
+// checkCacheDeclarations reports DEP and OUT declarations that no cacheable
+// step in the same block consumes.
+func (l *linter) checkCacheDeclarations(instructions []Instruction) {
+	for i, inst := range instructions {
+		l.checkCacheDeclarations(inst.Body)
+		l.checkCacheDeclarations(inst.Else)
+		if inst.Directive != "DEP" && inst.Directive != "OUT" {
+			continue
+		}
+		next := i + 1
+		for next < len(instructions) && (instructions[next].Directive == "DEP" || instructions[next].Directive == "OUT") {
+			next++
+		}
+		if next == len(instructions) || !isCacheable(instructions[next]) {
+			l.report(inst, "orphan-cache-decl", "%s is not followed by a cacheable RUN, CPY or USE step", inst.Directive)
+		}
+	}
+}
+
+func isCacheable(inst Instruction) bool {
+	return (inst.Directive == "RUN" && !isCapture(inst)) || inst.Directive == "CPY" || inst.Directive == "USE"
+}
+
+// checkImages reports USE steps with no image to run in, and BOX names
+// defined twice.
+func (l *linter) checkImages(flat []Instruction) {
+	hasImage := false
+	boxes := make(map[string]Instruction)
+	for _, inst := range flat {
+		switch inst.Directive {
+		case "FRM":
+			hasImage = true
+		case "BOX":
+			hasImage = true
+			parts, err := splitArgs(inst.Args)
+			if err != nil || len(parts) == 0 {
+				continue
+			}
+			if previous, ok := boxes[parts[0]]; ok {
+				l.report(inst, "duplicate-box", "BOX %s is already defined on %s", parts[0], previous.location())
+				continue
+			}
+			boxes[parts[0]] = inst
+		case "USE":
+			if !hasImage {
+				l.report(inst, "use-without-image", "USE runs before any FRM or BOX defines an image")
+			}
+		}
+	}
+}
+
+// checkVariables reports references to variables that nothing defines, and
+// ARGs that shadow an ENV of the same name. Variables set in Jetty's own
+// environment count as defined, as they do for build --strict. A RUN, CMD or
+// USE script may also use the variables it assigns or loops over itself.
+func (l *linter) checkVariables(flat []Instruction) {
+	defined := make(map[string]bool)
+	envs := make(map[string]Instruction)
+	for _, inst := range flat {
+		for _, name := range definedVariables(inst) {
+			defined[name] = true
+		}
+		if inst.Directive == "ENV" {
+			if key, _, err := parseAssignment(inst.Args, "ENV"); err == nil {
+				if _, ok := envs[key]; !ok {
+					envs[key] = inst
+				}
+			}
+		}
+	}
+	for _, inst := range flat {
+		if inst.Directive == "ARG" {
+			key, _, _ := strings.Cut(inst.Args, "=")
+			key = strings.TrimSpace(key)
+			if env, ok := envs[key]; ok {
+				l.report(inst, "arg-shadows-env", "ARG %s shadows ENV %s on %s; ARG values take precedence", key, key, env.location())
+			}
+		}
+		if inst.Directive == "INC" || inst.Directive == "ID" || inst.Directive == "AFTER" || inst.Directive == "TGT" {
+			continue
+		}
+		text := inst.Args
+		if inst.Heredoc != nil && !inst.Heredoc.Quoted {
+			text += "\n" + inst.Heredoc.Body
+		}
+		local := make(map[string]bool)
+		if isShellScript(inst) {
+			for _, name := range shellVariables(text) {
+				local[name] = true
+			}
+		}
+		reported := make(map[string]bool)
+		for _, name := range variableReferences(text) {
+			if defined[name] || local[name] || reported[name] {
+				continue
+			}
+			if _, ok := os.LookupEnv(name); ok {
+				continue
+			}
+			reported[name] = true
+			l.report(inst, "undefined-variable", "variable %s is referenced but never defined", name)
+		}
+	}
+}
+
+// isShellScript reports whether inst runs its arguments as a shell script.
+func isShellScript(inst Instruction) bool {
+	return inst.Directive == "RUN" || inst.Directive == "CMD" || inst.Directive == "USE"
+}
+
+// shellVariablePattern matches a shell assignment, optionally after export,
+// local, readonly or declare, and the variable of a for loop.
+var shellVariablePattern = regexp.MustCompile(`(?:^|[\s;&|(])(?:(?:export|local|readonly|declare)\s+(?:-\w+\s+)*([A-Za-z_][A-Za-z0-9_]*)=|([A-Za-z_][A-Za-z0-9_]*)=|for\s+([A-Za-z_][A-Za-z0-9_]*)\b)`)
+
+// shellVariables returns the variables a shell script assigns or loops over.
+func shellVariables(script string) []string {
+	var names []string
+	for _, match := range shellVariablePattern.FindAllStringSubmatch(script, -1) {
+		for _, name := range match[1:] {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// definedVariables returns the variables an instruction defines.
+func definedVariables(inst Instruction) []string {
+	switch inst.Directive {
+	case "ARG":
+		key, _, _ := strings.Cut(inst.Args, "=")
+		return []string{strings.TrimSpace(key)}
+	case "ENV":
+		if key, _, err := parseAssignment(inst.Args, "ENV"); err == nil {
+			return []string{key}
+		}
+	case "FMT":
+		if inst.Symbol == "$" || inst.Symbol == "&" {
+			if parts, err := splitArgs(inst.Args); err == nil && len(parts) > 0 {
+				return []string{parts[0]}
+			}
+		}
+	case "RUN":
+		if !isCapture(inst) {
+			break
+		}
+		if name, _, err := parseCapture(inst); err == nil {
+			if status, ok := inst.Options["status"]; ok {
+				return []string{name, status}
+			}
+			return []string{name}
+		}
+	case "FOR":
+		if header, err := parseLoopHeader(inst.Args); err == nil {
+			return []string{header.name}
+		}
+	case "CALL":
+		if inst.Macro != nil {
+			_, params, _ := parseMacroHeader(inst.Macro.Args)
+			return params
+		}
+	}
+	return nil
+}
+
+// variableReferences returns the names of the variables text references the
+// way BuildState.expand would resolve them. Names guarded by a :-, :? or :+
+// operator are not references to an undefined variable.
+func variableReferences(text string) []string {
+	var names []string
+	for i := 0; i+1 < len(text); i++ {
+		if text[i] != '$' {
+			continue
+		}
+		next := text[i+1]
+		switch {
+		case next == '$':
+			i++
+		case next == '{':
+			end := closingBrace(text, i+2)
+			if end < 0 {
+				return names
+			}
+			expr := strings.TrimPrefix(text[i+2:end], "#")
+			nameEnd := 0
+			for nameEnd < len(expr) && isNameByte(expr[nameEnd]) {
+				nameEnd++
+			}
+			op := expr[nameEnd:]
+			if nameEnd > 0 && isNameStart(expr[0]) && !strings.HasPrefix(op, ":-") && !strings.HasPrefix(op, ":?") && !strings.HasPrefix(op, ":+") {
+				names = append(names, expr[:nameEnd])
+			}
+			names = append(names, variableReferences(op)...)
+			i = end
+		case isNameStart(next):
+			end := i + 1
+			for end < len(text) && isNameByte(text[end]) {
+				end++
+			}
+			names = append(names, text[i+1:end])
+			i = end - 1
+		}
+	}
+	return names
+}
+
+// staticPath resolves a literal path argument against a statically tracked
+// working directory, which is empty once a WDR needed expansion. It returns
+// false when the path cannot be known without running the build.
+func staticPath(workDir string, arg string) (string, bool) {
+	if strings.Contains(arg, "$") {
+		return "", false
+	}
+	arg = filepath.ToSlash(arg)
+	if path.IsAbs(arg) {
+		return path.Clean(arg), true
+	}
+	if workDir == "" {
+		return "", false
+	}
+	return path.Join(workDir, arg), true
+}
+
+// nextWorkDir returns the statically tracked working directory after inst.
+func nextWorkDir(workDir string, inst Instruction) string {
+	if inst.Directive != "WDR" {
+		return workDir
+	}
+	dir, _ := staticPath(workDir, inst.Args)
+	return dir
+}
+
+// checkDirectories reports a WDR into a directory that only a later DIR
+// creates.
+func (l *linter) checkDirectories(flat []Instruction) {
+	paths := make([]string, len(flat))
+	workDir := "."
+	for i, inst := range flat {
+		if inst.Directive == "DIR" || inst.Directive == "WDR" {
+			paths[i], _ = staticPath(workDir, inst.Args)
+		}
+		workDir = nextWorkDir(workDir, inst)
+	}
+	for i, inst := range flat {
+		if inst.Directive != "WDR" || paths[i] == "" {
+			continue
+		}
+		for j, dir := range flat {
+			if dir.Directive != "DIR" || paths[j] != paths[i] {
+				continue
+			}
+			if j > i {
+				l.report(inst, "wdr-before-dir", "WDR %s runs before the DIR on %s creates it", inst.Args, dir.location())
+			}
+			break
+		}
+	}
+}
+
+// asyncWrite is a path an async instruction writes, pending until a WAIT or
+// AFTER joins it.
+type asyncWrite struct {
+	inst Instruction
+	path string
+}
+
+// checkAsyncRaces reports instructions that read a path an earlier async
+// instruction writes without a WAIT or AFTER in between. Writes are *CPY
+// destinations and the OUT paths of async steps; reads are CPY sources, DEP
+// paths, WDR targets and IF EXISTS paths.
+func (l *linter) checkAsyncRaces(flat []Instruction) {
+	var pending []asyncWrite
+	var outs []string
+	workDir := "."
+	for _, inst := range flat {
+		if inst.Directive == "WAIT" {
+			groups, _ := parseWaitGroups(inst.Args)
+			var remaining []asyncWrite
+			for _, write := range pending {
+				if !waitMatchesGroup(groups, write.inst.Options["group"]) {
+					remaining = append(remaining, write)
+				}
+			}
+			pending = remaining
+			continue
+		}
+		for _, read := range lintReads(inst) {
+			p, ok := staticPath(workDir, read)
+			if !ok {
+				continue
+			}
+			for _, write := range pending {
+				if (p == write.path || strings.HasPrefix(p, write.path+"/")) && !waitsFor(inst, write.inst) {
+					l.report(inst, "async-race", "%s reads %s, which the async %s%s on %s may still be writing; add a WAIT or AFTER", inst.Directive, read, write.inst.Symbol, write.inst.Directive, write.inst.location())
+					break
+				}
+			}
+		}
+		if inst.Directive == "OUT" {
+			if parts, err := splitArgs(inst.Args); err == nil {
+				outs = append(outs, parts...)
+			}
+			continue
+		}
+		workDir = nextWorkDir(workDir, inst)
+		if inst.Symbol == "*" {
+			writes := outs
+			if inst.Directive == "CPY" {
+				if parts, err := splitArgs(inst.Args); err == nil && len(parts) == 2 {
+					writes = append(writes, parts[1])
+				}
+			}
+			for _, write := range writes {
+				if p, ok := staticPath(workDir, write); ok {
+					pending = append(pending, asyncWrite{inst: inst, path: p})
+				}
+			}
+		}
+		if inst.Directive != "DEP" {
+			outs = nil
+		}
+	}
+}
+
+// lintReads returns the paths a synchronous instruction reads.
+func lintReads(inst Instruction) []string {
+	if inst.Symbol == "*" {
+		return nil
+	}
+	switch inst.Directive {
+	case "CPY":
+		if parts, err := splitArgs(inst.Args); err == nil && len(parts) == 2 {
+			return parts[:1]
+		}
+	case "DEP":
+		if parts, err := splitArgs(inst.Args); err == nil {
+			return parts
+		}
+	case "WDR":
+		return []string{inst.Args}
+	case "IF":
+		if cond, err := parseCondition(inst.Args); err == nil && cond.kind == "EXISTS" {
+			return cond.operands
+		}
+	}
+	return nil
+}
+
+func waitsFor(inst Instruction, async Instruction) bool {
+	if async.ID == "" {
+		return false
+	}
+	for _, name := range inst.After {
+		if name == async.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCMD reports instructions written after CMD, which always runs last.
+// A CMD is last when nothing follows it in its block, nor the blocks around
+// it in theirs; the other branch of an IF does not count.
+func (l *linter) checkCMD(instructions []Instruction, followed bool) {
+	for i, inst := range instructions {
+		after := followed || i < len(instructions)-1
+		if inst.Directive == "CMD" && after {
+			l.report(inst, "cmd-not-last", "CMD always runs after every other instruction; move it to the end of the file")
+		}
+		l.checkCMD(inst.Body, after)
+		l.checkCMD(inst.Else, after)
+	}
+}
+
+// writeLintFindings prints findings as `file:line:col: rule: message` lines
+// or, for format json, as a JSON array.
+func writeLintFindings(w io.Writer, findings []lintFinding, format string) error {
+	switch format {
+	case "json":
+		if findings == nil {
+			findings = []lintFinding{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(findings)
+	case "text":
+		for _, finding := range findings {
+			pos := Position{File: finding.File, Line: finding.Line, Column: finding.Column}
+			location := pos.String()
+			if finding.Column == 0 {
+				location = fmt.Sprintf("%s:%d", finding.File, finding.Line)
+			}
+			if _, err := fmt.Fprintf(w, "%s: %s: %s\n", location, finding.Rule, finding.Message); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unknown lint format %q (expected text or json)", ErrInvalidInput, format)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func lintForTest(t *testing.T, content string) []lintFinding {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), "Jettyfile")
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	findings, err := lintFile(fileName)
+	if err != nil {
+		t.Fatalf("lintFile returned error: %v", err)
+	}
+	return findings
+}
+
+func findingRules(findings []lintFinding) []string {
+	var rules []string
+	for _, finding := range findings {
+		rules = append(rules, finding.Rule)
+	}
+	return rules
+}
+
+func TestLintRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"orphan DEP", "DEP go.sum\nENV A=1\nRUN echo\n", "orphan-cache-decl@1"},
+		{"orphan OUT at end of block", "IF OS linux\nOUT bin/app\nEND\nRUN make\n", "orphan-cache-decl@2"},
+		{"cache declarations consumed", "DEP go.sum\nOUT app\n*RUN go build\n", ""},
+		{"USE without image", "USE go build\nFRM golang:1.22\nUSE go test\n", "use-without-image@1"},
+		{"duplicate BOX", "BOX go golang:1.22\nBOX go golang:1.23\nUSE go go build\n", "duplicate-box@2"},
+		{"undefined variable", "ARG A=1\nRUN echo $A ${B:-x} $$C ${#D} $E\n", "undefined-variable@2,undefined-variable@2"},
+		{"shell variables", "FRM golang:1.22\nRUN for f in *; do echo $f ${f%.txt}; done\nRUN OUT=dist; export V=1 && echo $OUT $V $W\nUSE go build $GOFLAGS_X\nCMD echo $f\n", "undefined-variable@3,undefined-variable@4,undefined-variable@5"},
+		{"variables from captures", "$RUN V git describe\n&RUN --status=C O true\nRUN echo $V $O $C\n", ""},
+		{"capture does not consume DEP", "DEP go.sum\n$RUN V cat go.sum\n", "orphan-cache-decl@1"},
+		{"heredoc variables", "RUN <<EOF\necho $U\nEOF\nRUN <<'EOF'\necho $Q\nEOF\n", "undefined-variable@1"},
+		{"variables from FOR, FMT and macros", "FOR i IN 1 2\nRUN echo $i\nEND\n$FMT F \"%s\" x\nDEF m P\nRUN echo $P $F\nEND\nCALL m y\n", ""},
+		{"ARG shadows ENV", "ENV MODE=dev\nARG MODE=release\n", "arg-shadows-env@2"},
+		{"WDR before DIR", "WDR build\nWDR ..\nDIR build\n", "wdr-before-dir@1"},
+		{"WDR after DIR", "DIR build\nWDR build\nDIR build\n", ""},
+		{"async race", "*CPY in.txt out/gen.txt\nCPY out/gen.txt final.txt\n", "async-race@2"},
+		{"async race on OUT", "OUT dist\n*RUN make dist\nDEP dist/app\nRUN ship\n", "async-race@3"},
+		{"async joined by WAIT", "*CPY --group=gen in.txt gen.txt\nWAIT gen\nCPY gen.txt final.txt\n", ""},
+		{"async joined by other group", "*CPY --group=gen in.txt gen.txt\nWAIT docs\nCPY gen.txt final.txt\n", "async-race@3"},
+		{"async joined by AFTER", "ID gen\n*CPY in.txt gen.txt\nAFTER gen\nCPY gen.txt final.txt\n", ""},
+		{"CMD not last", "CMD echo done\nRUN make\n", "cmd-not-last@1"},
+		{"CMD last", "RUN make\nCMD echo done\n", ""},
+		{"CMD last in each branch", "ARG A=1\nIF $A == 1\nCMD echo a\nELSE\nCMD echo b\nEND\n", ""},
+		{"CMD not last in branch", "ARG A=1\nIF $A == 1\nCMD echo a\nRUN make\nEND\nIF $A == 2\nCMD echo b\nEND\nRUN make\n", "cmd-not-last@3,cmd-not-last@7"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, finding := range lintForTest(t, tc.content) {
+				got = append(got, fmt.Sprintf("%s@%d", finding.Rule, finding.Line))
+			}
+			if strings.Join(got, ",") != tc.want {
+				t.Fatalf("findings = %v, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLintSuppressions(t *testing.T) {
+	content := strings.Join([]string{
+		"# jetty:ignore-file duplicate-box",
+		"BOX go golang:1.22",
+		"BOX go golang:1.23",
+		"# jetty:ignore undefined-variable",
+		"RUN echo $A",
+		"# jetty:ignore",
+		"DEP go.sum",
+		"RUN echo $B",
+		"# jetty:ignore not-a-rule",
+		"RUN echo",
+		"",
+	}, "\n")
+	findings := lintForTest(t, content)
+	if got := strings.Join(findingRules(findings), ","); got != "undefined-variable,lint-ignore-unknown" {
+		t.Fatalf("findings = %#v", findings)
+	}
+	if findings[0].Line != 8 || findings[1].Line != 9 || findings[1].Column != 1 {
+		t.Fatalf("unexpected finding lines: %#v", findings)
+	}
+}
+
+func TestLintReportsIncludedFile(t *testing.T) {
+	dir := t.TempDir()
+	writeIncludeFiles(t, dir, map[string]string{
+		"Jettyfile": "ENV MODE=dev\n# jetty:ignore orphan-cache-decl\nINC lib.jetty\n",
+		"lib.jetty": "\nARG MODE=release\nDEP go.sum\n",
+	})
+	findings, err := lintFile(filepath.Join(dir, "Jettyfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 1 || findings[0].Rule != "arg-shadows-env" || findings[0].File != "lib.jetty" || findings[0].Line != 2 {
+		t.Fatalf("unexpected findings: %#v", findings)
+	}
+}
+
+func TestWriteLintFindings(t *testing.T) {
+	findings := []lintFinding{
+		{Rule: "cmd-not-last", File: "Jettyfile", Line: 3, Column: 1, Message: "CMD always runs last"},
+		{Rule: "arg-shadows-env", File: "lib.jetty", Line: 2, Message: "ARG shadows ENV"},
+	}
+	var text bytes.Buffer
+	if err := writeLintFindings(&text, findings, "text"); err != nil {
+		t.Fatal(err)
+	}
+	want := "Jettyfile:3:1: cmd-not-last: CMD always runs last\nlib.jetty:2: arg-shadows-env: ARG shadows ENV\n"
+	if text.String() != want {
+		t.Fatalf("text output = %q, want %q", text.String(), want)
+	}
+
+	var out bytes.Buffer
+	if err := writeLintFindings(&out, nil, "json"); err != nil || strings.TrimSpace(out.String()) != "[]" {
+		t.Fatalf("expected an empty JSON array, got %q (%v)", out.String(), err)
+	}
+	if err := writeLintFindings(&out, findings, "yaml"); err == nil {
+		t.Fatal("expected an unknown format to be rejected")
+	}
+}
+
+func TestLintCommand(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "Jettyfile")
+	if err := os.WriteFile(fileName, []byte("CMD echo done\nRUN make\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := captureStdout(t)
+	err := handleSubcommands(context.Background(), []string{"lint", "--format", "json", fileName})
+	if err == nil || !strings.Contains(err.Error(), "lint found 1 problem(s)") {
+		t.Fatalf("expected lint to fail, got %v", err)
+	}
+	var findings []lintFinding
+	if err := json.Unmarshal(output.Bytes(), &findings); err != nil {
+		t.Fatalf("invalid JSON output %q: %v", output.String(), err)
+	}
+	if len(findings) != 1 || findings[0].Rule != "cmd-not-last" || findings[0].Line != 1 {
+		t.Fatalf("unexpected findings: %#v", findings)
+	}
+
+	if err := os.WriteFile(fileName, []byte("RUN make\nCMD echo done\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := handleSubcommands(context.Background(), []string{"lint", fileName}); err != nil {
+		t.Fatalf("expected a clean file to pass, got %v", err)
+	}
+}
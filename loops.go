@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var loopHeaderPattern = regexp.MustCompile(`(?s)^(\S+)\s+IN(?:\s+(.*))?$`)
+
+// loopHeader is a parsed `FOR name IN items...` or `FOR name IN GLOB
+// patterns...` header. The item list is kept unexpanded until the loop runs.
+type loopHeader struct {
+	name  string
+	items string
+	glob  bool
+}
+
+func parseLoopHeader(args string) (loopHeader, error) {
+	match := loopHeaderPattern.FindStringSubmatch(strings.TrimSpace(args))
+	if match == nil {
+		return loopHeader{}, fmt.Errorf("invalid FOR header, expected FOR name IN items...")
+	}
+	header := loopHeader{name: match[1], items: strings.TrimSpace(match[2])}
+	if !isValidName(header.name) {
+		return loopHeader{}, fmt.Errorf("invalid FOR variable name: %s", header.name)
+	}
+	if rest, ok := strings.CutPrefix(header.items, "GLOB"); ok && (rest == "" || strings.TrimLeft(rest, " \t\n") != rest) {
+		header.glob = true
+		header.items = strings.TrimSpace(rest)
+		if header.items == "" {
+			return loopHeader{}, fmt.Errorf("FOR %s IN GLOB requires at least one pattern", header.name)
+		}
+	}
+	if _, err := splitArgs(header.items); err != nil {
+		return loopHeader{}, err
+	}
+	return header, nil
+}
+
+// loopItems expands the header's item list against state. Variables are
+// expanded before splitting, so `FOR svc IN $SERVICES` iterates over each
+// word of SERVICES. GLOB patterns are matched relative to the working
+// directory and yield paths in the same form they were written.
+func (header loopHeader) loopItems(state *BuildState) ([]string, error) {
+	expanded, err := state.expand(header.items)
+	if err != nil {
+		return nil, err
+	}
+	items, err := splitArgs(expanded)
+	if err != nil {
+		return nil, err
+	}
+	if !header.glob {
+		return items, nil
+	}
+	var matches []string
+	for _, pattern := range items {
+		found, err := filepath.Glob(state.resolvePath(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid GLOB pattern %s: %w", pattern, err)
+		}
+		for _, match := range found {
+			if !filepath.IsAbs(pattern) {
+				if rel, err := filepath.Rel(state.WorkDir, match); err == nil {
+					match = rel
+				}
+			}
+			matches = append(matches, match)
+		}
+	}
+	return matches, nil
+}
+
+// runLoop executes a FOR block's body once per item. Each iteration runs on
+// a snapshot of the build state with the loop variable bound in its cloned
+// Args, so changes made inside the body do not leak between iterations. Async
+// instructions in the body are launched per iteration through the runner and
+// so fan out under the shared asyncSemaphore.
+func (runner *instructionRunner) runLoop(state *BuildState, inst Instruction) error {
+	header, err := parseLoopHeader(inst.Args)
+	if err != nil {
+		return err
+	}
+	items, err := header.loopItems(state)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		iteration := state.snapshot()
+		iteration.Args[header.name] = item
+		state.log("FOR %s=%s", header.name, item)
+		if err := runner.run(iteration, inst.Body); err != nil {
+			return fmt.Errorf("%s=%s: %w", header.name, item, err)
+		}
+	}
+	state.PendingDeps = nil
+	state.PendingOuts = nil
+	state.CurrentCacheKey = ""
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLoopHeader(t *testing.T) {
+	header, err := parseLoopHeader("svc IN api web \"worker pool\"")
+	if err != nil {
+		t.Fatalf("parseLoopHeader returned error: %v", err)
+	}
+	if header.name != "svc" || header.glob || header.items != "api web \"worker pool\"" {
+		t.Fatalf("unexpected header: %#v", header)
+	}
+
+	header, err = parseLoopHeader("f IN GLOB src/*.proto")
+	if err != nil {
+		t.Fatalf("parseLoopHeader returned error: %v", err)
+	}
+	if !header.glob || header.items != "src/*.proto" {
+		t.Fatalf("expected GLOB header, got %#v", header)
+	}
+
+	header, err = parseLoopHeader("g IN GLOBAL")
+	if err != nil || header.glob {
+		t.Fatalf("expected GLOBAL to be a plain item, got %#v (err %v)", header, err)
+	}
+
+	for _, args := range []string{"svc api web", "1bad IN a", "f IN GLOB", "svc IN \"open"} {
+		if _, err := parseLoopHeader(args); err == nil {
+			t.Errorf("parseLoopHeader(%q) expected an error", args)
+		}
+	}
+}
+
+func TestBuildExpandsLoopBodies(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	if err := os.MkdirAll(filepath.Join(dir, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.proto", "b.proto", "skip.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, "src", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"ARG SERVICES=api web",
+		"DIR out",
+		"FOR svc IN $SERVICES worker",
+		"  *RUN printf '%s' $svc > out/$svc.txt",
+		"  ARG LEAKED=$svc",
+		"END",
+		"FOR f IN GLOB src/*.proto",
+		"  CPY $f out/$f",
+		"END",
+		"CMD echo leaked=$LEAKED",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, _, err := runBuildForTest(t, buildFile)
+	if err != nil {
+		t.Fatalf("build returned error: %v\noutput:\n%s", err, strings.Join(output, "\n"))
+	}
+	for _, svc := range []string{"api", "web", "worker"} {
+		assertFileContent(t, filepath.Join(dir, "out", svc+".txt"), svc)
+	}
+	assertFileContent(t, filepath.Join(dir, "out", "src", "a.proto"), "a.proto")
+	assertFileContent(t, filepath.Join(dir, "out", "src", "b.proto"), "b.proto")
+	if _, err := os.Stat(filepath.Join(dir, "out", "src", "skip.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected GLOB to skip non-matching files, stat err = %v", err)
+	}
+	// ARGs set inside an iteration are scoped to it.
+	if joinedOutputContains(output, "leaked=worker") || !joinedOutputContains(output, "CMD: leaked=") {
+		t.Fatalf("expected loop-scoped ARG not to leak, got %q", output)
+	}
+}
+
+func TestBuildLoopFailureReportsIteration(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"FOR name IN present missing",
+		"  WDR $name",
+		"END",
+		"",
+	}, "\n")
+	if err := os.Mkdir(filepath.Join(dir, "present"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := runBuildForTest(t, buildFile)
+	if err == nil || !strings.Contains(err.Error(), "name=missing") {
+		t.Fatalf("expected failure naming the iteration, got %v", err)
+	}
+}
@@ -0,0 +1,747 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// directiveDoc is the hover documentation for a directive.
+type directiveDoc struct {
+	Syntax      string
+	Description string
+}
+
+// directiveDocs documents every directive in directiveSymbols.
+var directiveDocs = map[string]directiveDoc{
+	"ARG":   {"ARG [--type=T] [--desc=text] [--required] KEY[=value]", "Defines a build argument. A value passed with `--build-arg` takes precedence over the default; without a default the argument is required, and the build fails before it starts unless it is passed in or set earlier. `--type` is string, int, bool, path or enum:a,b; `--required` states that there is no default."},
+	"ENV":   {"ENV KEY=value", "Defines an environment variable for the rest of the build."},
+	"RUN":   {"RUN command", "Runs a shell command on the host. `$RUN NAME command` stores its trimmed output in an environment variable and `&RUN NAME command` in a build argument; `--status=CODE` also stores the exit code and keeps a failing command from failing the build."},
+	"CMD":   {"CMD command", "Runs a shell command once, after all other instructions and background tasks finish. Only one is allowed per file."},
+	"DEP":   {"DEP path...", "Declares the input files of the next cacheable `RUN`, `CPY` or `USE` step. Their contents form its cache key."},
+	"OUT":   {"OUT path...", "Declares the files the next cacheable step produces. The step is skipped as `CACHED` when its inputs and outputs are unchanged, or as `RESTORED` when missing outputs are restored from the cache."},
+	"DIR":   {"DIR path", "Creates a directory and its parents within the build workspace."},
+	"CPY":   {"CPY src dest", "Copies a file or directory."},
+	"WDR":   {"WDR path", "Changes the working directory for later instructions."},
+	"SUB":   {"SUB target", "Runs another Jettyfile, local or imported with `github.com/owner/repo[@ref][/path]`, as a sub-build."},
+	"FRM":   {"FRM image[:tag]", "Sets the default Docker image for `USE`."},
+	"JET":   {"JET plugin [args...]", "Runs a Jetty plugin from the `plugins/` directory or an absolute path."},
+	"FMT":   {"FMT format args...", "Formats a string into the build log. `^FMT file` appends it to a file, `$FMT NAME` assigns it to an environment variable and `&FMT NAME` to a build argument."},
+	"BOX":   {"BOX name image[:tag]", "Names a Docker image for `USE`."},
+	"USE":   {"USE [box] command", "Runs a command in a Docker container with the workspace mounted, using the named box or the `FRM` image."},
+	"TGT":   {"TGT name [deps...]", "Starts a target. The instructions up to the next `TGT` belong to it, and its dependencies run first."},
+	"IF":    {"IF cond", "Runs the instructions up to `ELSE` or `END` only when the condition holds."},
+	"ELSE":  {"ELSE", "Starts the branch of an `IF` block that runs when the condition does not hold."},
+	"END":   {"END", "Closes an `IF`, `FOR` or `DEF` block."},
+	"FOR":   {"FOR name IN items...", "Runs the instructions up to `END` once per item with `$name` bound. `FOR name IN GLOB patterns...` iterates over matching paths."},
+	"ID":    {"ID name", "Labels the next step so `AFTER` can refer to it."},
+	"AFTER": {"AFTER name...", "Makes the next step wait until the named steps finish."},
+	"WAIT":  {"WAIT [group...]", "Waits for earlier async instructions, or only those tagged with one of the groups, and fails the build if any of them failed."},
+	"INC":   {"INC path", "Splices the instructions of another Jettyfile, local or GitHub-imported, into this one at parse time."},
+	"DEF":   {"DEF name [param...]", "Defines a macro, closed by `END`."},
+	"CALL":  {"CALL name [arg...]", "Runs a macro with its parameters bound to the arguments."},
+	"SHELL": {`SHELL ["program", "arg"...]`, "Sets the program later `RUN`, `CMD` and `USE` scripts run with; the script is passed as the last argument. The default is `sh -c`."},
+}
+
+// JSON-RPC and LSP constants used by the language server.
+const (
+	lspParseErrorCode     = -32700
+	lspMethodNotFoundCode = -32601
+	lspInternalErrorCode  = -32603
+	lspSeverityError      = 1
+	lspSeverityWarning    = 2
+	lspCompletionKeyword  = 14
+	lspTextDocumentFull   = 1
+)
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *lspError) Error() string {
+	return err.Message
+}
+
+type lspRequest struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type lspResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result"`
+}
+
+type lspErrorResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   *lspError       `json:"error"`
+}
+
+type lspNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Code     string   `json:"code,omitempty"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspMarkupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type lspHover struct {
+	Contents lspMarkupContent `json:"contents"`
+	Range    lspRange         `json:"range"`
+}
+
+type lspCompletionItem struct {
+	Label         string           `json:"label"`
+	Kind          int              `json:"kind"`
+	Detail        string           `json:"detail,omitempty"`
+	Documentation lspMarkupContent `json:"documentation"`
+	TextEdit      lspTextEdit      `json:"textEdit"`
+}
+
+type lspTextDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+type lspPositionParams struct {
+	TextDocument lspTextDocumentIdentifier `json:"textDocument"`
+	Position     lspPosition               `json:"position"`
+}
+
+// lspServer serves one language client. Open documents are kept by URI with
+// their full text.
+type lspServer struct {
+	ctx       context.Context
+	writer    io.Writer
+	documents map[string]string
+	// includes caches remote INC files by URL, so diagnosing a document on
+	// every change does not download them again.
+	includes map[string]lspInclude
+	shutdown bool
+}
+
+// lspInclude is a cached remote include, or the error fetching it.
+type lspInclude struct {
+	content []byte
+	err     error
+	fetched time.Time
+}
+
+const (
+	// lspIncludeTimeout bounds how long diagnostics wait for a remote INC.
+	lspIncludeTimeout = 5 * time.Second
+	// lspIncludeTTL is how long a fetched remote INC, or a failure to fetch
+	// it, is reused.
+	lspIncludeTTL = 5 * time.Minute
+)
+
+// serveLSP speaks the Language Server Protocol over in and out until the
+// client sends exit, closes in, or ctx is done.
+func serveLSP(ctx context.Context, in io.Reader, out io.Writer) error {
+	server := &lspServer{ctx: ctx, writer: out, documents: make(map[string]string), includes: make(map[string]lspInclude)}
+	reader := bufio.NewReader(in)
+	for {
+		body, err := readLSPMessage(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var request lspRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			if err := server.send(lspErrorResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &lspError{Code: lspParseErrorCode, Message: err.Error()}}); err != nil {
+				return err
+			}
+			continue
+		}
+		if request.Method == "exit" {
+			if !server.shutdown {
+				return fmt.Errorf("language client exited without shutdown")
+			}
+			return nil
+		}
+		result, err := server.handle(request)
+		if len(request.ID) == 0 {
+			if err != nil {
+				logger.Printf("lsp: %s: %v", request.Method, err)
+			}
+			continue
+		}
+		if err != nil {
+			var rpcErr *lspError
+			if !errors.As(err, &rpcErr) {
+				rpcErr = &lspError{Code: lspInternalErrorCode, Message: err.Error()}
+			}
+			err = server.send(lspErrorResponse{JSONRPC: "2.0", ID: request.ID, Error: rpcErr})
+		} else {
+			err = server.send(lspResponse{JSONRPC: "2.0", ID: request.ID, Result: result})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readLSPMessage reads one Content-Length framed message.
+func readLSPMessage(reader *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid Content-Length %q", strings.TrimSpace(value))
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("message without Content-Length header")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (s *lspServer) send(message any) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.writer, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+func (s *lspServer) handle(request lspRequest) (any, error) {
+	switch request.Method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":           map[string]any{"openClose": true, "change": lspTextDocumentFull},
+				"completionProvider":         map[string]any{},
+				"hoverProvider":              true,
+				"definitionProvider":         true,
+				"documentFormattingProvider": true,
+			},
+			"serverInfo": map[string]any{"name": "jetty", "version": version},
+		}, nil
+	case "initialized":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, err
+		}
+		return nil, s.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument   lspTextDocumentIdentifier `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, err
+		}
+		if len(params.ContentChanges) == 0 {
+			return nil, nil
+		}
+		return nil, s.update(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+	case "textDocument/didClose":
+		var params struct {
+			TextDocument lspTextDocumentIdentifier `json:"textDocument"`
+		}
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, err
+		}
+		delete(s.documents, params.TextDocument.URI)
+		return nil, s.publishDiagnostics(params.TextDocument.URI, []lspDiagnostic{})
+	case "textDocument/completion":
+		var params lspPositionParams
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, err
+		}
+		return lspCompletions(s.documents[params.TextDocument.URI], params.Position), nil
+	case "textDocument/hover":
+		var params lspPositionParams
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, err
+		}
+		return lspHoverAt(s.documents[params.TextDocument.URI], params.Position), nil
+	case "textDocument/definition":
+		var params lspPositionParams
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, err
+		}
+		uri := params.TextDocument.URI
+		return lspDefinitions(uriToPath(uri), uri, s.documents[uri], params.Position), nil
+	case "textDocument/formatting":
+		var params struct {
+			TextDocument lspTextDocumentIdentifier `json:"textDocument"`
+		}
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, err
+		}
+		return lspFormat(s.documents[params.TextDocument.URI]), nil
+	}
+	if strings.HasPrefix(request.Method, "$/") {
+		return nil, nil
+	}
+	return nil, &lspError{Code: lspMethodNotFoundCode, Message: "method not found: " + request.Method}
+}
+
+// update stores the text of a document and publishes its diagnostics.
+func (s *lspServer) update(uri string, text string) error {
+	s.documents[uri] = text
+	return s.publishDiagnostics(uri, lspDiagnose(uriToPath(uri), text, s.fetchInclude(s.ctx)))
+}
+
+func (s *lspServer) publishDiagnostics(uri string, diagnostics []lspDiagnostic) error {
+	return s.send(lspNotification{
+		JSONRPC: "2.0",
+		Method:  "textDocument/publishDiagnostics",
+		Params:  map[string]any{"uri": uri, "diagnostics": diagnostics},
+	})
+}
+
+// fetchInclude returns a fetcher for the remote includes of one request. A
+// file is downloaded at most once per lspIncludeTTL, each download is
+// cancelled with ctx and limited to lspIncludeTimeout, and failures are
+// cached like content so a server that is down does not stall every change.
+func (s *lspServer) fetchInclude(ctx context.Context) remoteFetcher {
+	return func(url string) ([]byte, error) {
+		if cached, ok := s.includes[url]; ok && time.Since(cached.fetched) < lspIncludeTTL {
+			return cached.content, cached.err
+		}
+		fetchCtx, cancel := context.WithTimeout(ctx, lspIncludeTimeout)
+		defer cancel()
+		content, err := fetchRemoteJettyfile(fetchCtx, url)
+		if ctx.Err() == nil {
+			s.includes[url] = lspInclude{content: content, err: err, fetched: time.Now()}
+		}
+		return content, err
+	}
+}
+
+// errorLinePattern matches the `line N:` prefix of parse and validation
+// errors.
+var errorLinePattern = regexp.MustCompile(`^line (\d+): `)
+
+// lspDiagnose parses, validates and lints the text of fileName. A syntax or
+// validation error is reported as the only error; otherwise every lint
+// finding is a warning. Findings in included files are reported on the INC
+// line.
+func lspDiagnose(fileName string, text string, fetch remoteFetcher) []lspDiagnostic {
+	lines := strings.Split(text, "\n")
+	findings, err := lintSourceWith(fileName, []byte(text), fetch)
+	if err == nil {
+		// Remote includes come from the server's cache the second time.
+		var instructions []Instruction
+		if instructions, err = parseSourceWith(strings.NewReader(text), fileName, fetch); err == nil {
+			err = validateBuild(instructions)
+		}
+	}
+	if err != nil {
+		line, column, message := 1, 0, err.Error()
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) && parseErr.Pos.File == fileName {
+			line, column, message = parseErr.Pos.Line, parseErr.Pos.Column, parseErr.Err.Error()
+		} else if match := errorLinePattern.FindStringSubmatch(message); match != nil {
+			line, _ = strconv.Atoi(match[1])
+			message = message[len(match[0]):]
+		}
+		return []lspDiagnostic{{Range: lineRange(lines, line, column), Severity: lspSeverityError, Source: "jetty", Message: message}}
+	}
+	diagnostics := []lspDiagnostic{}
+	for _, finding := range findings {
+		line, column, message := finding.Line, finding.Column, finding.Message
+		if finding.File != fileName {
+			line, column = finding.line, 0
+			message = fmt.Sprintf("%s:%d: %s", finding.File, finding.Line, finding.Message)
+		}
+		diagnostics = append(diagnostics, lspDiagnostic{
+			Range:    lineRange(lines, line, column),
+			Severity: lspSeverityWarning,
+			Code:     finding.Rule,
+			Source:   "jetty",
+			Message:  message,
+		})
+	}
+	return diagnostics
+}
+
+// lineRange spans a 1-based line from the 1-based byte column, or from its
+// first non-blank character when column is 0, to the end of the line.
+func lineRange(lines []string, line int, column int) lspRange {
+	if line < 1 || line > len(lines) {
+		return lspRange{}
+	}
+	text := strings.TrimRight(lines[line-1], " \t\r")
+	if column == 0 {
+		column = len(text) - len(strings.TrimLeft(text, " \t")) + 1
+	}
+	return lspRange{
+		Start: lspPosition{Line: line - 1, Character: lspCharacter(text, column)},
+		End:   lspPosition{Line: line - 1, Character: lspCharacter(text, len(text)+1)},
+	}
+}
+
+// lspCharacter converts a 1-based byte column on line into the UTF-16 offset
+// LSP positions use.
+func lspCharacter(line string, column int) int {
+	if column-1 > len(line) {
+		column = len(line) + 1
+	}
+	return len(utf16.Encode([]rune(line[:column-1])))
+}
+
+// byteColumn converts a UTF-16 offset on line into a 1-based byte column.
+func byteColumn(line string, character int) int {
+	units := 0
+	for i, r := range line {
+		if units >= character {
+			return i + 1
+		}
+		units += utf16.RuneLen(r)
+	}
+	return len(line) + 1
+}
+
+func lspTokenRange(lines []string, token Token) lspRange {
+	return lspRange{Start: toLSPPosition(lines, token.Start), End: toLSPPosition(lines, token.End)}
+}
+
+func toLSPPosition(lines []string, pos Position) lspPosition {
+	if pos.Line < 1 || pos.Line > len(lines) {
+		return lspPosition{}
+	}
+	return lspPosition{Line: pos.Line - 1, Character: lspCharacter(strings.TrimRight(lines[pos.Line-1], "\r"), pos.Column)}
+}
+
+// lspCompletions offers every directive with each modifier it accepts while
+// the cursor is in the first word of an instruction.
+func lspCompletions(text string, position lspPosition) []lspCompletionItem {
+	items := []lspCompletionItem{}
+	lines := strings.Split(text, "\n")
+	if position.Line >= len(lines) {
+		return items
+	}
+	if position.Line > 0 && strings.HasSuffix(strings.TrimRight(lines[position.Line-1], " \t\r"), "\\") {
+		return items
+	}
+	line := strings.TrimRight(lines[position.Line], "\r")
+	prefix := line[:byteColumn(line, position.Character)-1]
+	word := strings.TrimLeft(prefix, " \t")
+	if strings.ContainsAny(word, " \t#") {
+		return items
+	}
+	replace := lspRange{
+		Start: lspPosition{Line: position.Line, Character: lspCharacter(line, len(prefix)-len(word)+1)},
+		End:   position,
+	}
+	directives := make([]string, 0, len(directiveSymbols))
+	for directive := range directiveSymbols {
+		directives = append(directives, directive)
+	}
+	sort.Strings(directives)
+	for _, directive := range directives {
+		for _, symbol := range []string{"", "*", "^", "$", "&"} {
+			if !directiveSymbols[directive][symbol] {
+				continue
+			}
+			doc := directiveDocs[directive]
+			items = append(items, lspCompletionItem{
+				Label:         symbol + directive,
+				Kind:          lspCompletionKeyword,
+				Detail:        doc.Syntax,
+				Documentation: lspMarkupContent{Kind: "markdown", Value: doc.Description},
+				TextEdit:      lspTextEdit{Range: replace, NewText: symbol + directive},
+			})
+		}
+	}
+	return items
+}
+
+// lspHoverAt documents the directive under the cursor.
+func lspHoverAt(text string, position lspPosition) *lspHover {
+	file, err := parseReader("", strings.NewReader(text))
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(text, "\n")
+	node, token := nodeAt(file, lines, position)
+	if node == nil || token != node.Keyword {
+		return nil
+	}
+	doc, ok := directiveDocs[node.Directive]
+	if !ok {
+		return nil
+	}
+	value := "```\n" + doc.Syntax + "\n```\n\n" + doc.Description
+	var modifiers []string
+	for _, symbol := range []string{"*", "^", "$", "&"} {
+		if directiveSymbols[node.Directive][symbol] {
+			modifiers = append(modifiers, "`"+symbol+node.Directive+"`")
+		}
+	}
+	if len(modifiers) > 0 {
+		value += "\n\nModifiers: " + strings.Join(modifiers, ", ")
+	}
+	var options []string
+	for option := range directiveOptions[node.Directive] {
+		options = append(options, "`--"+option+"`")
+	}
+	if len(options) > 0 {
+		sort.Strings(options)
+		value += "\n\nOptions: " + strings.Join(options, ", ")
+	}
+	return &lspHover{Contents: lspMarkupContent{Kind: "markdown", Value: value}, Range: lspTokenRange(lines, node.Keyword)}
+}
+
+// nodeAt returns the instruction and word under an LSP position.
+func nodeAt(file *SourceFile, lines []string, position lspPosition) (*Node, Token) {
+	if position.Line >= len(lines) {
+		return nil, Token{}
+	}
+	pos := Position{Line: position.Line + 1, Column: byteColumn(strings.TrimRight(lines[position.Line], "\r"), position.Character)}
+	before := func(a Position, b Position) bool {
+		return a.Line < b.Line || (a.Line == b.Line && a.Column <= b.Column)
+	}
+	for _, node := range file.Nodes {
+		if !before(node.Start, pos) || !before(pos, node.End) {
+			continue
+		}
+		tokens := append([]Token{node.Keyword}, node.Options...)
+		for _, token := range append(tokens, node.Args...) {
+			if before(token.Start, pos) && before(pos, token.End) {
+				return node, token
+			}
+		}
+		return node, Token{}
+	}
+	return nil, Token{}
+}
+
+// lspDefinitions finds the definitions of the name under the cursor: the
+// ARG and ENV instructions of a `$NAME` reference, the BOX of a USE box
+// name, or the local file of a SUB or INC path.
+func lspDefinitions(fileName string, uri string, text string, position lspPosition) []lspLocation {
+	locations := []lspLocation{}
+	file, err := parseReader("", strings.NewReader(text))
+	if err != nil {
+		return locations
+	}
+	lines := strings.Split(text, "\n")
+	node, token := nodeAt(file, lines, position)
+	if node == nil || token.Raw == "" || token == node.Keyword {
+		return locations
+	}
+	switch {
+	case (node.Directive == "SUB" || node.Directive == "INC") && len(node.Args) == 1 && token == node.Args[0]:
+		if target, ok := localJettyfilePath(fileName, token.Value); ok {
+			locations = append(locations, lspLocation{URI: pathToURI(target)})
+		}
+		return locations
+	case node.Directive == "USE" && len(node.Args) > 0 && token == node.Args[0]:
+		for _, box := range file.Nodes {
+			if box.Directive == "BOX" && len(box.Args) > 0 && box.Args[0].Value == token.Value {
+				locations = append(locations, lspLocation{URI: uri, Range: lspTokenRange(lines, box.Args[0])})
+			}
+		}
+		if len(locations) > 0 {
+			return locations
+		}
+	}
+	if token.Start.Line != position.Line+1 {
+		return locations
+	}
+	cursor := byteColumn(strings.TrimRight(lines[position.Line], "\r"), position.Character) - token.Start.Column
+	name := variableAt(token.Raw, cursor)
+	if name == "" {
+		return locations
+	}
+	for _, def := range file.Nodes {
+		if (def.Directive != "ARG" && def.Directive != "ENV") || len(def.Args) == 0 {
+			continue
+		}
+		key, _, _ := strings.Cut(def.Args[0].Value, "=")
+		if key != name {
+			continue
+		}
+		start := def.Args[0].Start
+		end := start
+		end.Column += len(key)
+		locations = append(locations, lspLocation{URI: uri, Range: lspRange{Start: toLSPPosition(lines, start), End: toLSPPosition(lines, end)}})
+	}
+	return locations
+}
+
+// localJettyfilePath resolves a SUB or INC path relative to the Jettyfile
+// that names it. Remote imports and paths with variables are not resolved.
+func localJettyfilePath(fileName string, arg string) (string, bool) {
+	if strings.Contains(arg, "$") {
+		return "", false
+	}
+	if githubURL, err := parseGithubImport(arg); err != nil || githubURL != "" {
+		return "", false
+	}
+	path := arg
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(fileName), path)
+	}
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		return "", false
+	}
+	return path, true
+}
+
+// variableAt returns the name of the `$NAME` or `${NAME...}` reference in raw
+// that covers offset, or "" when there is none.
+func variableAt(raw string, offset int) string {
+	for i := 0; i < len(raw); i++ {
+		if raw[i] != '$' || i+1 >= len(raw) {
+			continue
+		}
+		if raw[i+1] == '$' {
+			i++
+			continue
+		}
+		start := i + 1
+		braced := raw[start] == '{'
+		if braced {
+			start++
+			if start < len(raw) && raw[start] == '#' {
+				start++
+			}
+		}
+		end := start
+		if end < len(raw) && isNameStart(raw[end]) {
+			for end < len(raw) && isNameByte(raw[end]) {
+				end++
+			}
+		}
+		if end == start {
+			continue
+		}
+		last := end
+		if braced {
+			if closing := strings.IndexByte(raw[end:], '}'); closing >= 0 {
+				last = end + closing + 1
+			}
+		}
+		if offset >= i && offset <= last {
+			return raw[start:end]
+		}
+		i = last - 1
+	}
+	return ""
+}
+
+// lspFormat replaces the whole document with its jetty fmt form. Documents
+// that do not parse are left alone.
+func lspFormat(text string) []lspTextEdit {
+	edits := []lspTextEdit{}
+	file, err := parseReader("", strings.NewReader(text))
+	if err != nil {
+		return edits
+	}
+	formatted, err := formatSource(file)
+	if err != nil || bytes.Equal(formatted, []byte(text)) {
+		return edits
+	}
+	lines := strings.Split(text, "\n")
+	last := len(lines) - 1
+	end := lspPosition{Line: last, Character: len(utf16.Encode([]rune(lines[last])))}
+	return append(edits, lspTextEdit{Range: lspRange{End: end}, NewText: string(formatted)})
+}
+
+// uriToPath converts a file:// URI into a local path. Other URIs are
+// returned unchanged.
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	path := u.Path
+	if runtime.GOOS == "windows" {
+		path = strings.TrimPrefix(path, "/")
+	}
+	return filepath.FromSlash(path)
+}
+
+func pathToURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	slashed := filepath.ToSlash(path)
+	if !strings.HasPrefix(slashed, "/") {
+		slashed = "/" + slashed
+	}
+	return (&url.URL{Scheme: "file", Path: slashed}).String()
+}
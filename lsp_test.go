@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func lspFrame(t *testing.T, message map[string]any) string {
+	t.Helper()
+	message["jsonrpc"] = "2.0"
+	body, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func readLSPOutput(t *testing.T, output []byte) []map[string]any {
+	t.Helper()
+	reader := bufio.NewReader(bytes.NewReader(output))
+	var messages []map[string]any
+	for {
+		body, err := readLSPMessage(reader)
+		if err != nil {
+			return messages
+		}
+		var message map[string]any
+		if err := json.Unmarshal(body, &message); err != nil {
+			t.Fatalf("invalid message %q: %v", body, err)
+		}
+		messages = append(messages, message)
+	}
+}
+
+func TestServeLSPSession(t *testing.T) {
+	uri := pathToURI(filepath.Join(t.TempDir(), "Jettyfile"))
+	input := strings.Join([]string{
+		lspFrame(t, map[string]any{"id": 1, "method": "initialize", "params": map[string]any{}}),
+		lspFrame(t, map[string]any{"method": "initialized", "params": map[string]any{}}),
+		lspFrame(t, map[string]any{"method": "textDocument/didOpen", "params": map[string]any{
+			"textDocument": map[string]any{"uri": uri, "languageId": "jetty", "version": 1, "text": "run  echo hi\nNOPE x\n"},
+		}}),
+		lspFrame(t, map[string]any{"method": "textDocument/didChange", "params": map[string]any{
+			"textDocument":   map[string]any{"uri": uri, "version": 2},
+			"contentChanges": []any{map[string]any{"text": "run  echo hi\n"}},
+		}}),
+		lspFrame(t, map[string]any{"id": 2, "method": "textDocument/formatting", "params": map[string]any{
+			"textDocument": map[string]any{"uri": uri},
+		}}),
+		lspFrame(t, map[string]any{"id": 3, "method": "workspace/symbol", "params": map[string]any{}}),
+		lspFrame(t, map[string]any{"id": 4, "method": "shutdown"}),
+		lspFrame(t, map[string]any{"method": "exit"}),
+	}, "")
+	var output bytes.Buffer
+	if err := serveLSP(context.Background(), strings.NewReader(input), &output); err != nil {
+		t.Fatalf("serveLSP returned error: %v", err)
+	}
+	messages := readLSPOutput(t, output.Bytes())
+	if len(messages) != 6 {
+		t.Fatalf("expected 6 messages, got %d: %v", len(messages), messages)
+	}
+
+	capabilities := messages[0]["result"].(map[string]any)["capabilities"].(map[string]any)
+	for _, capability := range []string{"completionProvider", "hoverProvider", "definitionProvider", "documentFormattingProvider"} {
+		if capabilities[capability] == nil {
+			t.Errorf("initialize result lacks %s: %v", capability, capabilities)
+		}
+	}
+
+	opened := messages[1]["params"].(map[string]any)
+	diagnostics := opened["diagnostics"].([]any)
+	if messages[1]["method"] != "textDocument/publishDiagnostics" || opened["uri"] != uri || len(diagnostics) != 1 {
+		t.Fatalf("unexpected diagnostics after open: %v", messages[1])
+	}
+	if message := diagnostics[0].(map[string]any)["message"]; message != "invalid directive: NOPE" {
+		t.Fatalf("unexpected diagnostic message %v", message)
+	}
+	if changed := messages[2]["params"].(map[string]any)["diagnostics"].([]any); len(changed) != 0 {
+		t.Fatalf("expected no diagnostics after the fix, got %v", changed)
+	}
+
+	edits := messages[3]["result"].([]any)
+	if len(edits) != 1 || edits[0].(map[string]any)["newText"] != "RUN echo hi\n" {
+		t.Fatalf("unexpected formatting edits: %v", messages[3])
+	}
+	if code := messages[4]["error"].(map[string]any)["code"]; code != float64(lspMethodNotFoundCode) {
+		t.Fatalf("expected method not found, got %v", messages[4])
+	}
+	if _, ok := messages[5]["result"]; !ok || messages[5]["id"] != float64(4) {
+		t.Fatalf("unexpected shutdown response: %v", messages[5])
+	}
+}
+
+func TestServeLSPExitWithoutShutdown(t *testing.T) {
+	input := lspFrame(t, map[string]any{"method": "exit"})
+	if err := serveLSP(context.Background(), strings.NewReader(input), &bytes.Buffer{}); err == nil {
+		t.Fatal("expected exit without shutdown to fail")
+	}
+}
+
+func TestLSPDiagnose(t *testing.T) {
+	dir := t.TempDir()
+	writeIncludeFiles(t, dir, map[string]string{
+		"lib.jetty": "DEP go.sum\n",
+	})
+	fileName := filepath.Join(dir, "Jettyfile")
+
+	diagnostics := lspDiagnose(fileName, "IF $A == 1\n  RUN echo\n", nil)
+	if len(diagnostics) != 1 || diagnostics[0].Severity != lspSeverityError || diagnostics[0].Message != "unterminated IF block" || diagnostics[0].Range.Start.Line != 0 {
+		t.Fatalf("unexpected block diagnostics: %#v", diagnostics)
+	}
+
+	for _, tc := range []struct {
+		text    string
+		line    int
+		message string
+	}{
+		{"TGT build test\nRUN make\n", 0, "target build depends on unknown target test"},
+		{"RUN echo\nAFTER missing\nRUN make\n", 2, "AFTER references unknown step missing"},
+		{"ID a\nAFTER b\n*RUN echo a\nAFTER a\nRUN echo s\nID b\nRUN echo b\n", 4, "synchronous step cannot wait for step a"},
+	} {
+		diagnostics = lspDiagnose(fileName, tc.text, nil)
+		if len(diagnostics) != 1 || diagnostics[0].Severity != lspSeverityError || diagnostics[0].Range.Start.Line != tc.line || !strings.HasPrefix(diagnostics[0].Message, tc.message) {
+			t.Fatalf("unexpected validation diagnostics for %q: %#v", tc.text, diagnostics)
+		}
+	}
+
+	diagnostics = lspDiagnose(fileName, "RUN echo\n  CMD echo héllo\nRUN make\nINC lib.jetty\n", nil)
+	if len(diagnostics) != 2 {
+		t.Fatalf("expected 2 diagnostics, got %#v", diagnostics)
+	}
+	cmd := diagnostics[0]
+	if cmd.Code != "cmd-not-last" || cmd.Severity != lspSeverityWarning || cmd.Range != (lspRange{Start: lspPosition{1, 2}, End: lspPosition{1, 16}}) {
+		t.Fatalf("unexpected CMD diagnostic: %#v", cmd)
+	}
+	inc := diagnostics[1]
+	if inc.Code != "orphan-cache-decl" || inc.Range.Start.Line != 3 || !strings.HasPrefix(inc.Message, "lib.jetty:1: ") {
+		t.Fatalf("unexpected included diagnostic: %#v", inc)
+	}
+}
+
+func TestLSPCachesRemoteIncludes(t *testing.T) {
+	var requests atomic.Int32
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		fmt.Fprint(w, "DEF greet name\n  RUN echo $name\nEND\n")
+	}))
+	defer remote.Close()
+	server := &lspServer{ctx: context.Background(), includes: make(map[string]lspInclude)}
+	fileName := filepath.Join(t.TempDir(), "Jettyfile")
+	text := "INC github.com/owner/repo/lib.jetty\nCALL greet world\n"
+
+	// Serve the GitHub URL from the test server.
+	fetch := server.fetchInclude(server.ctx)
+	remoteLib := func(url string) ([]byte, error) {
+		return fetch(remote.URL + "/lib.jetty")
+	}
+	for i := 0; i < 3; i++ {
+		if diagnostics := lspDiagnose(fileName, text, remoteLib); len(diagnostics) != 0 {
+			t.Fatalf("expected the remote macro to resolve, got %#v", diagnostics)
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Fatalf("expected the remote include to be fetched once, got %d", got)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := server.fetchInclude(cancelled)(remote.URL + "/other.jetty"); err == nil {
+		t.Fatal("expected a cancelled fetch to fail")
+	}
+	if _, ok := server.includes[remote.URL+"/other.jetty"]; ok {
+		t.Fatal("expected a cancelled fetch not to be cached")
+	}
+}
+
+func TestLSPCompletions(t *testing.T) {
+	items := lspCompletions("RUN echo\n  *r", lspPosition{Line: 1, Character: 4})
+	labels := make(map[string]lspCompletionItem)
+	for _, item := range items {
+		labels[item.Label] = item
+	}
+	for _, label := range []string{"*RUN", "RUN", "^FMT", "$FMT", "&FMT", "*CALL"} {
+		if _, ok := labels[label]; !ok {
+			t.Errorf("completions lack %s", label)
+		}
+	}
+	if _, ok := labels["*ARG"]; ok {
+		t.Error("completions offer a modifier ARG does not accept")
+	}
+	if edit := labels["*RUN"].TextEdit; edit.Range.Start != (lspPosition{1, 2}) || edit.Range.End != (lspPosition{1, 4}) {
+		t.Fatalf("unexpected completion edit: %#v", edit)
+	}
+	if items := lspCompletions("RUN ec", lspPosition{Line: 0, Character: 6}); len(items) != 0 {
+		t.Fatalf("expected no completions in arguments, got %d", len(items))
+	}
+	if items := lspCompletions("RUN echo \\\n  ma", lspPosition{Line: 1, Character: 4}); len(items) != 0 {
+		t.Fatalf("expected no completions on a continuation line, got %d", len(items))
+	}
+}
+
+func TestDirectiveDocsCoverDirectives(t *testing.T) {
+	for directive := range directiveSymbols {
+		if directiveDocs[directive].Description == "" {
+			t.Errorf("directive %s has no hover documentation", directive)
+		}
+	}
+}
+
+func TestLSPHover(t *testing.T) {
+	hover := lspHoverAt("ARG A=1\n*run --timeout=5s echo\n", lspPosition{Line: 1, Character: 2})
+	if hover == nil {
+		t.Fatal("expected hover documentation")
+	}
+	for _, want := range []string{"RUN command", "Modifiers: `*RUN`", "`--timeout`"} {
+		if !strings.Contains(hover.Contents.Value, want) {
+			t.Errorf("hover %q lacks %q", hover.Contents.Value, want)
+		}
+	}
+	if hover.Range.Start != (lspPosition{1, 0}) || hover.Range.End != (lspPosition{1, 4}) {
+		t.Fatalf("unexpected hover range: %#v", hover.Range)
+	}
+	if hover := lspHoverAt("ARG A=1\n", lspPosition{Line: 0, Character: 5}); hover != nil {
+		t.Fatalf("expected no hover on arguments, got %#v", hover)
+	}
+}
+
+func TestLSPDefinitions(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "Jettyfile")
+	writeIncludeFiles(t, dir, map[string]string{"sub/Jettyfile": "RUN echo\n"})
+	uri := pathToURI(fileName)
+	text := strings.Join([]string{
+		"ARG NAME=world",
+		"ENV NAME=env",
+		"BOX go golang:1.22",
+		"RUN echo ${NAME:-x} $$NAME",
+		"USE go go build",
+		"SUB sub/Jettyfile",
+		"SUB missing/Jettyfile",
+		"",
+	}, "\n")
+	tests := []struct {
+		name     string
+		position lspPosition
+		want     []lspLocation
+	}{
+		{"variable", lspPosition{3, 13}, []lspLocation{
+			{URI: uri, Range: lspRange{Start: lspPosition{0, 4}, End: lspPosition{0, 8}}},
+			{URI: uri, Range: lspRange{Start: lspPosition{1, 4}, End: lspPosition{1, 8}}},
+		}},
+		{"escaped dollar", lspPosition{3, 23}, []lspLocation{}},
+		{"box", lspPosition{4, 5}, []lspLocation{{URI: uri, Range: lspRange{Start: lspPosition{2, 4}, End: lspPosition{2, 6}}}}},
+		{"sub path", lspPosition{5, 8}, []lspLocation{{URI: pathToURI(filepath.Join(dir, "sub", "Jettyfile"))}}},
+		{"missing sub path", lspPosition{6, 8}, []lspLocation{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := lspDefinitions(fileName, uri, text, tc.position)
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tc.want)
+			if !bytes.Equal(gotJSON, wantJSON) {
+				t.Fatalf("definitions = %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestURIPathRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dir with space", "Jettyfile")
+	uri := pathToURI(path)
+	if !strings.HasPrefix(uri, "file:///") || !strings.Contains(uri, "dir%20with%20space") {
+		t.Fatalf("unexpected URI %q", uri)
+	}
+	if got := uriToPath(uri); got != path {
+		t.Fatalf("uriToPath(%q) = %q, want %q", uri, got, path)
+	}
+}
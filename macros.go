@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseMacroHeader splits the arguments of a `DEF name [param...]` header
+// into the macro name and its parameter names.
+func parseMacroHeader(args string) (string, []string, error) {
+	parts, err := splitArgs(args)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(parts) == 0 {
+		return "", nil, fmt.Errorf("DEF requires a macro name")
+	}
+	if !targetNamePattern.MatchString(parts[0]) {
+		return "", nil, fmt.Errorf("invalid macro name: %s", parts[0])
+	}
+	seen := make(map[string]bool)
+	for _, param := range parts[1:] {
+		if !isValidName(param) {
+			return "", nil, fmt.Errorf("invalid macro parameter name: %s", param)
+		}
+		if seen[param] {
+			return "", nil, fmt.Errorf("duplicate macro parameter: %s", param)
+		}
+		seen[param] = true
+	}
+	return parts[0], parts[1:], nil
+}
+
+// parseCallArgs splits the arguments of a `CALL name [arg...]` instruction.
+// The arguments are expanded when the CALL runs.
+func parseCallArgs(args string) (string, []string, error) {
+	parts, err := splitArgs(args)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(parts) == 0 {
+		return "", nil, fmt.Errorf("CALL requires a macro name")
+	}
+	return parts[0], parts[1:], nil
+}
+
+// bindMacros removes the top-level DEF blocks from instructions and points
+// every CALL, including those inside other macros, at the DEF it names.
+// Calls are checked against the macro's parameter count, and macros may not
+// call themselves directly or indirectly.
+func bindMacros(instructions []Instruction) ([]Instruction, error) {
+	macros := make(map[string]*Instruction)
+	var names []string
+	var remaining []Instruction
+	for _, inst := range instructions {
+		if inst.Directive != "DEF" {
+			remaining = append(remaining, inst)
+			continue
+		}
+		name, _, err := parseMacroHeader(inst.Args)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", inst.location(), err)
+		}
+		if previous, ok := macros[name]; ok {
+			return nil, fmt.Errorf("%s: macro %s is already defined on line %d", inst.location(), name, previous.Line)
+		}
+		if err := checkMacroBody(inst.Body); err != nil {
+			return nil, err
+		}
+		def := inst
+		macros[name] = &def
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if err := linkCalls(macros[name].Body, macros); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkMacroCycles(names, macros); err != nil {
+		return nil, err
+	}
+	if err := linkCalls(remaining, macros); err != nil {
+		return nil, err
+	}
+	return remaining, nil
+}
+
+// checkMacroBody rejects instructions that cannot be repeated per call: a
+// CMD runs once per build and step labels must be unique.
+func checkMacroBody(instructions []Instruction) error {
+	for _, inst := range instructions {
+		if inst.Directive == "CMD" {
+			return fmt.Errorf("%s: CMD is not allowed inside a DEF block", inst.location())
+		}
+		if inst.ID != "" || len(inst.After) > 0 {
+			return fmt.Errorf("%s: ID/AFTER labels are not allowed inside a DEF block", inst.location())
+		}
+		if err := checkMacroBody(inst.Body); err != nil {
+			return err
+		}
+		if err := checkMacroBody(inst.Else); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkCalls sets Macro on every CALL in instructions, recursing into blocks.
+func linkCalls(instructions []Instruction, macros map[string]*Instruction) error {
+	for i := range instructions {
+		inst := &instructions[i]
+		if err := linkCalls(inst.Body, macros); err != nil {
+			return err
+		}
+		if err := linkCalls(inst.Else, macros); err != nil {
+			return err
+		}
+		if inst.Directive != "CALL" {
+			continue
+		}
+		name, args, err := parseCallArgs(inst.Args)
+		if err != nil {
+			return fmt.Errorf("%s: %w", inst.location(), err)
+		}
+		macro, ok := macros[name]
+		if !ok {
+			return fmt.Errorf("%s: CALL references undefined macro %s", inst.location(), name)
+		}
+		_, params, _ := parseMacroHeader(macro.Args)
+		if len(args) != len(params) {
+			return fmt.Errorf("%s: macro %s takes %d argument(s), got %d", inst.location(), name, len(params), len(args))
+		}
+		inst.Macro = macro
+	}
+	return nil
+}
+
+// checkMacroCycles rejects macros that end up calling themselves, which
+// would expand forever.
+func checkMacroCycles(names []string, macros map[string]*Instruction) error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make(map[string]int)
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visiting:
+			start := 0
+			for path[start] != name {
+				start++
+			}
+			cycle := append(append([]string(nil), path[start:]...), name)
+			return fmt.Errorf("%s: macro cycle: %s", macros[path[start]].location(), strings.Join(cycle, " -> "))
+		case visited:
+			return nil
+		}
+		marks[name] = visiting
+		path = append(path, name)
+		for _, callee := range calledMacros(macros[name].Body) {
+			if err := visit(callee); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		marks[name] = visited
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func calledMacros(instructions []Instruction) []string {
+	var called []string
+	for _, inst := range instructions {
+		if inst.Directive == "CALL" {
+			name, _, _ := parseCallArgs(inst.Args)
+			called = append(called, name)
+		}
+		called = append(called, calledMacros(inst.Body)...)
+		called = append(called, calledMacros(inst.Else)...)
+	}
+	return called
+}
+
+// executeCall runs a macro's body with its parameters bound to the expanded
+// call arguments. The body runs on a snapshot of the build state, so ARG,
+// ENV, BOX and WDR changes made inside it do not leak into the caller, and
+// its async instructions are joined before the call completes.
+func executeCall(state *BuildState, inst Instruction) error {
+	if inst.Macro == nil {
+		return fmt.Errorf("CALL references undefined macro %s", inst.Args)
+	}
+	name, params, err := parseMacroHeader(inst.Macro.Args)
+	if err != nil {
+		return err
+	}
+	_, args, err := parseCallArgs(inst.Args)
+	if err != nil {
+		return err
+	}
+	values, err := state.expandAll(args)
+	if err != nil {
+		return err
+	}
+	scope := state.snapshot()
+	state.PendingDeps = nil
+	state.PendingOuts = nil
+	state.CurrentCacheKey = ""
+	for i, param := range params {
+		scope.Args[param] = values[i]
+	}
+	state.log("CALL %s %s", name, strings.Join(values, " "))
+	return executeInstructions(scope, inst.Macro.Body)
+}
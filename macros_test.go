@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFileBindsMacros(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"CALL greet world",
+		"DEF greet NAME",
+		"CALL write greeting.txt $NAME",
+		"END",
+		"DEF write FILE TEXT",
+		"^FMT $FILE \"%s\" $TEXT",
+		"END",
+		"TGT all",
+		"*CALL greet jetty",
+		"",
+	}, "\n")
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	instructions, err := parseFile(fileName)
+	if err != nil {
+		t.Fatalf("parseFile returned error: %v", err)
+	}
+	if len(instructions) != 2 || instructions[0].Directive != "CALL" || instructions[1].Directive != "TGT" {
+		t.Fatalf("expected DEF blocks to be removed, got %#v", instructions)
+	}
+	greet := instructions[0].Macro
+	if greet == nil || greet.Args != "greet NAME" || len(greet.Body) != 1 {
+		t.Fatalf("expected CALL to be bound to the greet macro, got %#v", greet)
+	}
+	if greet.Body[0].Macro == nil || greet.Body[0].Macro.Args != "write FILE TEXT" {
+		t.Fatalf("expected nested CALL to be bound to the write macro, got %#v", greet.Body[0].Macro)
+	}
+	async := instructions[1].Body[0]
+	if async.Symbol != "*" || async.Macro != greet {
+		t.Fatalf("expected *CALL inside a target to be bound to greet, got %#v", async)
+	}
+}
+
+func TestParseFileRejectsInvalidMacros(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"CALL missing\n", "line 1: CALL references undefined macro missing"},
+		{"DEF m A B\nRUN echo $A\nEND\nCALL m x\n", "line 4: macro m takes 2 argument(s), got 1"},
+		{"DEF m\nRUN echo\nEND\nDEF m\nRUN echo\nEND\n", "line 4: macro m is already defined on line 1"},
+		{"DEF a\nCALL b\nEND\nDEF b\nCALL a\nEND\n", "line 1: macro cycle: a -> b -> a"},
+		{"IF 1 == 1\nDEF m\nEND\nEND\n", "line 2: DEF is not allowed inside the IF block on line 1"},
+		{"DEF m\nCMD echo\nEND\n", "line 2: CMD is not allowed inside a DEF block"},
+		{"DEF m\nID build\nRUN echo\nEND\n", "ID/AFTER labels are not allowed inside a DEF block"},
+		{"DEF m A A\nEND\n", "line 1: duplicate macro parameter: A"},
+		{"DEF m\nRUN echo\n", "line 1: unterminated DEF block"},
+	}
+	for _, tc := range tests {
+		dir := t.TempDir()
+		fileName := filepath.Join(dir, "Jettyfile")
+		if err := os.WriteFile(fileName, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := parseFile(fileName)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parseFile(%q) error = %v, want %q", tc.content, err, tc.want)
+		}
+	}
+}
+
+func TestBuildCallBindsScopedParameters(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"ARG MODULE=root",
+		"DEF module MODULE SUFFIX",
+		"ARG INNER=set",
+		"^FMT $MODULE.txt \"%s-%s\" $MODULE $SUFFIX",
+		"END",
+		"CALL module api v1",
+		"*CALL module web \"${MODULE}-v2\"",
+		"WAIT",
+		"^FMT caller.txt \"%s:%s\" $MODULE ${INNER:-unset}",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, _, err := runBuildForTest(t, buildFile)
+	if err != nil {
+		t.Fatalf("build returned error: %v", err)
+	}
+	assertFileContent(t, filepath.Join(dir, "api.txt"), "api-v1")
+	assertFileContent(t, filepath.Join(dir, "web.txt"), "web-root-v2")
+	assertFileContent(t, filepath.Join(dir, "caller.txt"), "root:unset")
+	if !joinedOutputContains(output, "CALL module api v1") {
+		t.Fatalf("expected CALL to be logged, got %v", output)
+	}
+}
+
+func TestBuildCallReportsMacroLine(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := "DEF copy SRC\nCPY $SRC out.txt\nEND\nCALL copy missing.txt\n"
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := runBuildForTest(t, buildFile)
+	if err == nil || !strings.Contains(err.Error(), "line 4 [CALL copy missing.txt]: (1/1) line 2 [CPY $SRC out.txt]") {
+		t.Fatalf("expected error to name the call and the macro line, got %v", err)
+	}
+}
@@ -44,6 +44,9 @@ type Command struct {
 	MaxArgs     int
 	Subcommands map[string]*Command
 	Flags       *flag.FlagSet
+	// NoTimeout exempts long-running commands, such as servers, from
+	// JETTY_TIMEOUT.
+	NoTimeout bool
 }
 
 func initApp() {
@@ -144,12 +147,24 @@ func handleSubcommands(ctx context.Context, args []string) error {
 		logger.SetFlags(log.LstdFlags | log.Lshortfile)
 		logger.Println("Verbose mode enabled for command:", filteredArgs[0])
 	}
-	if err := validateArgs(cmd, filteredArgs[1:]); err != nil {
+	args = filteredArgs[1:]
+	if len(args) > 0 {
+		if subcmd, ok := cmd.Subcommands[args[0]]; ok && subcmd.Run != nil {
+			cmd, args = *subcmd, args[1:]
+		}
+	}
+	if cmd.Run == nil {
+		return fmt.Errorf("%w: %s requires a subcommand", ErrInvalidInput, filteredArgs[0])
+	}
+	if err := validateArgs(cmd, args); err != nil {
 		return err
 	}
+	if cmd.NoTimeout {
+		return cmd.Run(ctx, args)
+	}
 	cmdCtx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
-	return cmd.Run(cmdCtx, filteredArgs[1:])
+	return cmd.Run(cmdCtx, args)
 }
 
 func showCommandHelp(cmdName string) error {
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// directiveOptions lists the leading `--name[=value]` options each directive
+// accepts. Options are stripped from Args at parse time.
+var directiveOptions = map[string]map[string]bool{
+	"RUN":  runOptions,
+	"CPY":  stepOptions,
+	"SUB":  stepOptions,
+	"JET":  stepOptions,
+	"USE":  stepOptions,
+	"CALL": stepOptions,
+	"ARG":  argOptions,
+}
+
+// stepOptions are accepted by every directive that runs a unit of work.
+var stepOptions = map[string]bool{
+	"group":         true,
+	"timeout":       true,
+	"retries":       true,
+	"backoff":       true,
+	"allow-failure": true,
+}
+
+// runOptions are stepOptions plus --status, which stores the exit code of a
+// capturing $RUN or &RUN.
+var runOptions = mergeOptions(stepOptions, map[string]bool{"status": true})
+
+// argOptions declare the type, description and whether an ARG must be
+// passed in.
+var argOptions = map[string]bool{
+	"type":     true,
+	"desc":     true,
+	"required": true,
+}
+
+// booleanOptions take true or false; a bare --name means true.
+var booleanOptions = map[string]bool{
+	"allow-failure": true,
+	"required":      true,
+}
+
+// asyncOnlyOptions are only meaningful on async (*) instructions.
+var asyncOnlyOptions = map[string]bool{
+	"group": true,
+}
+
+// captureOnlyOptions are only meaningful on capturing ($ or &) instructions.
+var captureOnlyOptions = map[string]bool{
+	"status": true,
+}
+
+// nameOptions take a variable name.
+var nameOptions = map[string]bool{
+	"status": true,
+}
+
+func mergeOptions(sets ...map[string]bool) map[string]bool {
+	merged := make(map[string]bool)
+	for _, set := range sets {
+		for name := range set {
+			merged[name] = true
+		}
+	}
+	return merged
+}
+
+// parseInstructionOptions strips leading `--name[=value]` options from args.
+// Values may be quoted; an option without a value is recorded as "true".
+func parseInstructionOptions(directive string, symbol string, args string) (map[string]string, string, error) {
+	allowed := directiveOptions[directive]
+	if allowed == nil {
+		return nil, args, nil
+	}
+	var options map[string]string
+	rest := strings.TrimLeftFunc(args, unicode.IsSpace)
+	for strings.HasPrefix(rest, "--") {
+		token, remainder := cutOptionToken(rest)
+		parts, err := splitArgs(token)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(parts) != 1 {
+			return nil, "", fmt.Errorf("invalid option: %s", token)
+		}
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(parts[0], "--"), "=")
+		if !allowed[name] {
+			return nil, "", fmt.Errorf("unknown option --%s for %s", name, directive)
+		}
+		if !hasValue {
+			value = "true"
+		}
+		if booleanOptions[name] {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid --%s %q: expected true or false", name, value)
+			}
+			value = strconv.FormatBool(enabled)
+		}
+		if nameOptions[name] && !isValidName(value) {
+			return nil, "", fmt.Errorf("invalid --%s %q: expected a variable name", name, value)
+		}
+		if asyncOnlyOptions[name] && symbol != "*" {
+			return nil, "", fmt.Errorf("option --%s requires an async (*) instruction", name)
+		}
+		if captureOnlyOptions[name] && symbol != "$" && symbol != "&" {
+			return nil, "", fmt.Errorf("option --%s requires a capturing ($ or &) instruction", name)
+		}
+		if options == nil {
+			options = make(map[string]string)
+		}
+		if _, dup := options[name]; dup {
+			return nil, "", fmt.Errorf("duplicate option --%s", name)
+		}
+		options[name] = value
+		rest = strings.TrimLeftFunc(remainder, unicode.IsSpace)
+	}
+	if _, err := parseStepLimits(options); err != nil {
+		return nil, "", err
+	}
+	return options, rest, nil
+}
+
+// cutOptionToken splits s at the first whitespace that is not inside quotes.
+func cutOptionToken(s string) (string, string) {
+	var quote rune
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case unicode.IsSpace(r):
+			return s[:i], s[i:]
+		}
+	}
+	return s, ""
+}
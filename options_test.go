@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseInstructionOptions(t *testing.T) {
+	options, args, err := parseInstructionOptions("RUN", "*", ` --group="code gen" go generate ./...`)
+	if err != nil {
+		t.Fatalf("parseInstructionOptions returned error: %v", err)
+	}
+	if options["group"] != "code gen" || args != "go generate ./..." {
+		t.Fatalf("unexpected result: options=%#v args=%q", options, args)
+	}
+
+	options, args, err = parseInstructionOptions("RUN", "", "echo --group=x")
+	if err != nil || options != nil || args != "echo --group=x" {
+		t.Fatalf("expected options after the command to be left alone, got %#v %q %v", options, args, err)
+	}
+
+	options, args, err = parseInstructionOptions("ENV", "", "--group=x")
+	if err != nil || options != nil || args != "--group=x" {
+		t.Fatalf("expected directives without options to be untouched, got %#v %q %v", options, args, err)
+	}
+
+	tests := []struct {
+		directive string
+		symbol    string
+		args      string
+		want      string
+	}{
+		{"RUN", "*", "--colour=red echo", "unknown option --colour for RUN"},
+		{"RUN", "", "--group=x echo", "requires an async (*) instruction"},
+		{"RUN", "*", "--group=a --group=b echo", "duplicate option --group"},
+		{"RUN", "*", `--group="open echo`, "invalid quoted arguments"},
+	}
+	for _, tc := range tests {
+		_, _, err := parseInstructionOptions(tc.directive, tc.symbol, tc.args)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parseInstructionOptions(%q, %q, %q) error = %v, want %q", tc.directive, tc.symbol, tc.args, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// argParam is a build parameter declared by an ARG, such as
+// `ARG --type=enum:debug,release --desc="Build mode" MODE=debug`.
+type argParam struct {
+	Name        string
+	Type        argType
+	Default     string
+	HasDefault  bool
+	Required    bool
+	Description string
+	// File is the Jettyfile that declares the parameter, or the INC argument
+	// naming it, and Line its line there.
+	File string
+	Line int
+}
+
+// argType is the type of an ARG value: string, int, bool, path, or enum with
+// its allowed values.
+type argType struct {
+	Name   string
+	Values []string
+}
+
+var stringArgType = argType{Name: "string"}
+
+func (t argType) String() string {
+	if t.Name == "enum" {
+		return "enum:" + strings.Join(t.Values, ",")
+	}
+	return t.Name
+}
+
+// parseArgType parses the value of an ARG --type option.
+func parseArgType(text string) (argType, error) {
+	name, values, hasValues := strings.Cut(text, ":")
+	switch name {
+	case "string", "int", "bool", "path":
+		if hasValues {
+			return argType{}, fmt.Errorf("ARG type %s takes no values", name)
+		}
+		return argType{Name: name}, nil
+	case "enum":
+		var allowed []string
+		for _, value := range strings.Split(values, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				allowed = append(allowed, value)
+			}
+		}
+		if len(allowed) == 0 {
+			return argType{}, fmt.Errorf("ARG type enum requires values, such as enum:debug,release")
+		}
+		return argType{Name: name, Values: allowed}, nil
+	}
+	return argType{}, fmt.Errorf("unknown ARG type %q: expected string, int, bool, path or enum:VALUES", text)
+}
+
+// check returns an error unless value is valid for t. A relative path is
+// resolved against dir, the directory of the Jettyfile.
+func (t argType) check(value string, dir string) error {
+	switch t.Name {
+	case "int":
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("%q is not an int", value)
+		}
+	case "bool":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%q is not a bool", value)
+		}
+	case "enum":
+		if !slices.Contains(t.Values, value) {
+			return fmt.Errorf("%q is not one of %s", value, strings.Join(t.Values, ", "))
+		}
+	case "path":
+		path := value
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("path %q does not exist", value)
+		}
+	}
+	return nil
+}
+
+// parseArgParam parses an ARG instruction. A default that references
+// variables, and any path default, is only checked when the ARG runs.
+func parseArgParam(inst Instruction) (argParam, error) {
+	param := argParam{
+		Type:        stringArgType,
+		Required:    inst.Options["required"] == "true",
+		Description: inst.Options["desc"],
+		File:        inst.File,
+		Line:        inst.Line,
+	}
+	if inst.FileLine != 0 {
+		param.Line = inst.FileLine
+	}
+	if text, ok := inst.Options["type"]; ok {
+		argType, err := parseArgType(text)
+		if err != nil {
+			return argParam{}, err
+		}
+		param.Type = argType
+	}
+	if !strings.Contains(inst.Args, "=") {
+		param.Name = strings.TrimSpace(inst.Args)
+		if !isValidName(param.Name) {
+			return argParam{}, fmt.Errorf("invalid ARG format, expected KEY=value or KEY")
+		}
+		return param, nil
+	}
+	key, value, err := parseAssignment(inst.Args, "ARG")
+	if err != nil {
+		return argParam{}, err
+	}
+	param.Name, param.Default, param.HasDefault = key, value, true
+	if param.Required {
+		return argParam{}, fmt.Errorf("ARG %s cannot be --required and have a default", key)
+	}
+	if param.Type.Name != "path" && !strings.Contains(value, "$") {
+		if err := param.Type.check(value, ""); err != nil {
+			return argParam{}, fmt.Errorf("ARG %s default: %w", key, err)
+		}
+	}
+	return param, nil
+}
+
+// executeArg runs an ARG: a bare `ARG KEY` requires KEY to be set, otherwise
+// the default applies unless the argument was passed in. The resulting value
+// is checked against the declared type.
+func executeArg(state *BuildState, inst Instruction) error {
+	param, err := parseArgParam(inst)
+	if err != nil {
+		return err
+	}
+	if !param.HasDefault {
+		if err := requireArg(state, param.Name); err != nil {
+			return err
+		}
+	} else if !state.ProvidedArgs[param.Name] {
+		// Like a Dockerfile ARG, the value is only a default: an argument
+		// passed in with --build-arg (or from a parent build) wins.
+		if state.Args[param.Name], err = state.expand(param.Default); err != nil {
+			delete(state.Args, param.Name)
+			return err
+		}
+	}
+	if err := param.Type.check(state.Args[param.Name], state.BaseDir); err != nil {
+		return fmt.Errorf("ARG %s: %w", param.Name, err)
+	}
+	return nil
+}
+
+// checkProvidedArgs validates the arguments a build starts with against the
+// ARGs it declares, before any instruction runs: passed-in values must match
+// their declared type, and an ARG without a default must be passed in unless
+// an earlier instruction sets it, as an ARG default, &FMT, &RUN, FOR or macro
+// parameter does.
+func checkProvidedArgs(instructions []Instruction, provided map[string]string, dir string) error {
+	set := map[string]bool{"BUILD_ID": true, "WORKER_NODE": true}
+	for _, inst := range flattenInstructions(instructions) {
+		if inst.Directive != "ARG" {
+			if inst.Directive != "ENV" && inst.Symbol != "$" {
+				for _, name := range definedVariables(inst) {
+					set[name] = true
+				}
+			}
+			continue
+		}
+		param, err := parseArgParam(inst)
+		if err != nil {
+			return fmt.Errorf("%s: %w", inst.location(), err)
+		}
+		value, ok := provided[param.Name]
+		if !ok {
+			if !param.HasDefault && !set[param.Name] {
+				return fmt.Errorf("%s: required ARG %s is not set; pass --build-arg %s=value", inst.location(), param.Name, param.Name)
+			}
+			set[param.Name] = true
+			continue
+		}
+		if err := param.Type.check(value, dir); err != nil {
+			return fmt.Errorf("%s: ARG %s: %w", inst.location(), param.Name, err)
+		}
+	}
+	return nil
+}
+
+// collectParams lists the parameters declared by the Jettyfile fileName and
+// by the local SUB files it reaches through literal paths, in declaration
+// order. Each parameter's File is relative to the directory of fileName.
+func collectParams(fileName string) ([]argParam, error) {
+	absFileName, err := filepath.Abs(fileName)
+	if err != nil {
+		return nil, err
+	}
+	root := filepath.Dir(absFileName)
+	var params []argParam
+	visited := make(map[string]bool)
+	var visit func(string) error
+	visit = func(file string) error {
+		if visited[file] {
+			return nil
+		}
+		visited[file] = true
+		display := file
+		if rel, err := filepath.Rel(root, file); err == nil {
+			display = rel
+		}
+		instructions, err := parseFile(file)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", display, err)
+		}
+		var subFiles []string
+		workDir := "."
+		for _, inst := range flattenInstructions(instructions) {
+			switch inst.Directive {
+			case "ARG":
+				param, err := parseArgParam(inst)
+				if err != nil {
+					return fmt.Errorf("%s: %s: %w", display, inst.location(), err)
+				}
+				if param.File == "" {
+					param.File = display
+				}
+				params = append(params, param)
+			case "SUB":
+				if subFile, ok := staticSubFile(filepath.Dir(file), workDir, inst.Args); ok {
+					subFiles = append(subFiles, subFile)
+				}
+			}
+			workDir = nextWorkDir(workDir, inst)
+		}
+		for _, subFile := range subFiles {
+			if err := visit(subFile); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(absFileName); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// staticSubFile resolves the argument of a SUB in a Jettyfile in dir to an
+// existing local file, when that is possible without running the build.
+func staticSubFile(dir string, workDir string, arg string) (string, bool) {
+	if githubURL, err := parseGithubImport(strings.TrimSpace(arg)); err != nil || githubURL != "" {
+		return "", false
+	}
+	parts, err := splitArgs(arg)
+	if err != nil || len(parts) != 1 {
+		return "", false
+	}
+	path, ok := staticPath(workDir, parts[0])
+	if !ok {
+		return "", false
+	}
+	path = filepath.FromSlash(path)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	if !isRegularFile(path) {
+		return "", false
+	}
+	return path, true
+}
+
+// printParams writes params as a table.
+func printParams(w io.Writer, params []argParam) error {
+	if len(params) == 0 {
+		_, err := fmt.Fprintln(w, "No parameters declared")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tDEFAULT\tREQUIRED\tDESCRIPTION\tDECLARED")
+	for _, param := range params {
+		defaultValue := "-"
+		if param.HasDefault {
+			defaultValue = param.Default
+		}
+		required := "no"
+		if !param.HasDefault {
+			required = "yes"
+		}
+		description := param.Description
+		if description == "" {
+			description = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s:%d\n", param.Name, param.Type, defaultValue, required, description, param.File, param.Line)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseArgParam(t *testing.T) {
+	instructions, err := scanInstructions(strings.NewReader(strings.Join([]string{
+		`ARG --type=enum:debug,release --desc="Build mode" MODE=debug`,
+		`ARG --required --type=int --desc=Replicas REPLICAS`,
+		`ARG NAME=$USER`,
+		"",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("scanInstructions returned error: %v", err)
+	}
+	mode, err := parseArgParam(instructions[0])
+	if err != nil {
+		t.Fatalf("parseArgParam returned error: %v", err)
+	}
+	if mode.Name != "MODE" || mode.Type.String() != "enum:debug,release" || mode.Default != "debug" || !mode.HasDefault || mode.Description != "Build mode" || mode.Required {
+		t.Fatalf("unexpected enum param: %#v", mode)
+	}
+	replicas, err := parseArgParam(instructions[1])
+	if err != nil || replicas.Name != "REPLICAS" || replicas.Type.Name != "int" || !replicas.Required || replicas.HasDefault {
+		t.Fatalf("unexpected required param: %#v %v", replicas, err)
+	}
+	name, err := parseArgParam(instructions[2])
+	if err != nil || name.Type.Name != "string" || name.Default != "$USER" {
+		t.Fatalf("unexpected string param: %#v %v", name, err)
+	}
+}
+
+func TestParseFileValidatesArgOptions(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"ARG --type=float N=1\n", `line 1: unknown ARG type "float"`},
+		{"ARG --type=enum: MODE\n", "line 1: ARG type enum requires values"},
+		{"ARG --type=int N=many\n", `line 1: ARG N default: "many" is not an int`},
+		{"ARG --type=enum:a,b M=c\n", `line 1: ARG M default: "c" is not one of a, b`},
+		{"ARG --required N=1\n", "line 1: ARG N cannot be --required and have a default"},
+		{"ARG --required=maybe N\n", `line 1: invalid --required "maybe": expected true or false`},
+		{"ARG --colour=red N\n", "line 1: unknown option --colour for ARG"},
+	}
+	for _, tc := range tests {
+		fileName := filepath.Join(t.TempDir(), "Jettyfile")
+		if err := os.WriteFile(fileName, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := parseFile(fileName)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parseFile(%q) error = %v, want %q", tc.content, err, tc.want)
+		}
+	}
+}
+
+func TestArgTypeCheck(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	enum, err := parseArgType("enum:debug, release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		argType argType
+		value   string
+		valid   bool
+	}{
+		{argType{Name: "int"}, "-3", true},
+		{argType{Name: "int"}, "3.5", false},
+		{argType{Name: "bool"}, "true", true},
+		{argType{Name: "bool"}, "yes", false},
+		{enum, "release", true},
+		{enum, "Release", false},
+		{argType{Name: "path"}, "config.yaml", true},
+		{argType{Name: "path"}, filepath.Join(dir, "config.yaml"), true},
+		{argType{Name: "path"}, "missing.yaml", false},
+		{stringArgType, "", true},
+	}
+	for _, tc := range tests {
+		if err := tc.argType.check(tc.value, dir); (err == nil) != tc.valid {
+			t.Errorf("%s check(%q) = %v, want valid=%v", tc.argType, tc.value, err, tc.valid)
+		}
+	}
+}
+
+func TestBuildChecksProvidedArgsAtStart(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"RUN touch started.txt",
+		"ARG --type=int --desc=Replicas REPLICAS=1",
+		"ARG --required --type=enum:staging,production TARGET",
+		"^FMT out.txt \"%s %s\" $REPLICAS $TARGET",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := handleSubcommands(ctx, []string{"build", "--build-arg", "REPLICAS=two", "--build-arg", "TARGET=staging", "-f", buildFile})
+	if err == nil || !strings.Contains(err.Error(), `line 2: ARG REPLICAS: "two" is not an int`) {
+		t.Fatalf("expected an invalid int to be rejected, got %v", err)
+	}
+	err = handleSubcommands(ctx, []string{"build", "-f", buildFile})
+	if err == nil || !strings.Contains(err.Error(), "line 3: required ARG TARGET is not set") {
+		t.Fatalf("expected a missing --required ARG to be rejected, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "started.txt")); !os.IsNotExist(err) {
+		t.Fatal("expected invalid build args to fail the build before any step runs")
+	}
+
+	if err := handleSubcommands(ctx, []string{"build", "--build-arg", "TARGET=production", "-f", buildFile}); err != nil {
+		t.Fatalf("handleSubcommands returned error: %v", err)
+	}
+	assertFileContent(t, filepath.Join(dir, "out.txt"), "1 production")
+}
+
+func TestBuildRequiresBareArgsAtStart(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"RUN touch started.txt",
+		"&FMT MODE \"%s\" release",
+		"ARG MODE",
+		"ARG VERSION",
+		"^FMT out.txt \"%s %s\" $MODE $VERSION",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := handleSubcommands(ctx, []string{"build", "-f", buildFile})
+	if err == nil || !strings.Contains(err.Error(), "line 4: required ARG VERSION is not set") {
+		t.Fatalf("expected a missing bare ARG to be rejected, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "started.txt")); !os.IsNotExist(err) {
+		t.Fatal("expected a missing bare ARG to fail the build before any step runs")
+	}
+
+	if err := handleSubcommands(ctx, []string{"build", "--build-arg", "VERSION=1.0", "-f", buildFile}); err != nil {
+		t.Fatalf("handleSubcommands returned error: %v", err)
+	}
+	assertFileContent(t, filepath.Join(dir, "out.txt"), "release 1.0")
+}
+
+func TestBuildChecksExpandedArgDefaults(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	if err := os.WriteFile(buildFile, []byte("ENV COUNT=many\nARG --type=int N=$COUNT\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := runBuildForTest(t, buildFile)
+	if err == nil || !strings.Contains(err.Error(), `ARG N: "many" is not an int`) {
+		t.Fatalf("expected the expanded default to be checked, got %v", err)
+	}
+}
+
+func TestParamsCommandListsSubBuildParams(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "services", "api"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	root := strings.Join([]string{
+		`ARG --type=enum:debug,release --desc="Build mode" MODE=debug`,
+		"ARG TAG",
+		"WDR services",
+		"SUB api/Jettyfile",
+		"SUB $MISSING/Jettyfile",
+		"SUB github.com/org/repo/Jettyfile",
+		"",
+	}, "\n")
+	api := strings.Join([]string{
+		`ARG --type=int --desc="Listen port" PORT=8080`,
+		"SUB ../../Jettyfile",
+		"",
+	}, "\n")
+	if err := os.WriteFile(filepath.Join(dir, "Jettyfile"), []byte(root), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "services", "api", "Jettyfile"), []byte(api), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := collectParams(filepath.Join(dir, "Jettyfile"))
+	if err != nil {
+		t.Fatalf("collectParams returned error: %v", err)
+	}
+	if len(params) != 3 || params[2].Name != "PORT" || params[2].File != filepath.Join("services", "api", "Jettyfile") || params[2].Line != 1 {
+		t.Fatalf("unexpected params: %#v", params)
+	}
+
+	output := captureStdout(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := handleSubcommands(ctx, []string{"params", filepath.Join(dir, "Jettyfile")}); err != nil {
+		t.Fatalf("params returned error: %v", err)
+	}
+	for _, want := range []string{
+		"NAME  TYPE",
+		"MODE  enum:debug,release  debug    no        Build mode",
+		"TAG   string              -        yes       -",
+		"PORT  int                 8080     no        Listen port",
+	} {
+		if !strings.Contains(output.String(), want) {
+			t.Fatalf("expected %q in params output, got:\n%s", want, output.String())
+		}
+	}
+
+	output.Reset()
+	if err := handleSubcommands(ctx, []string{"build", "--help-args", "-f", filepath.Join(dir, "Jettyfile")}); err != nil {
+		t.Fatalf("build --help-args returned error: %v", err)
+	}
+	if !strings.Contains(output.String(), "Listen port") {
+		t.Fatalf("expected build --help-args to list params, got:\n%s", output.String())
+	}
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 )
@@ -13,75 +13,179 @@ func parseFile(fileName string) ([]Instruction, error) {
 		return nil, err
 	}
 	defer file.Close()
-	var instructions []Instruction
-	scanner := bufio.NewScanner(file)
-	var multiLineCommand string
-	var multiLineStart int
-	lineNumber := 0
-	for scanner.Scan() {
-		lineNumber++
-		line := scanner.Text()
-		trimmedLine := strings.TrimSpace(line)
-		if multiLineCommand == "" && (trimmedLine == "" || strings.HasPrefix(trimmedLine, "#")) {
-			continue
-		}
-		lineWithoutTrailingSpace := strings.TrimRight(line, " \t")
-		if strings.HasSuffix(lineWithoutTrailingSpace, "\\") {
-			if multiLineCommand == "" {
-				multiLineStart = lineNumber
-			}
-			multiLineCommand += strings.TrimSuffix(lineWithoutTrailingSpace, "\\") + "\n"
-			continue
-		}
-		instructionLineNumber := lineNumber
-		if multiLineCommand != "" {
-			line = multiLineCommand + line
-			multiLineCommand = ""
-			instructionLineNumber = multiLineStart
-		}
-		line = strings.TrimSpace(line)
-		parts := strings.Fields(line)
-		if len(parts) < 2 {
-			return nil, fmt.Errorf("line %d: invalid instruction: %s", instructionLineNumber, line)
+	return parseSource(file, fileName)
+}
+
+// parseSource parses and validates Jettyfile content read from reader.
+// fileName locates the files it includes.
+func parseSource(reader io.Reader, fileName string) ([]Instruction, error) {
+	return parseSourceWith(reader, fileName, nil)
+}
+
+// parseSourceWith is parseSource with remote includes read through fetch.
+func parseSourceWith(reader io.Reader, fileName string, fetch remoteFetcher) ([]Instruction, error) {
+	instructions, err := scanInstructions(reader)
+	if err != nil {
+		return nil, err
+	}
+	instructions, err = resolveIncludes(instructions, includeSource{path: fileName, fetch: fetch}, nil)
+	if err != nil {
+		return nil, err
+	}
+	instructions, err = nestBlocks(instructions)
+	if err != nil {
+		return nil, err
+	}
+	instructions, err = attachStepLabels(instructions)
+	if err != nil {
+		return nil, err
+	}
+	instructions, err = bindMacros(instructions)
+	if err != nil {
+		return nil, err
+	}
+	return groupTargets(instructions)
+}
+
+// scanInstructions reads the instructions of a Jettyfile into a flat list.
+func scanInstructions(reader io.Reader) ([]Instruction, error) {
+	file, err := parseReader("", reader)
+	if err != nil {
+		return nil, err
+	}
+	return file.Instructions(), nil
+}
+
+// nestBlocks folds block directives (IF ... [ELSE] ... END, FOR ... END and
+// DEF ... END) into a tree: the opening instruction's Body (and Else) hold the
+// instructions it encloses.
+func nestBlocks(instructions []Instruction) ([]Instruction, error) {
+	type frame struct {
+		block  Instruction
+		inElse bool
+	}
+	var root []Instruction
+	var stack []*frame
+	appendInstruction := func(inst Instruction) {
+		if len(stack) == 0 {
+			root = append(root, inst)
+			return
 		}
-		token := parts[0]
-		argsStart := len(token)
-		directive, symbol, err := parseDirectiveToken(token)
-		if err != nil {
-			return nil, fmt.Errorf("line %d: %w", instructionLineNumber, err)
+		top := stack[len(stack)-1]
+		if top.inElse {
+			top.block.Else = append(top.block.Else, inst)
+		} else {
+			top.block.Body = append(top.block.Body, inst)
 		}
-		instructions = append(instructions, Instruction{
-			Directive: directive,
-			Symbol:    symbol,
-			Args:      strings.TrimSpace(line[argsStart:]),
-			Line:      instructionLineNumber,
-		})
 	}
-	if multiLineCommand != "" {
-		return nil, fmt.Errorf("line %d: unterminated multi-line command", multiLineStart)
+	for _, inst := range instructions {
+		switch inst.Directive {
+		case "IF":
+			if _, err := parseCondition(inst.Args); err != nil {
+				return nil, fmt.Errorf("%s: %w", inst.location(), err)
+			}
+			stack = append(stack, &frame{block: inst})
+		case "FOR":
+			if _, err := parseLoopHeader(inst.Args); err != nil {
+				return nil, fmt.Errorf("%s: %w", inst.location(), err)
+			}
+			stack = append(stack, &frame{block: inst})
+		case "DEF":
+			if len(stack) > 0 {
+				return nil, fmt.Errorf("%s: DEF is not allowed inside the %s block on line %d", inst.location(), stack[len(stack)-1].block.Directive, stack[len(stack)-1].block.Line)
+			}
+			if _, _, err := parseMacroHeader(inst.Args); err != nil {
+				return nil, fmt.Errorf("%s: %w", inst.location(), err)
+			}
+			stack = append(stack, &frame{block: inst})
+		case "WAIT":
+			if _, err := parseWaitGroups(inst.Args); err != nil {
+				return nil, fmt.Errorf("%s: %w", inst.location(), err)
+			}
+			appendInstruction(inst)
+		case "ARG":
+			if _, err := parseArgParam(inst); err != nil {
+				return nil, fmt.Errorf("%s: %w", inst.location(), err)
+			}
+			appendInstruction(inst)
+		case "SHELL":
+			if _, err := parseShellArgs(inst.Args); err != nil {
+				return nil, fmt.Errorf("%s: %w", inst.location(), err)
+			}
+			appendInstruction(inst)
+		case "ELSE":
+			if len(stack) == 0 || stack[len(stack)-1].block.Directive != "IF" {
+				return nil, fmt.Errorf("%s: ELSE without matching IF", inst.location())
+			}
+			top := stack[len(stack)-1]
+			if top.inElse {
+				return nil, fmt.Errorf("%s: duplicate ELSE for IF on line %d", inst.location(), top.block.Line)
+			}
+			top.inElse = true
+		case "END":
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("%s: END without matching block", inst.location())
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			appendInstruction(top.block)
+		case "TGT":
+			if len(stack) > 0 {
+				return nil, fmt.Errorf("%s: TGT is not allowed inside the %s block on line %d", inst.location(), stack[len(stack)-1].block.Directive, stack[len(stack)-1].block.Line)
+			}
+			appendInstruction(inst)
+		default:
+			appendInstruction(inst)
+		}
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	if len(stack) > 0 {
+		top := stack[len(stack)-1]
+		return nil, fmt.Errorf("%s: unterminated %s block", top.block.location(), top.block.Directive)
 	}
-	return instructions, nil
+	return root, nil
 }
 
 var directiveSymbols = map[string]map[string]bool{
-	"ARG": {"": true},
-	"ENV": {"": true},
-	"RUN": {"": true, "*": true},
-	"CMD": {"": true},
-	"DEP": {"": true},
-	"OUT": {"": true},
-	"DIR": {"": true},
-	"CPY": {"": true, "*": true},
-	"WDR": {"": true},
-	"SUB": {"": true, "*": true},
-	"FRM": {"": true},
-	"JET": {"": true, "*": true},
-	"FMT": {"": true, "^": true, "$": true, "&": true},
-	"BOX": {"": true},
-	"USE": {"": true, "*": true},
+	"ARG":   {"": true},
+	"ENV":   {"": true},
+	"RUN":   {"": true, "*": true, "$": true, "&": true},
+	"CMD":   {"": true},
+	"DEP":   {"": true},
+	"OUT":   {"": true},
+	"DIR":   {"": true},
+	"CPY":   {"": true, "*": true},
+	"WDR":   {"": true},
+	"SUB":   {"": true, "*": true},
+	"FRM":   {"": true},
+	"JET":   {"": true, "*": true},
+	"FMT":   {"": true, "^": true, "$": true, "&": true},
+	"BOX":   {"": true},
+	"USE":   {"": true, "*": true},
+	"TGT":   {"": true},
+	"IF":    {"": true},
+	"ELSE":  {"": true},
+	"END":   {"": true},
+	"FOR":   {"": true},
+	"ID":    {"": true},
+	"AFTER": {"": true},
+	"WAIT":  {"": true},
+	"INC":   {"": true},
+	"DEF":   {"": true},
+	"CALL":  {"": true, "*": true},
+	"SHELL": {"": true},
+}
+
+// bareDirectives may appear without arguments.
+var bareDirectives = map[string]bool{
+	"ELSE": true,
+	"END":  true,
+	"WAIT": true,
+}
+
+// argumentlessDirectives never take arguments.
+var argumentlessDirectives = map[string]bool{
+	"ELSE": true,
+	"END":  true,
 }
 
 func parseDirectiveToken(token string) (string, string, error) {
@@ -94,6 +198,8 @@ func parseDirectiveToken(token string) (string, string, error) {
 		symbol = token[:1]
 		directive = token[1:]
 	}
+	// Directives are case-insensitive; jetty fmt writes them in upper case.
+	directive = strings.ToUpper(directive)
 	allowedSymbols, ok := directiveSymbols[directive]
 	if !ok || directive == "" {
 		return "", "", fmt.Errorf("invalid directive: %s", token)
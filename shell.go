@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// parseShellArgs parses the JSON array of a SHELL instruction: the program and
+// the arguments to run before the script, which is passed as the last
+// argument.
+func parseShellArgs(args string) ([]string, error) {
+	var shell []string
+	if err := json.Unmarshal([]byte(args), &shell); err != nil {
+		return nil, fmt.Errorf(`SHELL requires a JSON array such as ["bash", "-c"]`)
+	}
+	if len(shell) == 0 || shell[0] == "" {
+		return nil, fmt.Errorf("SHELL requires a program")
+	}
+	return shell, nil
+}
+
+// executeShellDirective sets the shell later RUN, CMD and USE instructions of
+// the current scope run their scripts with.
+func executeShellDirective(state *BuildState, args string) error {
+	shell, err := parseShellArgs(args)
+	if err != nil {
+		return err
+	}
+	state.Shell = shell
+	state.log("SHELL: %s", strings.Join(shell, " "))
+	return nil
+}
+
+// shellArgs returns the command line that runs script with shell, or with
+// fallback when no SHELL is set.
+func shellArgs(shell []string, fallback []string, script string) []string {
+	if len(shell) == 0 {
+		shell = fallback
+	}
+	return append(append([]string(nil), shell...), script)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseShellArgs(t *testing.T) {
+	shell, err := parseShellArgs(`["bash", "-euo", "pipefail", "-c"]`)
+	if err != nil || !reflect.DeepEqual(shell, []string{"bash", "-euo", "pipefail", "-c"}) {
+		t.Fatalf("parseShellArgs() = %q, %v", shell, err)
+	}
+	for _, args := range []string{"bash -c", `[]`, `[""]`, `["bash", 1]`} {
+		if _, err := parseShellArgs(args); err == nil {
+			t.Errorf("parseShellArgs(%q) succeeded, want an error", args)
+		}
+	}
+	if got := shellArgs(nil, []string{"sh", "-c"}, "echo"); !reflect.DeepEqual(got, []string{"sh", "-c", "echo"}) {
+		t.Fatalf("shellArgs() without SHELL = %q", got)
+	}
+}
+
+func TestParseFileValidatesShell(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "Jettyfile")
+	if err := os.WriteFile(fileName, []byte("RUN echo\nSHELL bash -c\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := parseFile(fileName)
+	if err == nil || !strings.Contains(err.Error(), `line 2: SHELL requires a JSON array such as ["bash", "-c"]`) {
+		t.Fatalf("expected an invalid SHELL error, got %v", err)
+	}
+}
+
+func TestBuildShellIsInherited(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	// `$-` lists the shell's flags, so each step records whether it ran
+	// under `sh -e`.
+	record := func(name string) string {
+		return "RUN case $- in *e*) touch " + name + ";; esac"
+	}
+	writeIncludeFiles(t, dir, map[string]string{
+		"sub/Jettyfile": record("sub.txt") + "\n",
+		"Jettyfile": strings.Join([]string{
+			record("default.txt"),
+			"DEF plain",
+			`SHELL ["sh", "-c"]`,
+			record("macro.txt"),
+			"END",
+			`SHELL ["sh", "-e", "-c"]`,
+			"CALL plain",
+			record("main.txt"),
+			"*" + record("async.txt"),
+			"WAIT",
+			"SUB sub/Jettyfile",
+			"CMD false; touch cmd.txt",
+			"",
+		}, "\n"),
+	})
+
+	output, _, err := runBuildForTest(t, filepath.Join(dir, "Jettyfile"))
+	if err == nil || !strings.Contains(err.Error(), "[CMD false; touch cmd.txt]") {
+		t.Fatalf("expected CMD to fail under sh -e, got %v\noutput:\n%s", err, strings.Join(output, "\n"))
+	}
+	for _, name := range []string{"main.txt", "async.txt", "sub/sub.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s to run under the SHELL: %v", name, err)
+		}
+	}
+	for _, name := range []string{"default.txt", "macro.txt", "cmd.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to exist", name)
+		}
+	}
+	if !joinedOutputContains(output, "SHELL: sh -e -c") {
+		t.Fatalf("expected SHELL to be logged, got %v", output)
+	}
+}
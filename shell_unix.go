@@ -9,8 +9,10 @@ import (
 	"time"
 )
 
-func shellCommand(ctx context.Context, script string) *exec.Cmd {
-	cmd := exec.CommandContext(ctx, "sh", "-c", script)
+// shellCommand runs script with shell, or with `sh -c` when shell is empty.
+func shellCommand(ctx context.Context, shell []string, script string) *exec.Cmd {
+	argv := shellArgs(shell, []string{"sh", "-c"}, script)
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	cmd.Cancel = func() error {
 		if cmd.Process == nil {
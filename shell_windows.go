@@ -8,11 +8,15 @@ import (
 	"time"
 )
 
-func shellCommand(ctx context.Context, script string) *exec.Cmd {
-	cmd := exec.CommandContext(ctx, "cmd", "/C", script)
-	if shell, err := exec.LookPath("sh"); err == nil {
-		cmd = exec.CommandContext(ctx, shell, "-c", script)
+// shellCommand runs script with shell or, when shell is empty, with `sh -c`
+// if sh is installed and `cmd /C` otherwise.
+func shellCommand(ctx context.Context, shell []string, script string) *exec.Cmd {
+	fallback := []string{"cmd", "/C"}
+	if sh, err := exec.LookPath("sh"); err == nil {
+		fallback = []string{sh, "-c"}
 	}
+	argv := shellArgs(shell, fallback, script)
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
 
 	cmd.Cancel = func() error {
 		// Windows cannot deliver os.Interrupt to another process; Signal would
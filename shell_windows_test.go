@@ -7,7 +7,7 @@ import (
 
 func TestShellCommand(t *testing.T) {
 	ctx := context.Background()
-	cmd := shellCommand(ctx, "echo hello")
+	cmd := shellCommand(ctx, nil, "echo hello")
 
 	// Process is nil before starting
 	if err := cmd.Cancel(); err != nil {
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// errStepSkipped marks a labeled step whose enclosing IF branch was not
+// taken. Steps waiting on it proceed as if it had completed.
+var errStepSkipped = errors.New("step skipped")
+
+// errStepNotRun marks a labeled step that never ran because the build stopped
+// before reaching it.
+var errStepNotRun = errors.New("step did not run")
+
+// stepNode tracks completion of a labeled (ID) step.
+type stepNode struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// unlabelableDirectives cannot carry an ID or AFTER label.
+var unlabelableDirectives = map[string]bool{
+	"CMD":  true,
+	"DEF":  true,
+	"FOR":  true,
+	"IF":   true,
+	"TGT":  true,
+	"WAIT": true,
+}
+
+// attachStepLabels folds each ID and AFTER instruction into the step that
+// follows it (skipping intervening DEP and OUT declarations), so the label
+// travels with the step through target selection and block nesting.
+func attachStepLabels(instructions []Instruction) ([]Instruction, error) {
+	var labeled []Instruction
+	var pendingID string
+	var pendingAfter []string
+	pendingLine := 0
+	for _, inst := range instructions {
+		var err error
+		if inst.Body, err = attachStepLabels(inst.Body); err != nil {
+			return nil, err
+		}
+		if inst.Else, err = attachStepLabels(inst.Else); err != nil {
+			return nil, err
+		}
+		switch inst.Directive {
+		case "ID":
+			names, err := parseStepNames(inst.Args, "ID")
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", inst.location(), err)
+			}
+			if len(names) != 1 {
+				return nil, fmt.Errorf("%s: ID requires exactly one step name", inst.location())
+			}
+			if pendingID != "" {
+				return nil, fmt.Errorf("%s: step is already labeled %s", inst.location(), pendingID)
+			}
+			pendingID = names[0]
+			if pendingLine == 0 {
+				pendingLine = inst.Line
+			}
+		case "AFTER":
+			names, err := parseStepNames(inst.Args, "AFTER")
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", inst.location(), err)
+			}
+			pendingAfter = append(pendingAfter, names...)
+			if pendingLine == 0 {
+				pendingLine = inst.Line
+			}
+		case "DEP", "OUT":
+			labeled = append(labeled, inst)
+		default:
+			if pendingLine != 0 {
+				if unlabelableDirectives[inst.Directive] {
+					return nil, fmt.Errorf("%s: ID/AFTER on line %d cannot label a %s directive", inst.location(), pendingLine, inst.Directive)
+				}
+				inst.ID = pendingID
+				inst.After = pendingAfter
+				pendingID, pendingAfter, pendingLine = "", nil, 0
+			}
+			labeled = append(labeled, inst)
+		}
+	}
+	if pendingLine != 0 {
+		return nil, fmt.Errorf("line %d: ID/AFTER must be followed by a step in the same block", pendingLine)
+	}
+	return labeled, nil
+}
+
+func parseStepNames(args string, directive string) ([]string, error) {
+	names, err := splitArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%s requires a step name", directive)
+	}
+	for _, name := range names {
+		if !targetNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid step name: %s", name)
+		}
+	}
+	return names, nil
+}
+
+// validateBuild runs the checks a parsed file must pass before it can be
+// built in full: the TGT dependency graph, then the ID/AFTER graph of every
+// target in build order.
+func validateBuild(instructions []Instruction) error {
+	selected, err := selectTargets(instructions, nil)
+	if err != nil {
+		return err
+	}
+	return validateSteps(selected)
+}
+
+// validateSteps checks the ID/AFTER graph of instructions in execution order:
+// step names must be unique and defined, IDs may not repeat inside a FOR
+// body, synchronous steps and WAIT barriers may only wait for steps launched
+// before them, and the AFTER edges between labeled steps must not form a
+// cycle.
+func validateSteps(instructions []Instruction) error {
+	type stepDef struct {
+		line  int
+		order int
+		after []string
+	}
+	defined := make(map[string]stepDef)
+	var names []string
+	type waiter struct {
+		inst  Instruction
+		order int
+	}
+	var waiters []waiter
+	var launched []waiter
+	var barriers []waiter
+	order := 0
+	var walk func(instructions []Instruction, inLoop bool) error
+	walk = func(instructions []Instruction, inLoop bool) error {
+		for _, inst := range instructions {
+			order++
+			if inst.Symbol == "*" {
+				launched = append(launched, waiter{inst: inst, order: order})
+			}
+			if inst.Directive == "WAIT" {
+				barriers = append(barriers, waiter{inst: inst, order: order})
+			}
+			if inst.ID != "" {
+				if inLoop {
+					return fmt.Errorf("%s: step %s cannot be labeled inside a FOR block", inst.location(), inst.ID)
+				}
+				if previous, ok := defined[inst.ID]; ok {
+					return fmt.Errorf("%s: step %s is already defined on line %d", inst.location(), inst.ID, previous.line)
+				}
+				defined[inst.ID] = stepDef{line: inst.Line, order: order, after: inst.After}
+				names = append(names, inst.ID)
+			}
+			if len(inst.After) > 0 {
+				waiters = append(waiters, waiter{inst: inst, order: order})
+			}
+			if err := walk(inst.Body, inLoop || inst.Directive == "FOR"); err != nil {
+				return err
+			}
+			if err := walk(inst.Else, inLoop); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(instructions, false); err != nil {
+		return err
+	}
+	for _, w := range waiters {
+		for _, name := range w.inst.After {
+			if _, ok := defined[name]; !ok {
+				return fmt.Errorf("%s: AFTER references unknown step %s", w.inst.location(), name)
+			}
+		}
+	}
+	// laterStep returns the step reached only after position order that
+	// name depends on, either itself or through the steps it waits for.
+	laterStep := func(name string, order int) (string, bool) {
+		seen := make(map[string]bool)
+		var find func(name string) (string, bool)
+		find = func(name string) (string, bool) {
+			if seen[name] {
+				return "", false
+			}
+			seen[name] = true
+			def := defined[name]
+			if def.order > order {
+				return name, true
+			}
+			for _, dep := range def.after {
+				if later, ok := find(dep); ok {
+					return later, true
+				}
+			}
+			return "", false
+		}
+		return find(name)
+	}
+	// waitsLater describes how name leads to a later step, for errors.
+	waitsLater := func(name string, later string) string {
+		if name == later {
+			return fmt.Sprintf("step %s, which runs later (line %d)", name, defined[later].line)
+		}
+		return fmt.Sprintf("step %s, which waits for step %s that runs later (line %d)", name, later, defined[later].line)
+	}
+	// A synchronous step blocks the build while it waits, so nothing it
+	// depends on may only be reached after it.
+	for _, w := range waiters {
+		if w.inst.Symbol == "*" {
+			continue
+		}
+		for _, name := range w.inst.After {
+			if later, ok := laterStep(name, w.order); ok {
+				return fmt.Errorf("%s: synchronous step cannot wait for %s", w.inst.location(), waitsLater(name, later))
+			}
+		}
+	}
+	// A WAIT blocks the build until earlier async steps finish, so none of
+	// them may depend on a step that is only reached after the WAIT.
+	for _, barrier := range barriers {
+		groups, err := parseWaitGroups(barrier.inst.Args)
+		if err != nil {
+			return fmt.Errorf("%s: %w", barrier.inst.location(), err)
+		}
+		for _, async := range launched {
+			if async.order > barrier.order || !waitMatchesGroup(groups, async.inst.Options["group"]) {
+				continue
+			}
+			for _, name := range async.inst.After {
+				if later, ok := laterStep(name, barrier.order); ok {
+					return fmt.Errorf("%s: WAIT would block forever: step on line %d waits for %s", barrier.inst.location(), async.inst.Line, waitsLater(name, later))
+				}
+			}
+		}
+	}
+	const (
+		visiting = iota + 1
+		visited
+	)
+	marks := make(map[string]int, len(names))
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visiting:
+			start := 0
+			for i, step := range path {
+				if step == name {
+					start = i
+					break
+				}
+			}
+			cycle := append(append([]string(nil), path[start:]...), name)
+			return fmt.Errorf("line %d: step dependency cycle: %s", defined[name].line, strings.Join(cycle, " -> "))
+		case visited:
+			return nil
+		}
+		marks[name] = visiting
+		path = append(path, name)
+		for _, dep := range defined[name].after {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		marks[name] = visited
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (runner *instructionRunner) step(name string) *stepNode {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	if runner.steps == nil {
+		runner.steps = make(map[string]*stepNode)
+	}
+	node, ok := runner.steps[name]
+	if !ok {
+		node = &stepNode{done: make(chan struct{})}
+		runner.steps[name] = node
+	}
+	return node
+}
+
+// finishStep records the outcome of a labeled step and releases its waiters.
+// Only the first outcome is kept.
+func (runner *instructionRunner) finishStep(name string, err error) {
+	if name == "" {
+		return
+	}
+	node := runner.step(name)
+	node.once.Do(func() {
+		node.err = err
+		close(node.done)
+	})
+}
+
+// awaitSteps blocks until every named step has finished. A step that failed
+// or never ran fails the waiter; a step skipped by an untaken IF branch does
+// not.
+func (runner *instructionRunner) awaitSteps(ctx context.Context, names []string) error {
+	for _, name := range names {
+		node := runner.step(name)
+		select {
+		case <-node.done:
+			if node.err != nil && !errors.Is(node.err, errStepSkipped) {
+				return fmt.Errorf("step %s did not complete", name)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// skipSteps releases the labeled steps in a branch that will not run.
+func (runner *instructionRunner) skipSteps(instructions []Instruction) {
+	for _, inst := range instructions {
+		runner.finishStep(inst.ID, errStepSkipped)
+		runner.skipSteps(inst.Body)
+		runner.skipSteps(inst.Else)
+	}
+}
+
+// releaseSteps fails every labeled step that has not finished, so async
+// instructions waiting on a step the build never reached do not block forever.
+func (runner *instructionRunner) releaseSteps() {
+	runner.mu.Lock()
+	names := make([]string, 0, len(runner.steps))
+	for name := range runner.steps {
+		names = append(names, name)
+	}
+	runner.mu.Unlock()
+	for _, name := range names {
+		runner.finishStep(name, errStepNotRun)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestAttachStepLabels(t *testing.T) {
+	instructions := []Instruction{
+		{Directive: "ID", Args: "compile", Line: 1},
+		{Directive: "AFTER", Args: "fetch lint", Line: 2},
+		{Directive: "DEP", Args: "main.go", Line: 3},
+		{Directive: "RUN", Symbol: "*", Args: "go build", Line: 4},
+		{Directive: "RUN", Args: "echo unlabeled", Line: 5},
+	}
+	labeled, err := attachStepLabels(instructions)
+	if err != nil {
+		t.Fatalf("attachStepLabels returned error: %v", err)
+	}
+	if len(labeled) != 3 {
+		t.Fatalf("expected ID and AFTER to be folded away, got %d instructions", len(labeled))
+	}
+	run := labeled[1]
+	if run.ID != "compile" || strings.Join(run.After, ",") != "fetch,lint" {
+		t.Fatalf("expected labels on the RUN, got %#v", run)
+	}
+	if labeled[2].ID != "" || labeled[2].After != nil {
+		t.Fatalf("expected labels to apply to a single step, got %#v", labeled[2])
+	}
+
+	invalid := []struct {
+		instructions []Instruction
+		want         string
+	}{
+		{[]Instruction{{Directive: "ID", Args: "a", Line: 1}}, "must be followed by a step"},
+		{[]Instruction{{Directive: "ID", Args: "a", Line: 1}, {Directive: "ID", Args: "b", Line: 2}, {Directive: "RUN", Args: "x", Line: 3}}, "already labeled a"},
+		{[]Instruction{{Directive: "ID", Args: "a b", Line: 1}, {Directive: "RUN", Args: "x", Line: 2}}, "exactly one step name"},
+		{[]Instruction{{Directive: "AFTER", Args: "a", Line: 1}, {Directive: "CMD", Args: "x", Line: 2}}, "cannot label a CMD"},
+		{[]Instruction{{Directive: "IF", Args: "DEFINED X", Line: 1, Body: []Instruction{{Directive: "ID", Args: "a", Line: 2}}}}, "must be followed by a step"},
+	}
+	for _, tc := range invalid {
+		_, err := attachStepLabels(tc.instructions)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("attachStepLabels(%#v) error = %v, want %q", tc.instructions, err, tc.want)
+		}
+	}
+}
+
+func TestValidateSteps(t *testing.T) {
+	valid := []Instruction{
+		{Directive: "RUN", Symbol: "*", Args: "a", Line: 1, ID: "a", After: []string{"b"}},
+		{Directive: "RUN", Symbol: "*", Args: "b", Line: 2, ID: "b"},
+		{Directive: "RUN", Args: "c", Line: 3, After: []string{"a", "b"}},
+	}
+	if err := validateSteps(valid); err != nil {
+		t.Fatalf("validateSteps returned error: %v", err)
+	}
+
+	tests := []struct {
+		instructions []Instruction
+		want         string
+	}{
+		{[]Instruction{{Directive: "RUN", Args: "x", Line: 1, After: []string{"missing"}}}, "unknown step missing"},
+		{[]Instruction{
+			{Directive: "RUN", Args: "x", Line: 1, ID: "a"},
+			{Directive: "RUN", Args: "y", Line: 2, ID: "a"},
+		}, "already defined on line 1"},
+		{[]Instruction{
+			{Directive: "RUN", Args: "x", Line: 1, After: []string{"later"}},
+			{Directive: "RUN", Symbol: "*", Args: "y", Line: 2, ID: "later"},
+		}, "synchronous step cannot wait for step later"},
+		{[]Instruction{
+			{Directive: "RUN", Symbol: "*", Args: "x", Line: 1, ID: "a", After: []string{"c"}},
+			{Directive: "RUN", Symbol: "*", Args: "y", Line: 2, ID: "b", After: []string{"a"}},
+			{Directive: "RUN", Symbol: "*", Args: "z", Line: 3, ID: "c", After: []string{"b"}},
+		}, "a -> c -> b -> a"},
+		{[]Instruction{{Directive: "FOR", Args: "x IN a b", Line: 1, Body: []Instruction{
+			{Directive: "RUN", Args: "x", Line: 2, ID: "looped"},
+		}}}, "cannot be labeled inside a FOR block"},
+	}
+	for _, tc := range tests {
+		err := validateSteps(tc.instructions)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("validateSteps error = %v, want %q", err, tc.want)
+		}
+	}
+}
+
+func TestValidateRejectsSyncStepWaitingOnLaterStepIndirectly(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "Jettyfile")
+	content := "ID a\nAFTER b\n*RUN echo a\nAFTER a\nRUN echo s\nID b\nRUN echo b\n"
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := commands["validate"].Run(context.Background(), []string{fileName})
+	want := "line 5: synchronous step cannot wait for step a, which waits for step b that runs later (line 7)"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("expected validate to reject the indirect wait, got %v", err)
+	}
+}
+
+func TestBuildSchedulesStepsAfterTheirDependencies(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		if _, err := exec.LookPath("sh"); err != nil {
+			t.Skip("requires sh for portable sleep command")
+		}
+	}
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"AFTER generate",
+		"*RUN cat gen.txt > consumed-async.txt",
+		"ID generate",
+		"*RUN sleep 0.3 && echo generated > gen.txt",
+		"IF DEFINED JETTY_TEST_NEVER_SET",
+		"  ID optional",
+		"  RUN exit 1",
+		"END",
+		"AFTER generate optional",
+		"RUN cat gen.txt > consumed-sync.txt",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, _, err := runBuildForTest(t, buildFile)
+	if err != nil {
+		t.Fatalf("build returned error: %v\noutput:\n%s", err, strings.Join(output, "\n"))
+	}
+	assertFileContent(t, filepath.Join(dir, "consumed-async.txt"), "generated\n")
+	assertFileContent(t, filepath.Join(dir, "consumed-sync.txt"), "generated\n")
+}
+
+func TestBuildSkipsDependentsOfFailedStep(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		if _, err := exec.LookPath("sh"); err != nil {
+			t.Skip("requires sh for portable exit command")
+		}
+	}
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"ID broken",
+		"*RUN exit 3",
+		"AFTER broken",
+		"*RUN touch should-not-exist.txt",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := runBuildForTest(t, buildFile)
+	if err == nil {
+		t.Fatal("expected the failed step to fail the build")
+	}
+	if _, statErr := os.Stat(filepath.Join(dir, "should-not-exist.txt")); !os.IsNotExist(statErr) {
+		t.Fatalf("expected dependent step not to run, stat err = %v", statErr)
+	}
+}
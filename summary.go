@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+)
+
+const (
+	stepPassed  = "passed"
+	stepFailed  = "failed"
+	stepAllowed = "failed (allowed)"
+	stepCached  = "cached"
+	stepSkipped = "skipped"
+)
+
+// StepResult is the outcome of one executed instruction.
+type StepResult struct {
+	Line        int
+	Instruction string
+	Status      string
+	Error       string
+}
+
+// buildStats collects counters and step outcomes shared by every snapshot of
+// a build's state.
+type buildStats struct {
+	retries atomic.Int64
+	mu      sync.Mutex
+	steps   []StepResult
+}
+
+// stepResults returns the recorded outcomes ordered by line. Steps run in
+// the same loop iteration keep their execution order.
+func (stats *buildStats) stepResults() []StepResult {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	results := append([]StepResult(nil), stats.steps...)
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Line < results[j].Line
+	})
+	return results
+}
+
+func (state *BuildState) recordStep(inst Instruction, status string, err error) {
+	if state.Stats == nil {
+		return
+	}
+	result := StepResult{
+		Line:        inst.Line,
+		Instruction: fmt.Sprintf("%s%s %s", inst.Symbol, inst.Directive, inst.Args),
+		Status:      status,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	state.Stats.mu.Lock()
+	defer state.Stats.mu.Unlock()
+	state.Stats.steps = append(state.Stats.steps, result)
+}
+
+// hasFailedSteps reports whether any step failed, allowed or not.
+func hasFailedSteps(steps []StepResult) bool {
+	for _, step := range steps {
+		if step.Status == stepFailed || step.Status == stepAllowed {
+			return true
+		}
+	}
+	return false
+}
+
+func printStepSummary(w io.Writer, steps []StepResult) {
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "LINE\tSTATUS\tINSTRUCTION\tERROR")
+	for _, step := range steps {
+		instruction := truncateRunes(strings.Join(strings.Fields(step.Instruction), " "), 40)
+		errStr := truncateRunes(step.Error, 50)
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\n", step.Line, step.Status, instruction, errStr)
+	}
+	writer.Flush()
+}
+
+// truncateRunes shortens text to at most limit runes, ending it with "..."
+// when it is cut.
+func truncateRunes(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit-3]) + "..."
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestPrintStepSummary(t *testing.T) {
+	var output bytes.Buffer
+	printStepSummary(&output, []StepResult{
+		{Line: 1, Instruction: "RUN go test\n./...", Status: stepPassed},
+		{Line: 4, Instruction: "RUN exit 2", Status: stepFailed, Error: "shell command failed: exit status 2"},
+		{Line: 6, Instruction: "RUN echo " + strings.Repeat("é", 40), Status: stepFailed, Error: strings.Repeat("ü", 60)},
+	})
+	if !utf8.Valid(output.Bytes()) {
+		t.Fatalf("expected truncated cells to stay valid UTF-8, got %q", output.String())
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "LINE") {
+		t.Fatalf("unexpected summary:\n%s", output.String())
+	}
+	if !strings.Contains(lines[1], "passed") || !strings.Contains(lines[1], "RUN go test ./...") {
+		t.Fatalf("expected multi-line instructions on one row, got %q", lines[1])
+	}
+	if !strings.Contains(lines[2], "failed") || !strings.Contains(lines[2], "exit status 2") {
+		t.Fatalf("expected the failure row to carry its error, got %q", lines[2])
+	}
+}
+
+func TestBuildAllowFailureContinues(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		if _, err := exec.LookPath("sh"); err != nil {
+			t.Skip("requires sh for portable exit command")
+		}
+	}
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"ID lint",
+		"RUN --allow-failure exit 2",
+		"*RUN --allow-failure exit 3",
+		"AFTER lint",
+		"RUN touch after.txt",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, infos, err := runBuildForTest(t, buildFile)
+	if err != nil {
+		t.Fatalf("build returned error: %v\noutput:\n%s", err, strings.Join(output, "\n"))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "after.txt")); err != nil {
+		t.Fatalf("expected steps after an allowed failure to run: %v", err)
+	}
+	if !joinedOutputContains(output, "ALLOWED FAILURE: line 2") {
+		t.Fatalf("expected the allowed failure to be logged, got %q", output)
+	}
+	steps := infos[len(infos)-1].Steps
+	if len(steps) != 3 || steps[0].Status != stepAllowed || steps[1].Status != stepAllowed || steps[2].Status != stepPassed {
+		t.Fatalf("unexpected step results: %#v", steps)
+	}
+}
+
+func TestBuildAllowFailureDropsCacheDeclarations(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		if _, err := exec.LookPath("sh"); err != nil {
+			t.Skip("requires sh for portable false command")
+		}
+	}
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	if err := os.WriteFile(filepath.Join(dir, "in.txt"), []byte("in"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"DEP in.txt",
+		"OUT out.txt",
+		"RUN --allow-failure false",
+		"RUN echo hi > other.txt",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if output, _, err := runBuildForTest(t, buildFile); err != nil {
+		t.Fatalf("build returned error: %v\noutput:\n%s", err, strings.Join(output, "\n"))
+	}
+	records, err := listCacheEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("expected the failed step's DEP and OUT not to carry over, got %#v", records)
+	}
+}
+
+func TestBuildCommandKeepGoingPrintsSummary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		if _, err := exec.LookPath("sh"); err != nil {
+			t.Skip("requires sh for portable exit command")
+		}
+	}
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"ID broken",
+		"RUN exit 2",
+		"*RUN touch independent.txt",
+		"AFTER broken",
+		"*RUN touch dependent.txt",
+		"RUN touch later.txt",
+		"CMD touch cmd.txt",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := captureStdout(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := handleSubcommands(ctx, []string{"build", "--keep-going", "-f", buildFile})
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected the failed step to fail the build, got %v", err)
+	}
+	for _, name := range []string{"independent.txt", "later.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("expected independent step to run with --keep-going: %v", err)
+		}
+	}
+	for _, name := range []string{"dependent.txt", "cmd.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s not to be created, stat err = %v", name, err)
+		}
+	}
+	summary := output.String()
+	for _, want := range []string{"LINE", "2     failed", "3     passed", "5     skipped", "6     passed", "7     skipped"} {
+		if !strings.Contains(summary, want) {
+			t.Fatalf("expected summary to contain %q, got:\n%s", want, summary)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var targetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// parseTargetHeader splits the arguments of a `TGT name [deps...]` header into
+// the target name and its declared dependencies.
+func parseTargetHeader(args string) (string, []string, error) {
+	parts, err := splitArgs(args)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(parts) == 0 {
+		return "", nil, fmt.Errorf("TGT requires a target name")
+	}
+	for _, part := range parts {
+		if !targetNamePattern.MatchString(part) {
+			return "", nil, fmt.Errorf("invalid target name: %s", part)
+		}
+	}
+	return parts[0], parts[1:], nil
+}
+
+// groupTargets nests the instructions following each TGT header into that
+// header's Body. Instructions before the first TGT stay at the top level and
+// form the preamble every target selection runs.
+func groupTargets(instructions []Instruction) ([]Instruction, error) {
+	grouped := make([]Instruction, 0, len(instructions))
+	definedOn := make(map[string]int)
+	current := -1
+	for _, inst := range instructions {
+		if inst.Directive != "TGT" {
+			if current >= 0 {
+				grouped[current].Body = append(grouped[current].Body, inst)
+			} else {
+				grouped = append(grouped, inst)
+			}
+			continue
+		}
+		name, _, err := parseTargetHeader(inst.Args)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", inst.location(), err)
+		}
+		if line, ok := definedOn[name]; ok {
+			return nil, fmt.Errorf("%s: target %s is already defined on line %d", inst.location(), name, line)
+		}
+		definedOn[name] = inst.Line
+		grouped = append(grouped, inst)
+		current = len(grouped) - 1
+	}
+	return grouped, nil
+}
+
+type targetGraph struct {
+	order   []string
+	headers map[string]Instruction
+	deps    map[string][]string
+}
+
+func newTargetGraph(instructions []Instruction) (*targetGraph, error) {
+	graph := &targetGraph{
+		headers: make(map[string]Instruction),
+		deps:    make(map[string][]string),
+	}
+	for _, inst := range instructions {
+		if inst.Directive != "TGT" {
+			continue
+		}
+		name, deps, err := parseTargetHeader(inst.Args)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", inst.location(), err)
+		}
+		graph.order = append(graph.order, name)
+		graph.headers[name] = inst
+		graph.deps[name] = deps
+	}
+	return graph, nil
+}
+
+// validateTargets reports TGT dependencies that name an undefined target or
+// that form a cycle.
+func validateTargets(instructions []Instruction) error {
+	graph, err := newTargetGraph(instructions)
+	if err != nil {
+		return err
+	}
+	return graph.validate()
+}
+
+func (graph *targetGraph) validate() error {
+	for _, name := range graph.order {
+		for _, dep := range graph.deps[name] {
+			if _, ok := graph.headers[dep]; !ok {
+				return fmt.Errorf("%s: target %s depends on unknown target %s", graph.headers[name].location(), name, dep)
+			}
+		}
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make(map[string]int, len(graph.order))
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visiting:
+			start := 0
+			for i, step := range path {
+				if step == name {
+					start = i
+					break
+				}
+			}
+			cycle := append(append([]string(nil), path[start:]...), name)
+			return fmt.Errorf("%s: target dependency cycle: %s", graph.headers[name].location(), strings.Join(cycle, " -> "))
+		case visited:
+			return nil
+		}
+		marks[name] = visiting
+		path = append(path, name)
+		for _, dep := range graph.deps[name] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		marks[name] = visited
+		return nil
+	}
+	for _, name := range graph.order {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectTargets flattens a grouped instruction list into the instructions to
+// execute: the preamble followed by each requested target, with its declared
+// dependencies run first and every target run at most once. An empty
+// selection runs every target in file order.
+func selectTargets(instructions []Instruction, names []string) ([]Instruction, error) {
+	graph, err := newTargetGraph(instructions)
+	if err != nil {
+		return nil, err
+	}
+	if err := graph.validate(); err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		names = graph.order
+	}
+	var selected []Instruction
+	for _, inst := range instructions {
+		if inst.Directive != "TGT" {
+			selected = append(selected, inst)
+		}
+	}
+	done := make(map[string]bool, len(graph.order))
+	var visit func(name string)
+	visit = func(name string) {
+		if done[name] {
+			return
+		}
+		done[name] = true
+		for _, dep := range graph.deps[name] {
+			visit(dep)
+		}
+		header := graph.headers[name]
+		body := header.Body
+		header.Body = nil
+		selected = append(selected, header)
+		selected = append(selected, body...)
+	}
+	for _, name := range names {
+		if _, ok := graph.headers[name]; !ok {
+			return nil, fmt.Errorf("%w: unknown target '%s'", ErrInvalidInput, name)
+		}
+		visit(name)
+	}
+	return selected, nil
+}
+
+// countInstructions returns the number of instructions in a grouped list,
+// including those nested under TGT headers and inside blocks.
+func countInstructions(instructions []Instruction) int {
+	count := 0
+	for _, inst := range instructions {
+		count += 1 + countInstructions(inst.Body) + countInstructions(inst.Else)
+	}
+	return count
+}
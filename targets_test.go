@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFileGroupsTargets(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"ARG NAME=world",
+		"TGT build",
+		"DIR out",
+		"RUN echo build",
+		"TGT test build",
+		"RUN echo test",
+		"",
+	}, "\n")
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	instructions, err := parseFile(fileName)
+	if err != nil {
+		t.Fatalf("parseFile returned error: %v", err)
+	}
+	if len(instructions) != 3 {
+		t.Fatalf("expected preamble plus two targets, got %d instructions", len(instructions))
+	}
+	if instructions[1].Directive != "TGT" || len(instructions[1].Body) != 2 {
+		t.Fatalf("expected build target with two instructions, got %#v", instructions[1])
+	}
+	if instructions[2].Directive != "TGT" || len(instructions[2].Body) != 1 {
+		t.Fatalf("expected test target with one instruction, got %#v", instructions[2])
+	}
+	if got := countInstructions(instructions); got != 6 {
+		t.Fatalf("countInstructions = %d, want 6", got)
+	}
+}
+
+func TestParseFileRejectsDuplicateTargets(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "Jettyfile")
+	if err := os.WriteFile(fileName, []byte("TGT a\nDIR x\nTGT a\nDIR y\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := parseFile(fileName)
+	if err == nil || !strings.Contains(err.Error(), "already defined on line 1") {
+		t.Fatalf("expected duplicate target error, got %v", err)
+	}
+}
+
+func TestSelectTargetsRunsDependenciesOnce(t *testing.T) {
+	instructions := []Instruction{
+		{Directive: "ARG", Args: "A=1", Line: 1},
+		{Directive: "TGT", Args: "lint", Line: 2, Body: []Instruction{{Directive: "RUN", Args: "lint", Line: 3}}},
+		{Directive: "TGT", Args: "compile", Line: 4, Body: []Instruction{{Directive: "RUN", Args: "compile", Line: 5}}},
+		{Directive: "TGT", Args: "test compile", Line: 6, Body: []Instruction{{Directive: "RUN", Args: "test", Line: 7}}},
+		{Directive: "TGT", Args: "release test compile", Line: 8, Body: []Instruction{{Directive: "RUN", Args: "release", Line: 9}}},
+	}
+
+	selected, err := selectTargets(instructions, []string{"release"})
+	if err != nil {
+		t.Fatalf("selectTargets returned error: %v", err)
+	}
+	var runs []string
+	for _, inst := range selected {
+		if inst.Directive == "RUN" {
+			runs = append(runs, inst.Args)
+		}
+	}
+	if got := strings.Join(runs, ","); got != "compile,test,release" {
+		t.Fatalf("unexpected execution order %q", got)
+	}
+	if selected[0].Directive != "ARG" {
+		t.Fatalf("expected the preamble to run first, got %#v", selected[0])
+	}
+
+	all, err := selectTargets(instructions, nil)
+	if err != nil {
+		t.Fatalf("selectTargets returned error: %v", err)
+	}
+	if got := countInstructions(all); got != 9 {
+		t.Fatalf("expected every target to run once without a selection, got %d instructions", got)
+	}
+
+	_, err = selectTargets(instructions, []string{"missing"})
+	if !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected unknown target to be invalid input, got %v", err)
+	}
+}
+
+func TestValidateTargetsReportsUnknownAndCyclicReferences(t *testing.T) {
+	unknown := []Instruction{
+		{Directive: "TGT", Args: "a b", Line: 1},
+	}
+	if err := validateTargets(unknown); err == nil || !strings.Contains(err.Error(), "unknown target b") {
+		t.Fatalf("expected unknown target error, got %v", err)
+	}
+
+	cyclic := []Instruction{
+		{Directive: "TGT", Args: "a b", Line: 1},
+		{Directive: "TGT", Args: "b c", Line: 2},
+		{Directive: "TGT", Args: "c a", Line: 3},
+	}
+	err := validateTargets(cyclic)
+	if err == nil || !strings.Contains(err.Error(), "a -> b -> c -> a") {
+		t.Fatalf("expected cycle error, got %v", err)
+	}
+	if _, err := selectTargets(cyclic, []string{"a"}); err == nil {
+		t.Fatal("expected selectTargets to reject a cycle")
+	}
+}
+
+func TestBuildCommandRunsDottedTarget(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	content := "TGT deploy.prod\n^FMT deployed.txt \"%s\" prod\n"
+	if err := os.WriteFile(filepath.Join(dir, "Jettyfile"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := handleSubcommands(ctx, []string{"build", "deploy.prod"}); err != nil {
+		t.Fatalf("handleSubcommands returned error: %v", err)
+	}
+	assertFileContent(t, filepath.Join(dir, "deployed.txt"), "prod")
+
+	err = handleSubcommands(ctx, []string{"build", "deploy.staging"})
+	if err == nil || !strings.Contains(err.Error(), "build file deploy.staging not found") {
+		t.Fatalf("expected a missing build file error, got %v", err)
+	}
+}
+
+func TestValidateCommandReportsTargetCycle(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "Jettyfile")
+	if err := os.WriteFile(fileName, []byte("TGT a b\nDIR x\nTGT b a\nDIR y\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := commands["validate"].Run(context.Background(), []string{fileName})
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("expected validate to report the cycle, got %v", err)
+	}
+}
+
+func TestBuildCommandRunsSelectedTarget(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"DIR out",
+		"TGT compile",
+		"^FMT out/compile.txt \"%s\" compiled",
+		"TGT docs",
+		"^FMT out/docs.txt \"%s\" docs",
+		"TGT package compile",
+		"^FMT out/package.txt \"%s\" packaged",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := handleSubcommands(ctx, []string{"build", "-f", buildFile, "package"}); err != nil {
+		t.Fatalf("handleSubcommands returned error: %v", err)
+	}
+	assertFileContent(t, filepath.Join(dir, "out", "compile.txt"), "compiled")
+	assertFileContent(t, filepath.Join(dir, "out", "package.txt"), "packaged")
+	if _, err := os.Stat(filepath.Join(dir, "out", "docs.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected unselected target not to run, stat err = %v", err)
+	}
+
+	err := handleSubcommands(ctx, []string{"build", buildFile, "missing"})
+	if err == nil || !strings.Contains(err.Error(), "unknown target 'missing'") {
+		t.Fatalf("expected unknown target error, got %v", err)
+	}
+
+	for _, mistyped := range []string{filepath.Join(dir, "Jetyfile"), "Jettyfile.prod"} {
+		err = handleSubcommands(ctx, []string{"build", mistyped, "package"})
+		if err == nil || !strings.Contains(err.Error(), "build file "+mistyped+" not found") {
+			t.Fatalf("expected a missing build file error for %s, got %v", mistyped, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// asyncTask tracks one launched async instruction so a WAIT can join it.
+type asyncTask struct {
+	group   string
+	done    chan struct{}
+	err     error
+	claimed bool
+}
+
+func (task *asyncTask) finish(err error) {
+	task.err = err
+	close(task.done)
+}
+
+// parseWaitGroups validates the optional group names of a WAIT directive.
+func parseWaitGroups(args string) ([]string, error) {
+	groups, err := splitArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		if !targetNamePattern.MatchString(group) {
+			return nil, fmt.Errorf("invalid WAIT group name: %s", group)
+		}
+	}
+	return groups, nil
+}
+
+// track registers an async instruction before it is launched.
+func (runner *instructionRunner) track(inst Instruction) *asyncTask {
+	task := &asyncTask{group: inst.Options["group"], done: make(chan struct{})}
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	runner.tasks = append(runner.tasks, task)
+	return task
+}
+
+// wait blocks until every async instruction launched so far (or only those in
+// the named groups) has finished. Errors from the joined instructions are
+// claimed by the WAIT, so they are reported here instead of at the end of the
+// build.
+func (runner *instructionRunner) wait(state *BuildState, args string) error {
+	groups, err := parseWaitGroups(args)
+	if err != nil {
+		return err
+	}
+	runner.mu.Lock()
+	var pending []*asyncTask
+	for _, task := range runner.tasks {
+		if !task.claimed && waitMatchesGroup(groups, task.group) {
+			task.claimed = true
+			pending = append(pending, task)
+		}
+	}
+	runner.mu.Unlock()
+
+	var errs []error
+	for _, task := range pending {
+		<-task.done
+		if task.err != nil {
+			errs = append(errs, task.err)
+		}
+	}
+	if len(groups) > 0 {
+		state.log("WAIT %s: %d async instruction(s) finished", strings.Join(groups, " "), len(pending))
+	} else {
+		state.log("WAIT: %d async instruction(s) finished", len(pending))
+	}
+	return errors.Join(errs...)
+}
+
+// unclaimedErrors returns the errors of async instructions no WAIT joined, in
+// launch order. Call it only after every worker has finished.
+func (runner *instructionRunner) unclaimedErrors() []error {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	var errs []error
+	for _, task := range runner.tasks {
+		if !task.claimed && task.err != nil {
+			errs = append(errs, task.err)
+		}
+	}
+	return errs
+}
+
+func waitMatchesGroup(groups []string, group string) bool {
+	if len(groups) == 0 {
+		return true
+	}
+	for _, candidate := range groups {
+		if candidate == group {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseFileRecordsWaitAndGroups(t *testing.T) {
+	dir := t.TempDir()
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"*RUN --group=gen echo a",
+		"*RUN echo b",
+		"WAIT gen",
+		"WAIT",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	instructions, err := parseFile(buildFile)
+	if err != nil {
+		t.Fatalf("parseFile returned error: %v", err)
+	}
+	if len(instructions) != 4 {
+		t.Fatalf("expected 4 instructions, got %d", len(instructions))
+	}
+	if instructions[0].Options["group"] != "gen" || instructions[0].Args != "echo a" {
+		t.Fatalf("expected group option to be stripped from args, got %#v", instructions[0])
+	}
+	if instructions[2].Directive != "WAIT" || instructions[2].Args != "gen" || instructions[3].Args != "" {
+		t.Fatalf("unexpected WAIT instructions: %#v %#v", instructions[2], instructions[3])
+	}
+
+	for _, bad := range []string{"WAIT bad/name\n", "ID x\nWAIT\n"} {
+		if err := os.WriteFile(buildFile, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseFile(buildFile); err == nil {
+			t.Errorf("parseFile(%q) expected an error", bad)
+		}
+	}
+}
+
+func TestValidateStepsRejectsWaitOnLaterStep(t *testing.T) {
+	instructions := []Instruction{
+		{Directive: "RUN", Symbol: "*", Args: "x", Line: 1, After: []string{"later"}},
+		{Directive: "WAIT", Line: 2},
+		{Directive: "RUN", Symbol: "*", Args: "y", Line: 3, ID: "later"},
+	}
+	err := validateSteps(instructions)
+	if err == nil || !strings.Contains(err.Error(), "WAIT would block forever") {
+		t.Fatalf("expected WAIT deadlock to be rejected, got %v", err)
+	}
+
+	// A WAIT for a different group does not join the dependent step.
+	instructions[1].Args = "other"
+	if err := validateSteps(instructions); err != nil {
+		t.Fatalf("validateSteps returned error: %v", err)
+	}
+}
+
+func TestBuildWaitJoinsAsyncGroup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		if _, err := exec.LookPath("sh"); err != nil {
+			t.Skip("requires sh for portable sleep command")
+		}
+	}
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"*RUN --group=gen sleep 0.3 && echo generated > gen.txt",
+		"*RUN sleep 0.3",
+		"WAIT gen",
+		"RUN cat gen.txt > consumed.txt",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, _, err := runBuildForTest(t, buildFile)
+	if err != nil {
+		t.Fatalf("build returned error: %v\noutput:\n%s", err, strings.Join(output, "\n"))
+	}
+	assertFileContent(t, filepath.Join(dir, "consumed.txt"), "generated\n")
+	if !joinedOutputContains(output, "WAIT gen: 1 async instruction(s) finished") {
+		t.Fatalf("expected WAIT to report the joined group, got %q", output)
+	}
+}
+
+func TestBuildWaitSurfacesAsyncErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		if _, err := exec.LookPath("sh"); err != nil {
+			t.Skip("requires sh for portable exit command")
+		}
+	}
+	dir := t.TempDir()
+	t.Setenv(jettyStateDirEnv, filepath.Join(dir, "state"))
+	buildFile := filepath.Join(dir, "Jettyfile")
+	content := strings.Join([]string{
+		"*RUN sleep 0.2 && exit 3",
+		"WAIT",
+		"RUN touch after-wait.txt",
+		"",
+	}, "\n")
+	if err := os.WriteFile(buildFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := runBuildForTest(t, buildFile)
+	if err == nil {
+		t.Fatal("expected the async failure to fail the build")
+	}
+	if !strings.Contains(err.Error(), "line 2 [WAIT") {
+		t.Fatalf("expected the failure to be reported at the WAIT, got %v", err)
+	}
+	if strings.Count(err.Error(), "line 1 [*RUN") != 1 {
+		t.Fatalf("expected the async error to be reported once, got %v", err)
+	}
+	if _, statErr := os.Stat(filepath.Join(dir, "after-wait.txt")); !os.IsNotExist(statErr) {
+		t.Fatalf("expected instructions after WAIT not to run, stat err = %v", statErr)
+	}
+}